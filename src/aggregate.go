@@ -0,0 +1,292 @@
+package sql_planner
+
+import (
+	"errors"
+	"fmt"
+)
+
+type AggregateFunc int
+
+const (
+  Count AggregateFunc = iota + 1
+  Sum
+  Min
+  Max
+  // of INT values, truncated to an INT like integer division
+  Avg
+)
+
+func (f AggregateFunc) String() string {
+  switch f {
+  case Count:
+    return "count"
+  case Sum:
+    return "sum"
+  case Min:
+    return "min"
+  case Max:
+    return "max"
+  case Avg:
+    return "avg"
+  default:
+    return "unknown"
+  }
+}
+
+// Aggregate of one column of the input. NULLs are skipped, and an aggregate
+// of no values is NULL, except for COUNT which is 0.
+type Aggregate struct {
+  Func AggregateFunc
+  // position of the aggregated column, or -1 for COUNT(*), which counts rows
+  Column int
+  // only aggregate each distinct value once
+  Distinct bool
+}
+
+func validateAggregates(groupBy []int, aggregates []Aggregate) error {
+  for _, position := range groupBy {
+    if position < 0 {
+      return errors.New("group by column out of range")
+    }
+  }
+  for _, aggregate := range aggregates {
+    switch aggregate.Func {
+    case Count, Sum, Min, Max, Avg:
+    default:
+      return errors.New("unknown aggregate function")
+    }
+    if aggregate.Column < 0 && (aggregate.Func != Count || aggregate.Column != -1) {
+      return errors.New("aggregate column out of range")
+    }
+  }
+  return nil
+}
+
+// running state of an aggregate over one group
+type accumulator struct {
+  aggregate Aggregate
+  count int64
+  sum int64
+  // for MIN and MAX
+  value Field
+  // encoded values seen so far, for DISTINCT
+  seen map[string]bool
+}
+
+func newAccumulators(aggregates []Aggregate) []*accumulator {
+  accumulators := make([]*accumulator, 0, len(aggregates))
+  for _, aggregate := range aggregates {
+    a := &accumulator{aggregate: aggregate}
+    if aggregate.Distinct {
+      a.seen = make(map[string]bool)
+    }
+    accumulators = append(accumulators, a)
+  }
+  return accumulators
+}
+
+func (a *accumulator) add(row Row) error {
+  if a.aggregate.Column == -1 {
+    a.count++
+    return nil
+  }
+  if a.aggregate.Column >= len(row) {
+    return errors.New("aggregate column out of range")
+  }
+  f := row[a.aggregate.Column]
+  if f == nil {
+    return nil
+  }
+  if a.seen != nil {
+    key := encodeKey(Row{f})
+    if a.seen[key] {
+      return nil
+    }
+    a.seen[key] = true
+  }
+  a.count++
+  switch a.aggregate.Func {
+  case Sum, Avg:
+    v, ok := f.(IntField)
+    if !ok {
+      return fmt.Errorf("can not %s a %s value", a.aggregate.Func, f.columnType())
+    }
+    a.sum += int64(v)
+  case Min:
+    if a.value == nil || f.lessThan(a.value) {
+      a.value = f
+    }
+  case Max:
+    if a.value == nil || a.value.lessThan(f) {
+      a.value = f
+    }
+  }
+  return nil
+}
+
+func (a *accumulator) result() Field {
+  switch {
+  case a.aggregate.Func == Count:
+    return IntField(a.count)
+  case a.count == 0:
+    return nil
+  case a.aggregate.Func == Sum:
+    return IntField(a.sum)
+  case a.aggregate.Func == Avg:
+    return IntField(a.sum / a.count)
+  default:
+    return a.value
+  }
+}
+
+// output row of a group, its key followed by its aggregates
+func groupRow(key Row, accumulators []*accumulator) Row {
+  row := make(Row, 0, len(key)+len(accumulators))
+  row = append(row, key...)
+  for _, a := range accumulators {
+    row = append(row, a.result())
+  }
+  return row
+}
+
+// fields of row at positions, NULLs included
+func groupKey(row Row, positions []int) (Row, error) {
+  key := make(Row, len(positions))
+  for i, position := range positions {
+    if position >= len(row) {
+      return nil, errors.New("group by column out of range")
+    }
+    key[i] = row[position]
+  }
+  return key, nil
+}
+
+// like Row.equals, but NULLs equal each other, as they're one group
+func sameGroup(a Row, b Row) bool {
+  for i := range a {
+    if a[i] == nil || b[i] == nil {
+      if a[i] != b[i] {
+        return false
+      }
+    } else if !a[i].equals(b[i]) {
+      return false
+    }
+  }
+  return true
+}
+
+// Groups rows of any order in a hash table. Output rows are the GroupBy
+// columns followed by the aggregates, one per group in the order groups were
+// first seen. Without GroupBy there is exactly one group, even for no rows.
+type HashAggregate struct {
+  Input RowSource
+  GroupBy []int
+  Aggregates []Aggregate
+  // condition on output rows, may be nil
+  Having func(Row) bool
+  BatchSize int
+}
+
+func (h *HashAggregate) Run(output chan<- []Row) error {
+  if err := validateAggregates(h.GroupBy, h.Aggregates); err != nil {
+    return err
+  }
+  type group struct {
+    key Row
+    accumulators []*accumulator
+  }
+  groups := make(map[string]*group)
+  order := make([]*group, 0)
+  if len(h.GroupBy) == 0 {
+    order = append(order, &group{key: Row{}, accumulators: newAccumulators(h.Aggregates)})
+    groups[encodeKey(Row{})] = order[0]
+  }
+  err := drain(h.Input, func(batch []Row) error {
+    for _, row := range batch {
+      key, err := groupKey(row, h.GroupBy)
+      if err != nil {
+        return err
+      }
+      encoded := encodeKey(key)
+      g, exists := groups[encoded]
+      if !exists {
+        g = &group{key: key, accumulators: newAccumulators(h.Aggregates)}
+        groups[encoded] = g
+        order = append(order, g)
+      }
+      for _, a := range g.accumulators {
+        if err := a.add(row); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  out := newBatcher(output, h.BatchSize)
+  for _, g := range order {
+    row := groupRow(g.key, g.accumulators)
+    if h.Having == nil || h.Having(row) {
+      out.add(row)
+    }
+  }
+  out.flush()
+  return nil
+}
+
+// Aggregates input whose rows come grouped by the GroupBy columns, such as
+// rows in the order of an index that starts with them, holding only one group
+// in memory. Output is like HashAggregate's, in the order of the input.
+type StreamAggregate struct {
+  Input RowSource
+  GroupBy []int
+  Aggregates []Aggregate
+  // condition on output rows, may be nil
+  Having func(Row) bool
+  BatchSize int
+}
+
+func (s *StreamAggregate) Run(output chan<- []Row) error {
+  if err := validateAggregates(s.GroupBy, s.Aggregates); err != nil {
+    return err
+  }
+  out := newBatcher(output, s.BatchSize)
+  var key Row
+  var accumulators []*accumulator
+  finish := func() {
+    row := groupRow(key, accumulators)
+    if s.Having == nil || s.Having(row) {
+      out.add(row)
+    }
+  }
+  if len(s.GroupBy) == 0 {
+    key, accumulators = Row{}, newAccumulators(s.Aggregates)
+  }
+  err := drain(s.Input, func(batch []Row) error {
+    for _, row := range batch {
+      rowKey, err := groupKey(row, s.GroupBy)
+      if err != nil {
+        return err
+      }
+      if accumulators == nil || !sameGroup(key, rowKey) {
+        if accumulators != nil {
+          finish()
+        }
+        key, accumulators = rowKey, newAccumulators(s.Aggregates)
+      }
+      for _, a := range accumulators {
+        if err := a.add(row); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  })
+  if err == nil && accumulators != nil {
+    finish()
+  }
+  out.flush()
+  return err
+}
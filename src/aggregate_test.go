@@ -0,0 +1,247 @@
+package sql_planner
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rows of (group, subgroup, value, name), with some NULL subgroups and values,
+// sorted by group and then subgroup with NULLs first
+func randomAggregateRows(r *rand.Rand, count int) []Row {
+  rows := make([]Row, 0, count)
+  for i := 0; i < count; i++ {
+    row := Row{IntField(r.Intn(4)), IntField(r.Intn(3)), IntField(r.Intn(50) - 10), StringField(fmt.Sprintf("n%d", r.Intn(30)))}
+    if r.Intn(8) == 0 {
+      row[1] = nil
+    }
+    if r.Intn(6) == 0 {
+      row[2] = nil
+    }
+    rows = append(rows, row)
+  }
+  sort.SliceStable(rows, func(i, j int) bool {
+    a, b := rows[i], rows[j]
+    if !a[0].equals(b[0]) {
+      return a[0].lessThan(b[0])
+    }
+    if a[1] == nil || b[1] == nil {
+      return a[1] == nil && b[1] != nil
+    }
+    return a[1].lessThan(b[1])
+  })
+  return rows
+}
+
+var testAggregates = []Aggregate{
+  {Func: Count, Column: -1},
+  {Func: Count, Column: 2},
+  {Func: Sum, Column: 2},
+  {Func: Min, Column: 2},
+  {Func: Max, Column: 3},
+  {Func: Avg, Column: 2},
+  {Func: Count, Column: 2, Distinct: true},
+  {Func: Sum, Column: 2, Distinct: true},
+}
+
+// testAggregates the slow way, for rows of one group
+func naiveAggregates(key Row, rows []Row) Row {
+  var count, values, sum, distinctSum int64
+  var min, max Field
+  distinct := make(map[IntField]bool)
+  for _, row := range rows {
+    count++
+    if row[2] != nil {
+      v := row[2].(IntField)
+      values++
+      sum += int64(v)
+      if !distinct[v] {
+        distinct[v] = true
+        distinctSum += int64(v)
+      }
+      if min == nil || v.lessThan(min) {
+        min = v
+      }
+    }
+    if max == nil || max.lessThan(row[3]) {
+      max = row[3]
+    }
+  }
+  result := append(Row{}, key...)
+  result = append(result, IntField(count), IntField(values))
+  if values == 0 {
+    return append(result, nil, nil, max, nil, IntField(0), nil)
+  }
+  return append(result, IntField(sum), min, max, IntField(sum/values), IntField(len(distinct)), IntField(distinctSum))
+}
+
+func TestAggregate(t *testing.T) {
+  rows := randomAggregateRows(rand.New(rand.NewSource(3)), 300)
+  groups := make(map[string][]Row)
+  keys := make([]Row, 0)
+  for _, row := range rows {
+    key := Row{row[0], row[1]}
+    if _, exists := groups[encodeKey(key)]; !exists {
+      keys = append(keys, key)
+    }
+    groups[encodeKey(key)] = append(groups[encodeKey(key)], row)
+  }
+  expected := make([]Row, 0)
+  for _, key := range keys {
+    expected = append(expected, naiveAggregates(key, groups[encodeKey(key)]))
+  }
+
+  hashRows, err := collectRows((&HashAggregate{
+    Input:      rowsSource(rows, 7),
+    GroupBy:    []int{0, 1},
+    Aggregates: testAggregates,
+  }).Run)
+  require.NoError(t, err)
+  require.Equal(t, expected, hashRows)
+
+  // groups come out in the order of the input
+  streamRows, err := collectRows((&StreamAggregate{
+    Input:      rowsSource(rows, 7),
+    GroupBy:    []int{1, 0},
+    Aggregates: testAggregates,
+  }).Run)
+  require.NoError(t, err)
+  for i, row := range streamRows {
+    row[0], row[1] = row[1], row[0]
+    require.Equal(t, expected[i], row)
+  }
+  require.Len(t, streamRows, len(expected))
+
+  // without GROUP BY, all rows are one group
+  for _, run := range []RowSource{
+    (&HashAggregate{Input: rowsSource(rows, 7), Aggregates: testAggregates}).Run,
+    (&StreamAggregate{Input: rowsSource(rows, 7), Aggregates: testAggregates}).Run,
+  } {
+    total, err := collectRows(run)
+    require.NoError(t, err)
+    require.Equal(t, []Row{naiveAggregates(Row{}, rows)}, total)
+  }
+}
+
+func TestAggregateEmpty(t *testing.T) {
+  for _, groupBy := range [][]int{nil, {0}} {
+    hashRows, err := collectRows((&HashAggregate{Input: rowsSource(nil, 1), GroupBy: groupBy, Aggregates: testAggregates}).Run)
+    require.NoError(t, err)
+    streamRows, err := collectRows((&StreamAggregate{Input: rowsSource(nil, 1), GroupBy: groupBy, Aggregates: testAggregates}).Run)
+    require.NoError(t, err)
+    require.Equal(t, hashRows, streamRows)
+    if groupBy == nil {
+      require.Equal(t, []Row{naiveAggregates(Row{}, nil)}, hashRows)
+    } else {
+      require.Empty(t, hashRows)
+    }
+  }
+}
+
+func TestAggregateHaving(t *testing.T) {
+  rows := randomAggregateRows(rand.New(rand.NewSource(5)), 100)
+  having := func(row Row) bool { return row[1].(IntField) > 25 }
+  for _, run := range []RowSource{
+    (&HashAggregate{Input: rowsSource(rows, 3), GroupBy: []int{0}, Aggregates: testAggregates[:1], Having: having}).Run,
+    (&StreamAggregate{Input: rowsSource(rows, 3), GroupBy: []int{0}, Aggregates: testAggregates[:1], Having: having}).Run,
+  } {
+    result, err := collectRows(run)
+    require.NoError(t, err)
+    count := 0
+    for _, row := range result {
+      require.Greater(t, int(row[1].(IntField)), 25)
+      count += int(row[1].(IntField))
+    }
+    require.Less(t, count, 100)
+  }
+}
+
+func TestAggregateInvalid(t *testing.T) {
+  rows := []Row{{IntField(1), StringField("a")}}
+  for _, aggregate := range []Aggregate{
+    {Func: Sum, Column: 1},
+    {Func: AggregateFunc(42), Column: 0},
+    {Func: Sum, Column: -1},
+    {Func: Count, Column: 5},
+  } {
+    _, err := collectRows((&HashAggregate{Input: rowsSource(rows, 1), Aggregates: []Aggregate{aggregate}}).Run)
+    require.Error(t, err, "%+v", aggregate)
+    _, err = collectRows((&StreamAggregate{Input: rowsSource(rows, 1), Aggregates: []Aggregate{aggregate}}).Run)
+    require.Error(t, err, "%+v", aggregate)
+  }
+}
+
+func TestPlanAggregate(t *testing.T) {
+  db := createQueryDatabase(t)
+  users, _ := db.Table("users")
+  usersByAge := users.Indices()[0]
+  aggregates := []AggregateColumn{{Func: Count}, {Func: Max, Column: "id"}}
+
+  plan, err := PlanAggregate(IndexScan(users, usersByAge), []string{"age"}, aggregates, nil)
+  require.NoError(t, err)
+  require.True(t, plan.Streaming)
+  require.Equal(t, []Column{
+    {Name: "users.age", ColumnType: INT},
+    {Name: "count(*)", ColumnType: INT},
+    {Name: "max(users.id)", ColumnType: INT},
+  }, plan.Columns())
+  rows, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  require.Len(t, rows, 20)
+  for age, row := range rows {
+    require.Equal(t, Row{IntField(age), IntField(10), IntField(180 + age)}, row)
+  }
+
+  plan, err = PlanAggregate(FullScan(users), []string{"age"}, aggregates, nil)
+  require.NoError(t, err)
+  require.False(t, plan.Streaming)
+  hashed, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  require.ElementsMatch(t, rows, hashed)
+
+  for _, aggregates := range [][]AggregateColumn{
+    {{Func: Sum}},
+    {{Func: Sum, Column: "nope"}},
+  } {
+    _, err = PlanAggregate(FullScan(users), nil, aggregates, nil)
+    require.Error(t, err)
+  }
+  _, err = PlanAggregate(FullScan(users), []string{"nope"}, nil, nil)
+  require.Error(t, err)
+}
+
+func TestQueryAggregate(t *testing.T) {
+  db := createQueryDatabase(t)
+  // grouped by the primary key, which the primary index delivers in order
+  plan, err := db.Plan(Query{
+    Tables:     []string{"users", "pets"},
+    Joins:      []JoinCondition{{Left: "users.id", Right: "pets.ownerId"}},
+    GroupBy:    []string{"users.id"},
+    Aggregates: []AggregateColumn{{Func: Count}},
+    Having:     func(row Row) bool { return row[1].(IntField) > 1 },
+  })
+  require.NoError(t, err)
+  require.Contains(t, plan.Explain(), "aggregate group by users.id computing count(*) having a condition")
+
+  // pet i belongs to owner 7i % 250, so pets i and i + 250 share an owner
+  rows, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  expected := make([]Row, 0)
+  for i := 0; i < 50; i++ {
+    if owner := (i * 7) % 250; owner < 200 {
+      expected = append(expected, Row{IntField(owner), IntField(2)})
+    }
+  }
+  require.ElementsMatch(t, expected, rows)
+
+  single, err := db.Plan(Query{
+    Tables:     []string{"users"},
+    GroupBy:    []string{"users.id"},
+    Aggregates: []AggregateColumn{{Func: Sum, Column: "users.age"}},
+  })
+  require.NoError(t, err)
+  require.True(t, single.Root.(*AggregatePlan).Streaming)
+}
@@ -0,0 +1,421 @@
+package sql_planner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// rows copied from the primary index at a time while backfilling an index
+const backfillBatchSize = 100
+
+func sameSchema(a []Column, b []Column) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// Adds a secondary index on columns and fills it from the primary index, while
+// writes to the table carry on. Rows written during the backfill go to the new
+// index directly, and rows deleted during it are checked again at the end. The
+// index only shows up in Indices once it's complete.
+func (t *Table) AddIndex(columns []string) (*Index, error) {
+  return t.AddIndexIncluding(columns, nil)
+}
+
+// Like AddIndex, but the index also stores the include columns, after the
+// primary key. They aren't part of its order, but queries that read only
+// columns of the index are answered from it without reading the table.
+func (t *Table) AddIndexIncluding(columns []string, include []string) (*Index, error) {
+  return t.AddPartialIndex(columns, include, nil)
+}
+
+// Like AddIndexIncluding, but only rows where is true for are in the index,
+// which it checks as rows are written. where is over the table's columns, and
+// nil makes a full index. The optimizer only reads a partial index for queries
+// whose conditions make sure every row they want is in it.
+func (t *Table) AddPartialIndex(columns []string, include []string, where Expr) (*Index, error) {
+  keys := make([]Expr, 0, len(columns))
+  for _, name := range columns {
+    keys = append(keys, ColumnRef(name))
+  }
+  return t.AddExpressionIndex(keys, include, where)
+}
+
+// Like AddPartialIndex, but the index is on keys, expressions over the table's
+// columns such as Lower(ColumnRef("email")), which are computed as rows are
+// written. Rows that an expression is NULL for, or fails on, aren't in the
+// index. The optimizer reads it for queries that compare each of its
+// expressions to a value.
+func (t *Table) AddExpressionIndex(keys []Expr, include []string, where Expr) (*Index, error) {
+  return t.addIndex(keys, include, where, false)
+}
+
+// Like AddIndex, but no two rows of the table can have the same values of
+// columns. Writes that would give a row the values another row has fail with
+// ErrUniqueViolation, as does building the index if two rows already do.
+func (t *Table) AddUniqueIndex(columns []string) (*Index, error) {
+  keys := make([]Expr, 0, len(columns))
+  for _, name := range columns {
+    keys = append(keys, ColumnRef(name))
+  }
+  return t.addIndex(keys, nil, nil, true)
+}
+
+func (t *Table) addIndex(keys []Expr, include []string, where Expr, unique bool) (*Index, error) {
+  t.alterMutex.Lock()
+  defer t.alterMutex.Unlock()
+
+  t.mutex.Lock()
+  index, err := newSecondaryIndex(keys, include, where, t.primaryKey(), t.schema)
+  if err == nil && unique {
+    names := make([]string, 0, len(keys))
+    for _, key := range keys {
+      names = appendUnique(names, key.String())
+    }
+    index.unique = len(names)
+  }
+  if err == nil {
+    for _, existing := range t.indices {
+      if sameSchema(existing.schema, index.schema) && sameWhere(existing.where, where) && existing.unique == index.unique {
+        err = errors.New("index already exists")
+      }
+    }
+  }
+  if err != nil {
+    t.mutex.Unlock()
+    return nil, err
+  }
+  index.building = true
+  // from here on every write to the table also goes to the new index
+  t.indices = append(append(make([]*Index, 0, len(t.indices)+1), t.indices...), index)
+  t.mutex.Unlock()
+
+  err = pipe(context.Background(), func(ctx context.Context, output chan<- []Row) error {
+    return t.primaryIndex.traversePaginated(ctx, QueryPredicate{
+      LowerBound: NegativeInfinity{},
+      UpperBound: Infinity{},
+      Limit:      NoLimit,
+    }, backfillBatchSize, output)
+  }, func(rowBatch []Row) error {
+    t.uniqueMutex.Lock()
+    defer t.uniqueMutex.Unlock()
+    for _, row := range rowBatch {
+      entry, belongs, err := index.checkedEntry(row, t.primaryIndex.schema)
+      if err != nil {
+        return err
+      }
+      if !belongs {
+        continue
+      }
+      // writes since the build began may already have added the row
+      if index.unique > 0 && t.conflicts(index, index.unique, entry, nil) {
+        return fmt.Errorf("%w: %v", ErrUniqueViolation, entry[:index.unique])
+      }
+      index.insertEntry(entry)
+    }
+    return nil
+  })
+  if err != nil {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    t.removeIndex(index)
+    return nil, err
+  }
+
+  // no writes while catching up with the deletes
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  index.mutex.Lock()
+  defer index.mutex.Unlock()
+  for _, row := range index.buildLog {
+    // the backfill may have copied the row before it was deleted
+    entry, belongs := index.entry(row, t.schema)
+    if belongs && t.searchPrimaryIndex(reorderRowBySchema(row, t.schema, t.primaryIndex.schema)) == nil {
+      index.btree = index.btree.Delete(entry)
+    }
+  }
+  index.building = false
+  index.buildLog = nil
+  return index, nil
+}
+
+// Index on keys that hasn't been filled yet. Keys that are ColumnRefs are
+// columns of the table, and the others are computed, and named after their
+// expression.
+func newSecondaryIndex(keys []Expr, include []string, where Expr, primaryKey []string, tableSchema []Column) (*Index, error) {
+  index := &Index{btree: new(BTree), where: where}
+  nameToType := schemaTypes(tableSchema)
+  columns := make([]string, 0, len(keys))
+  for _, key := range keys {
+    if ref, ok := key.(columnRef); ok {
+      columns = append(columns, ref.name)
+      continue
+    }
+    compiled, err := Compile(key, tableSchema)
+    if err != nil {
+      return nil, err
+    }
+    column := Column{Name: key.String(), ColumnType: compiled.Type}
+    if _, exists := nameToType[column.Name]; !exists {
+      nameToType[column.Name] = column.ColumnType
+      index.computed = append(index.computed, computedColumn{column: column, expr: key})
+    }
+    columns = append(columns, column.Name)
+  }
+  schema, err := secondaryIndexSchema(columns, include, primaryKey, nameToType)
+  if err != nil {
+    return nil, err
+  }
+  index.schema = schema
+  if err := index.compile(tableSchema); err != nil {
+    return nil, err
+  }
+  return index, nil
+}
+
+func sameWhere(a Expr, b Expr) bool {
+  if a == nil || b == nil {
+    return a == nil && b == nil
+  }
+  return a.String() == b.String()
+}
+
+func (t *Table) DropIndex(index *Index) error {
+  t.alterMutex.Lock()
+  defer t.alterMutex.Unlock()
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  if index == t.primaryIndex {
+    return errors.New("can not drop the primary index")
+  }
+  if !t.removeIndex(index) {
+    return errors.New("index does not belong to table")
+  }
+  return nil
+}
+
+// takes index out of the table's indices, false if it isn't one of them
+func (t *Table) removeIndex(index *Index) bool {
+  for i, existing := range t.indices {
+    if existing == index {
+      indices := append(make([]*Index, 0, len(t.indices)-1), t.indices[:i]...)
+      t.indices = append(indices, t.indices[i+1:]...)
+      return true
+    }
+  }
+  return false
+}
+
+// every row of the index, in order
+func (i *Index) rows() []Row {
+  output := make(chan Row)
+  go func() {
+    defer close(output)
+    i.tree().TraverseAll(output)
+  }()
+  rows := make([]Row, 0)
+  for row := range output {
+    rows = append(rows, row)
+  }
+  return rows
+}
+
+func columnPosition(schema []Column, name string) int {
+  for i, col := range schema {
+    if col.Name == name {
+      return i
+    }
+  }
+  return -1
+}
+
+// replaces the index's rows and schema, the rows must be sorted and unique
+func (i *Index) replace(schema []Column, rows []Row) {
+  tree := bulkLoad(rows, i.tree().uncompressed)
+  i.mutex.Lock()
+  defer i.mutex.Unlock()
+  i.schema = schema
+  i.btree = tree
+}
+
+// Adds a column to the end of the schema, with value defaultValue in every
+// existing row. No writes can happen while the primary index is rewritten.
+func (t *Table) AddColumn(col Column, defaultValue Field) error {
+  t.alterMutex.Lock()
+  defer t.alterMutex.Unlock()
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+
+  if col.Name == "" {
+    return errors.New("column name can not be empty")
+  }
+  if columnPosition(t.schema, col.Name) >= 0 {
+    return errors.New("column already exists")
+  }
+  if defaultValue == nil || defaultValue.columnType() != col.ColumnType {
+    return errors.New("default value does not match column type")
+  }
+  // the new column goes last in the primary index too, so the order of
+  // existing rows doesn't change
+  rows := t.primaryIndex.rows()
+  for i, row := range rows {
+    rows[i] = append(row.copy(), defaultValue)
+    // each row holds the value
+    t.strings.intern(rows[i][len(row):])
+  }
+  t.schema = append(append(make([]Column, 0, len(t.schema)+1), t.schema...), col)
+  primarySchema := append(append(make([]Column, 0, len(t.schema)), t.primaryIndex.schema...), col)
+  t.primaryIndex.replace(primarySchema, rows)
+  return nil
+}
+
+// Removes a column. Columns of the primary key can't be dropped, nor can a
+// column that is all two rows differ in. If the column is part of a secondary
+// index, or of its condition, the index is dropped along with it when cascade
+// is set, otherwise the column isn't dropped.
+func (t *Table) DropColumn(name string, cascade bool) error {
+  t.alterMutex.Lock()
+  defer t.alterMutex.Unlock()
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+
+  position := columnPosition(t.primaryIndex.schema, name)
+  if position < 0 {
+    return errors.New("column does not exist")
+  }
+  if position < t.primaryKeyLength {
+    return errors.New("can not drop a primary key column")
+  }
+  if len(t.schema) == 1 {
+    return errors.New("can not drop the only column")
+  }
+  indices := make([]*Index, 0, len(t.indices))
+  for _, index := range t.indices {
+    if !index.uses(name) {
+      indices = append(indices, index)
+    } else if !cascade {
+      return errors.New("column is used by an index")
+    }
+  }
+
+  rows := t.primaryIndex.rows()
+  dropped := make(Row, len(rows))
+  for i, row := range rows {
+    dropped[i] = row[position]
+    rows[i] = append(row[:position:position], row[position+1:]...)
+  }
+  // rows that only differ in the dropped column would be one row without it
+  sort.SliceStable(rows, func(a, b int) bool { return rows[a].lessThan(rows[b]) })
+  for i := 1; i < len(rows); i++ {
+    if rows[i-1].equals(rows[i]) {
+      return fmt.Errorf("two rows would be %v without column %s", rows[i], name)
+    }
+  }
+
+  tablePosition := columnPosition(t.schema, name)
+  t.schema = append(append(make([]Column, 0, len(t.schema)-1), t.schema[:tablePosition]...), t.schema[tablePosition+1:]...)
+  primarySchema := append(
+    append(make([]Column, 0, len(t.primaryIndex.schema)-1), t.primaryIndex.schema[:position]...),
+    t.primaryIndex.schema[position+1:]...,
+  )
+  t.primaryIndex.replace(primarySchema, rows)
+  t.strings.release(dropped)
+  t.indices = indices
+  for _, index := range t.indices {
+    if index.partial() {
+      // can't fail, the index doesn't read the dropped column
+      _ = index.compile(t.schema)
+    }
+  }
+  return nil
+}
+
+// Renames a column everywhere it's used, including the conditions and
+// expressions of indices. Rows are stored by position, so only the schemas
+// change.
+func (t *Table) RenameColumn(oldName string, newName string) error {
+  t.alterMutex.Lock()
+  defer t.alterMutex.Unlock()
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+
+  if newName == "" {
+    return errors.New("column name can not be empty")
+  }
+  if columnPosition(t.schema, oldName) < 0 {
+    return errors.New("column does not exist")
+  }
+  if columnPosition(t.schema, newName) >= 0 {
+    return errors.New("column already exists")
+  }
+  renameColumn := func(name string) string {
+    if name == oldName {
+      return newName
+    }
+    return name
+  }
+  rename := func(schema []Column, names func(string) string) []Column {
+    renamed := make([]Column, len(schema))
+    for i, col := range schema {
+      col.Name = names(col.Name)
+      renamed[i] = col
+    }
+    return renamed
+  }
+  schema := rename(t.schema, renameColumn)
+
+  // computed columns are named after their expressions, so they're renamed
+  // along with them
+  type renamedIndex struct {
+    where Expr
+    computed []computedColumn
+    names map[string]string
+  }
+  renamed := make([]renamedIndex, len(t.indices))
+  for k, index := range t.indices {
+    r := renamedIndex{where: index.where, names: map[string]string{oldName: newName}}
+    if r.where != nil {
+      r.where = r.where.withColumns(renameColumn)
+    }
+    for _, c := range index.computed {
+      expr := c.expr.withColumns(renameColumn)
+      column := Column{Name: expr.String(), ColumnType: c.column.ColumnType}
+      if column.Name != c.column.Name && columnPosition(schema, column.Name) >= 0 {
+        return fmt.Errorf("column %s already exists", column.Name)
+      }
+      r.names[c.column.Name] = column.Name
+      r.computed = append(r.computed, computedColumn{column: column, expr: expr})
+    }
+    renamed[k] = r
+  }
+
+  t.schema = schema
+  t.primaryIndex.mutex.Lock()
+  t.primaryIndex.schema = rename(t.primaryIndex.schema, renameColumn)
+  t.primaryIndex.mutex.Unlock()
+  for k, index := range t.indices {
+    names := renamed[k].names
+    index.mutex.Lock()
+    index.schema = rename(index.schema, func(name string) string {
+      if renamedName, ok := names[name]; ok {
+        return renamedName
+      }
+      return name
+    })
+    index.where, index.computed = renamed[k].where, renamed[k].computed
+    index.mutex.Unlock()
+    if index.partial() {
+      // can't fail, the expressions read the same columns as before
+      _ = index.compile(t.schema)
+    }
+  }
+  return nil
+}
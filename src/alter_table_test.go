@@ -0,0 +1,483 @@
+package sql_planner
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddIndex(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+
+  index, err := table.AddIndex([]string{"age"})
+  require.NoError(t, err)
+  require.Equal(t, []Column{
+    {Name: "age", ColumnType: INT},
+    {Name: "id", ColumnType: INT},
+    {Name: "isActive", ColumnType: BOOL},
+  }, index.schema)
+  require.Equal(t, []*Index{table.indices[0], index}, table.Indices())
+  require.Equal(t, []Row{rows[2], rows[3], rows[6], rows[7]}, table.ListWithIndex(index, Row{IntField(1)}))
+
+  // new writes go to the new index too
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(1), IntField(0), BoolField(true)}))
+  require.NoError(t, table.Delete(table.primaryIndex, Row{IntField(12)}))
+  require.Equal(t, []Row{
+    {StringField("momo@sheen.com"), IntField(1), IntField(0), BoolField(true)},
+    rows[2], rows[3], rows[7],
+  }, table.ListWithIndex(index, Row{IntField(1)}))
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  _, err = table.AddIndex([]string{"age"})
+  require.Error(t, err)
+  _, err = table.AddIndex([]string{"height"})
+  require.Error(t, err)
+}
+
+func TestAddIndexIncluding(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+
+  index, err := table.AddIndexIncluding([]string{"isActive"}, []string{"age", "id"})
+  require.NoError(t, err)
+  require.Equal(t, []Column{
+    {Name: "isActive", ColumnType: BOOL},
+    {Name: "id", ColumnType: INT},
+    {Name: "age", ColumnType: INT},
+  }, index.schema)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  scan := func(index *Index, columns []string) []Row {
+    rows, err := collectRows(table.Scan(index, QueryPredicate{
+      LowerBound: InclusiveBound(Row{BoolField(false)}),
+      UpperBound: ExclusiveBound(Row{BoolField(false)}),
+      Limit:      NoLimit,
+      Columns:    columns,
+    }, DefaultBatchSize))
+    require.NoError(t, err)
+    return rows
+  }
+  // the index has every column read, so the email isn't looked up
+  require.Equal(t, []Row{
+    {nil, IntField(1), IntField(2), BoolField(false)},
+    {nil, IntField(1), IntField(12), BoolField(false)},
+  }, scan(index, []string{"age", "isActive"}))
+  require.Equal(t, []Row{rows[2], rows[6]}, scan(index, []string{"age", "email"}))
+  require.Equal(t, []Row{rows[2], rows[6]}, scan(index, nil))
+
+  // updates through a covering predicate still write whole rows
+  require.NoError(t, table.Update(index, QueryPredicate{
+    LowerBound: InclusiveBound(Row{BoolField(false)}),
+    UpperBound: ExclusiveBound(Row{BoolField(false)}),
+    Limit:      NoLimit,
+    Columns:    []string{"isActive"},
+  }, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(5)}))
+  require.Equal(t, StringField("toto@sheen.com"), scan(index, nil)[0][0])
+  report = table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  _, err = table.AddIndexIncluding([]string{"age"}, []string{"height"})
+  require.Error(t, err)
+}
+
+func TestAddPartialIndex(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+
+  index, err := table.AddPartialIndex([]string{"age"}, nil, ColumnRef("isActive"))
+  require.NoError(t, err)
+  require.Equal(t, []Row{rows[3], rows[7]}, table.ListWithIndex(index, Row{IntField(1)}))
+
+  // rows only go in when they meet the condition, and move as it changes
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(1), IntField(0), BoolField(true)}))
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(1), IntField(50), BoolField(false)}))
+  require.Len(t, table.ListWithIndex(index, Row{IntField(1)}), 3)
+  require.NoError(t, table.Delete(table.primaryIndex, Row{IntField(8)}))
+  require.NoError(t, table.Update(table.primaryIndex, QueryPredicate{
+    LowerBound: InclusiveBound(Row{IntField(50)}),
+    UpperBound: ExclusiveBound(Row{IntField(50)}),
+    Limit:      NoLimit,
+  }, map[Column]Field{{Name: "isActive", ColumnType: BOOL}: BoolField(true)}))
+  require.Equal(t, []Row{
+    {StringField("momo@sheen.com"), IntField(1), IntField(0), BoolField(true)},
+    rows[7],
+    {StringField("momo@sheen.com"), IntField(1), IntField(50), BoolField(true)},
+  }, table.ListWithIndex(index, Row{IntField(1)}))
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+  require.Equal(t, 7, report.RowCounts[index])
+
+  // the same columns with another condition is another index
+  _, err = table.AddPartialIndex([]string{"age"}, nil, Not(ColumnRef("isActive")))
+  require.NoError(t, err)
+  _, err = table.AddPartialIndex([]string{"age"}, nil, ColumnRef("isActive"))
+  require.Error(t, err)
+  _, err = table.AddPartialIndex([]string{"age"}, nil, ColumnRef("email"))
+  require.Error(t, err)
+
+  // the condition follows the column it reads
+  require.NoError(t, table.RenameColumn("isActive", "active"))
+  require.Equal(t, "active", index.Where().String())
+  require.NoError(t, table.AddColumn(Column{Name: "height", ColumnType: INT}, IntField(0)))
+  require.NoError(t, table.Insert(Row{StringField("a@sheen.com"), IntField(1), IntField(100), BoolField(true), IntField(5)}))
+  require.NoError(t, table.Insert(Row{StringField("a@sheen.com"), IntField(1), IntField(101), BoolField(false), IntField(5)}))
+  require.Len(t, table.ListWithIndex(index, Row{IntField(1)}), 4)
+  index, err = table.AddPartialIndex([]string{"email"}, nil, Compare(Greater, ColumnRef("height"), Literal(IntField(1))))
+  require.NoError(t, err)
+  require.Error(t, table.DropColumn("height", false))
+  require.NoError(t, table.DropColumn("height", true))
+  require.NotContains(t, table.Indices(), index)
+}
+
+func TestAddExpressionIndex(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+
+  upper, err := table.AddExpressionIndex([]Expr{Upper(ColumnRef("email"))}, nil, nil)
+  require.NoError(t, err)
+  require.Equal(t, Column{Name: "UPPER(email)", ColumnType: STRING}, upper.Schema()[0])
+  require.Equal(t, []Row{rows[0], rows[3], rows[4], rows[7]}, table.ListWithIndex(upper, Row{StringField("DOODLE@SHEEN.COM")}))
+
+  // rows an expression fails on aren't in the index
+  ratio, err := table.AddExpressionIndex([]Expr{Arithmetic(Divide, Literal(IntField(12)), ColumnRef("age"))}, nil, nil)
+  require.NoError(t, err)
+  require.NoError(t, table.Insert(Row{StringField("Momo@sheen.com"), IntField(0), IntField(50), BoolField(true)}))
+  require.Equal(t, []Row{rows[2], rows[3], rows[6], rows[7]}, table.ListWithIndex(ratio, Row{IntField(12)}))
+  require.Len(t, table.ListWithIndex(upper, Row{StringField("MOMO@SHEEN.COM")}), 1)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+  require.Equal(t, 8, report.RowCounts[ratio])
+
+  require.NoError(t, table.Update(table.primaryIndex, QueryPredicate{
+    LowerBound: InclusiveBound(Row{IntField(50)}),
+    UpperBound: ExclusiveBound(Row{IntField(50)}),
+    Limit:      NoLimit,
+  }, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(4)}))
+  require.Equal(t, []Row{
+    {StringField("Momo@sheen.com"), IntField(4), IntField(50), BoolField(true)},
+  }, table.ListWithIndex(ratio, Row{IntField(3)}))
+  report = table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  _, err = table.AddExpressionIndex([]Expr{Upper(ColumnRef("email"))}, nil, nil)
+  require.Error(t, err)
+  _, err = table.AddExpressionIndex([]Expr{Upper(ColumnRef("age"))}, nil, nil)
+  require.Error(t, err)
+
+  require.Error(t, table.DropColumn("age", false))
+  require.NoError(t, table.DropColumn("age", true))
+  require.NotContains(t, table.Indices(), ratio)
+  require.NoError(t, table.Insert(Row{StringField("a@sheen.com"), IntField(60), BoolField(true)}))
+  require.Len(t, table.ListWithIndex(upper, Row{StringField("A@SHEEN.COM")}), 1)
+  report = table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+}
+
+func TestRenameColumnExpressionIndex(t *testing.T) {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "email", ColumnType: STRING},
+    {Name: "age", ColumnType: INT},
+  }, []string{"id"})
+  require.NoError(t, err)
+  for i := 0; i < 1000; i++ {
+    require.NoError(t, users.Insert(Row{IntField(i), StringField(fmt.Sprintf("User%d@sheen.com", i)), IntField(i % 90)}))
+  }
+  index, err := db.CreateExpressionIndex("users_email", "users", []Expr{Lower(ColumnRef("email"))}, nil,
+    Compare(Greater, ColumnRef("age"), Literal(IntField(17))))
+  require.NoError(t, err)
+
+  // the expressions, and the columns named after them, follow the columns
+  require.NoError(t, users.RenameColumn("email", "mail"))
+  require.NoError(t, users.RenameColumn("age", "years"))
+  require.Equal(t, "LOWER(mail)", index.Keys()[0].String())
+  require.Equal(t, Column{Name: "LOWER(mail)", ColumnType: STRING}, index.Schema()[0])
+  require.Equal(t, "years > 17", index.Where().String())
+
+  require.NoError(t, users.Insert(Row{IntField(1000), StringField("Momo@sheen.com"), IntField(30)}))
+  require.NoError(t, users.Insert(Row{IntField(1001), StringField("Momo@sheen.com"), IntField(3)}))
+  require.NoError(t, users.Delete(users.PrimaryIndex(), Row{IntField(20)}))
+  report := users.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  for _, test := range []struct {
+    email string
+    expected []Row
+  }{
+    {"momo@sheen.com", []Row{{IntField(1000)}}},
+    {"user20@sheen.com", []Row{}},
+    {"user21@sheen.com", []Row{{IntField(21)}}},
+  } {
+    plan, err := db.Plan(Query{Tables: []string{"users"}, Where: And(
+      Compare(Equal, Lower(ColumnRef("mail")), Literal(StringField(test.email))),
+      Compare(Greater, ColumnRef("years"), Literal(IntField(17))),
+    )})
+    require.NoError(t, err)
+    require.Equal(t, index, plan.Root.(*ScanPlan).Index, plan.Explain())
+    require.ElementsMatch(t, test.expected, runPlan(t, plan.Root, "users.id"))
+  }
+}
+
+func TestAddIndexDuringWrites(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 2000)
+
+  done := make(chan struct{})
+  writerDone := make(chan struct{})
+  go func() {
+    defer close(writerDone)
+    for i := 0; ; i++ {
+      select {
+      case <-done:
+        return
+      default:
+      }
+      require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(i % 7), IntField(100000 + i), BoolField(true)}))
+      require.NoError(t, table.Delete(table.primaryIndex, Row{IntField(10 * (i % 200) + 1)}))
+      require.NoError(t, table.Update(table.primaryIndex, QueryPredicate{
+        LowerBound: InclusiveBound(Row{IntField(10 * (i % 200) + 8)}),
+        UpperBound: ExclusiveBound(Row{IntField(10 * (i % 200) + 8)}),
+        Limit:      NoLimit,
+      }, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(i)}))
+    }
+  }()
+  index, err := table.AddIndex([]string{"age", "email"})
+  close(done)
+  <-writerDone
+  require.NoError(t, err)
+  require.Contains(t, table.Indices(), index)
+
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+}
+
+func TestDropIndex(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 8)
+  index, err := table.AddIndex([]string{"age"})
+  require.NoError(t, err)
+
+  require.NoError(t, table.DropIndex(table.indices[0]))
+  require.Equal(t, []*Index{index}, table.Indices())
+  // later writes don't touch the dropped index
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(1), IntField(0), BoolField(true)}))
+  require.Len(t, table.ListWithIndex(index, Row{IntField(1)}), 5)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  require.Error(t, table.DropIndex(table.primaryIndex))
+  require.Error(t, table.DropIndex(&Index{}))
+}
+
+func TestAddColumn(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+
+  require.Error(t, table.AddColumn(Column{Name: "age", ColumnType: INT}, IntField(0)))
+  require.Error(t, table.AddColumn(Column{Name: "name", ColumnType: STRING}, IntField(0)))
+  require.NoError(t, table.AddColumn(Column{Name: "name", ColumnType: STRING}, StringField("pusheen")))
+  require.Equal(t, Column{Name: "name", ColumnType: STRING}, table.schema[4])
+  require.Equal(t, Column{Name: "name", ColumnType: STRING}, table.primaryIndex.schema[4])
+
+  for _, row := range table.ListWithIndex(table.indices[0], Row{StringField("doodle@sheen.com")}) {
+    require.Equal(t, StringField("pusheen"), row[4])
+  }
+  require.Equal(t,
+    []Row{append(rows[2].copy(), StringField("pusheen")), append(rows[1].copy(), StringField("pusheen"))},
+    table.ListWithIndex(table.primaryIndex, Row{IntField(2)}),
+  )
+  require.Error(t, table.Insert(rows[0]))
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(1), IntField(0), BoolField(true), StringField("momo")}))
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+}
+
+func TestDropColumn(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+
+  require.Error(t, table.DropColumn("height", false))
+  require.Error(t, table.DropColumn("id", true))
+
+  // a row that only differs from another in age can't lose it
+  twin := Row{rows[0][0], IntField(4), rows[0][2], rows[0][3]}
+  require.NoError(t, table.Insert(twin))
+  require.Error(t, table.DropColumn("age", false))
+  require.Len(t, table.ListWithIndex(table.primaryIndex, Row{IntField(1)}), 2)
+  require.Len(t, table.Schema(), 4)
+  require.NoError(t, table.Delete(table.primaryIndex, Row{IntField(1), BoolField(true), StringField("doodle@sheen.com"), IntField(4)}))
+
+  require.NoError(t, table.DropColumn("age", false))
+  require.Equal(t, []Column{
+    {Name: "email", ColumnType: STRING},
+    {Name: "id", ColumnType: INT},
+    {Name: "isActive", ColumnType: BOOL},
+  }, table.schema)
+  require.Equal(t,
+    []Row{
+      {rows[2][0], rows[2][2], rows[2][3]},
+      {rows[1][0], rows[1][2], rows[1][3]},
+    },
+    table.ListWithIndex(table.primaryIndex, Row{IntField(2)}),
+  )
+
+  // email is used by the secondary index
+  require.Error(t, table.DropColumn("email", false))
+  require.Len(t, table.Indices(), 1)
+  require.NoError(t, table.DropColumn("email", true))
+  require.Empty(t, table.Indices())
+  require.Len(t, table.ListWithIndex(table.primaryIndex, Row{}), 8)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+}
+
+func TestRenameColumn(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 8)
+
+  require.Error(t, table.RenameColumn("email", "age"))
+  require.Error(t, table.RenameColumn("height", "weight"))
+  require.NoError(t, table.RenameColumn("email", "mail"))
+  require.Equal(t, Column{Name: "mail", ColumnType: STRING}, table.schema[0])
+  require.Equal(t, Column{Name: "mail", ColumnType: STRING}, table.primaryIndex.schema[2])
+  require.Equal(t, Column{Name: "mail", ColumnType: STRING}, table.indices[0].schema[0])
+
+  require.NoError(t, table.Update(table.primaryIndex, QueryPredicate{
+    LowerBound: InclusiveBound(Row{IntField(1)}),
+    UpperBound: ExclusiveBound(Row{IntField(1)}),
+    Limit:      NoLimit,
+  }, map[Column]Field{{Name: "mail", ColumnType: STRING}: StringField("momo@sheen.com")}))
+  require.Equal(t,
+    []Row{{StringField("momo@sheen.com"), IntField(3), IntField(1), BoolField(true)}},
+    table.ListWithIndex(table.indices[0], Row{StringField("momo@sheen.com")}),
+  )
+  index, err := table.AddIndex([]string{"mail", "age"})
+  require.NoError(t, err)
+  require.Len(t, table.ListWithIndex(index, Row{StringField("doodle@sheen.com")}), 3)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+}
+
+func TestRenameColumnPartialIndex(t *testing.T) {
+  db := NewDatabase()
+  orders, err := db.CreateTable("orders", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "customer", ColumnType: INT},
+    {Name: "note", ColumnType: STRING},
+    {Name: "total", ColumnType: INT},
+  }, []string{"id"})
+  require.NoError(t, err)
+  for i := 0; i < 1000; i++ {
+    require.NoError(t, orders.Insert(Row{IntField(i), IntField(i % 100), StringField(""), IntField(i % 37)}))
+  }
+  index, err := db.CreatePartialIndex("orders_big", "orders", []string{"customer"}, nil,
+    Compare(Greater, ColumnRef("total"), Literal(IntField(30))))
+  require.NoError(t, err)
+
+  // the index doesn't read note, but still has to find the columns it does
+  require.NoError(t, orders.RenameColumn("note", "comment"))
+  require.NoError(t, orders.Insert(Row{IntField(1000), IntField(5), StringField("new"), IntField(35)}))
+  require.NoError(t, orders.Insert(Row{IntField(1001), IntField(5), StringField("new"), IntField(5)}))
+  require.NoError(t, orders.Delete(orders.primaryIndex, Row{IntField(405)}))
+  report := orders.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  plan, err := db.Plan(Query{Tables: []string{"orders"}, Filters: []ColumnFilter{
+    {Column: "orders.customer", Op: Equal, Value: IntField(5)},
+    {Column: "orders.total", Op: GreaterOrEqual, Value: IntField(31)},
+  }})
+  require.NoError(t, err)
+  require.Equal(t, index, plan.Root.(*ScanPlan).Index, plan.Explain())
+  expected := []Row{{IntField(1000)}}
+  for i := 5; i < 1000; i += 100 {
+    if i%37 >= 31 && i != 405 {
+      expected = append(expected, Row{IntField(i)})
+    }
+  }
+  require.ElementsMatch(t, expected, runPlan(t, plan.Root, "orders.id"))
+}
+
+func TestAddUniqueIndex(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+
+  // two rows share an email
+  _, err := table.AddUniqueIndex([]string{"email"})
+  require.ErrorIs(t, err, ErrUniqueViolation)
+  require.Len(t, table.Indices(), 1)
+
+  index, err := table.AddUniqueIndex([]string{"id", "age"})
+  require.NoError(t, err)
+  require.True(t, index.Unique())
+  require.False(t, table.indices[0].Unique())
+  require.Equal(t, []*Index{table.indices[0], index}, table.Indices())
+
+  // writes can't give a row another row's key
+  err = table.Insert(Row{StringField("momo@sheen.com"), IntField(21), IntField(2), BoolField(false)})
+  require.ErrorIs(t, err, ErrUniqueViolation)
+  err = table.Update(table.primaryIndex, QueryPredicate{
+    LowerBound: InclusiveBound(Row{IntField(8)}),
+    UpperBound: ExclusiveBound(Row{IntField(8)}),
+    Limit: NoLimit,
+  }, map[Column]Field{{Name: "id", ColumnType: INT}: IntField(2)})
+  require.ErrorIs(t, err, ErrUniqueViolation)
+  // but a row keeps its own
+  require.NoError(t, table.Update(table.primaryIndex, QueryPredicate{
+    LowerBound: InclusiveBound(Row{IntField(8)}),
+    UpperBound: ExclusiveBound(Row{IntField(8)}),
+    Limit: NoLimit,
+  }, map[Column]Field{{Name: "email", ColumnType: STRING}: StringField("momo@sheen.com")}))
+  rows[3][0] = StringField("momo@sheen.com")
+  scanned, err := collectRows(table.Scan(table.primaryIndex, QueryPredicate{
+    LowerBound: NegativeInfinity{},
+    UpperBound: Infinity{},
+    Limit: NoLimit,
+  }, DefaultBatchSize))
+  require.NoError(t, err)
+  require.ElementsMatch(t, rows, scanned)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+
+  _, err = table.AddUniqueIndex([]string{"id", "age"})
+  require.Error(t, err)
+}
+
+func TestRenameColumnWhileScanning(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 40)
+  all := QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit}
+
+  stop := make(chan struct{})
+  done := make(chan error)
+  go func() {
+    names := []string{"age", "years"}
+    for i := 0; ; i++ {
+      select {
+      case <-stop:
+        done <- nil
+        return
+      default:
+      }
+      if err := table.RenameColumn(names[i%2], names[(i+1)%2]); err != nil {
+        done <- err
+        return
+      }
+    }
+  }()
+  // renames only change names, so every scan reads the same rows
+  for i := 0; i < 50; i++ {
+    for _, index := range []*Index{table.primaryIndex, table.indices[0]} {
+      scanned, err := collectRows(table.Scan(index, all, 3))
+      require.NoError(t, err)
+      require.ElementsMatch(t, rows, scanned)
+    }
+    require.Len(t, table.ListWithIndex(table.indices[0], Row{StringField("toto@sheen.com")}), 20)
+  }
+  close(stop)
+  require.NoError(t, <-done)
+}
@@ -1,6 +1,7 @@
 package sql_planner
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
@@ -9,17 +10,136 @@ type Row []Field
 const MAX_NODE_SIZE = 6
 
 type BTree struct {
-  // keys end with the primary key field
+  // leading fields shared by every key in the node, stored once
+  prefix Row
+  // keys end with the primary key field. Only the part after prefix is stored,
+  // use key(i) for the full key, or compareKey to compare with it.
   keys []Row
   children []*BTree
+  // keys are stored whole, without a shared prefix. Nodes split or merged
+  // from this one store them the same way.
+  uncompressed bool
   mutex sync.RWMutex
 }
 
+func (t *BTree) key(i int) Row {
+  if len(t.prefix) == 0 {
+    return t.keys[i]
+  }
+  k := make(Row, 0, len(t.prefix)+len(t.keys[i]))
+  return append(append(k, t.prefix...), t.keys[i]...)
+}
+
+// field j of key i
+func (t *BTree) field(i int, j int) Field {
+  if j < len(t.prefix) {
+    return t.prefix[j]
+  }
+  return t.keys[i][j-len(t.prefix)]
+}
+
+// How key i compares with row, a key or the leading part of one: -1 if key i
+// is before row, 1 if it's after, and 0 if it starts with row. Doesn't build
+// the full key.
+func (t *BTree) compareKey(i int, row Row) int {
+  for j, f := range row {
+    field := t.field(i, j)
+    if field.lessThan(f) {
+      return -1
+    } else if !field.equals(f) {
+      return 1
+    }
+  }
+  return 0
+}
+
+// like bound.rowGreaterThan(t.key(i)), without building the full key
+func (t *BTree) keyAfter(bound RowBound, i int) bool {
+  switch b := bound.(type) {
+  case InclusiveBound:
+    return t.compareKey(i, Row(b)) >= 0
+  case ExclusiveBound:
+    return t.compareKey(i, Row(b)) > 0
+  }
+  // infinities don't look at the row
+  return bound.rowGreaterThan(nil)
+}
+
+// what the node stores of key k, which must start with prefix
+func (t *BTree) suffix(k Row) Row {
+  if len(t.prefix) == 0 {
+    return k
+  }
+  return k[len(t.prefix):].copy()
+}
+
+func (t *BTree) hasPrefix(k Row) bool {
+  for j, f := range t.prefix {
+    if !f.equals(k[j]) {
+      return false
+    }
+  }
+  return true
+}
+
+// puts k in the node as key i, expanding the node if k doesn't share its
+// prefix
+func (t *BTree) insertKey(i int, k Row) {
+  if !t.hasPrefix(k) {
+    t.expand()
+  }
+  t.keys = append(t.keys, nil)
+  copy(t.keys[i+1:], t.keys[i:])
+  t.keys[i] = t.suffix(k)
+}
+
+// replaces key i with k, expanding the node if k doesn't share its prefix
+func (t *BTree) setKey(i int, k Row) {
+  if !t.hasPrefix(k) {
+    t.expand()
+  }
+  t.keys[i] = t.suffix(k)
+}
+
+// turn the node's keys back into full keys, so they can be moved around
+func (t *BTree) expand() {
+  if len(t.prefix) == 0 {
+    return
+  }
+  keys := make([]Row, len(t.keys))
+  for i := range t.keys {
+    keys[i] = t.key(i)
+  }
+  t.keys = keys
+  t.prefix = nil
+}
+
+// strip the fields shared by all keys in the node into prefix
+func (t *BTree) compress() {
+  if t.uncompressed || len(t.prefix) > 0 || len(t.keys) < 2 {
+    return
+  }
+  // keys are sorted, so whatever the first and last key share, all keys share
+  first, last := t.keys[0], t.keys[len(t.keys)-1]
+  shared := 0
+  for shared < len(first) && first[shared].equals(last[shared]) {
+    shared++
+  }
+  if shared == 0 {
+    return
+  }
+  t.prefix = first[:shared].copy()
+  for i, key := range t.keys {
+    t.keys[i] = key[shared:].copy()
+  }
+}
+
 func (t *BTree) String() string {
   t.mutex.RLock()
   defer t.mutex.RUnlock()
   s := "{"
-  for i, key := range t.keys {
+  for i := range t.keys {
+    key := t.key(i)
     if t.IsLeaf() {
       s += fmt.Sprintf("%v", key)
       if i < len(t.keys)-1 {
@@ -60,42 +180,35 @@ func (r Row) equals(a Row) bool {
 }
 
 func (t *BTree) delete(k Row) {
+  defer t.compress()
   isLeaf := len(t.children) == 0
-  found := false
-  childIndex := 0
-  for i, key := range t.keys {
-    if k.lessThan(key) {
-      if isLeaf {
-        // it's not in the tree => no-op
-      } else {
+  // the child k is in, if it's not in the node
+  childIndex := len(t.keys)
+  for i := range t.keys {
+    c := t.compareKey(i, k)
+    if c < 0 {
+      continue
+    }
+    childIndex = i
+    if c > 0 {
+      if !isLeaf {
         t.children[i].delete(k)
-        childIndex = i
-      }
-      found = true
-      break
-    } else if k.equals(key) {
-      if isLeaf {
-        suffix := copyKeys(t.keys[i+1:])
-        t.keys = append(t.keys[:i], suffix...)
-      } else {
-        // move up the largest element in the left subtree
-        movingKey := t.children[i].max()
-        t.keys[i] = movingKey
-        t.children[i].delete(movingKey)
-        childIndex = i
       }
-      found = true
-      break
+      // otherwise it's not in the tree => no-op
+    } else if isLeaf {
+      suffix := copyKeys(t.keys[i+1:])
+      t.keys = append(t.keys[:i], suffix...)
+    } else {
+      // move up the largest element in the left subtree
+      movingKey := t.children[i].max()
+      t.setKey(i, movingKey)
+      t.children[i].delete(movingKey)
     }
+    break
   }
   // it's in the rightmost subtree
-  if !found {
-    childIndex = len(t.children)-1
-    if isLeaf {
-      // it's not in the tree => no-op
-    } else {
-      t.children[childIndex].delete(k)
-    }
+  if childIndex == len(t.keys) && !isLeaf {
+    t.children[childIndex].delete(k)
   }
 
   if !isLeaf {
@@ -109,12 +222,17 @@ func (t *BTree) delete(k Row) {
         siblingIndex, keyIndex = childIndex-1, childIndex-1
       }
       sibling := t.children[siblingIndex]
+      t.expand()
+      child.expand()
+      sibling.expand()
       if len(sibling.keys) == MAX_NODE_SIZE/2 {
         // can't shuffle keys around in existing nodes, have to merge nodes
         mergedChild := &BTree{
           keys: append(append(t.children[keyIndex].keys, t.keys[keyIndex]), t.children[keyIndex+1].keys...),
           children: append(t.children[keyIndex].children, t.children[keyIndex+1].children...),
+          uncompressed: t.uncompressed,
         }
+        mergedChild.compress()
         t.keys = append(t.keys[:keyIndex], t.keys[keyIndex+1:]...)
         t.children = append(append(t.children[:keyIndex], mergedChild), t.children[keyIndex+2:]...)
       } else {
@@ -136,6 +254,8 @@ func (t *BTree) delete(k Row) {
             sibling.children = sibling.children[:len(sibling.children)-1]
           }
         }
+        child.compress()
+        sibling.compress()
       }
     }
   }
@@ -153,14 +273,14 @@ func (t *BTree) Delete(k Row) *BTree {
 
 func (t *BTree) max() Row {
   if len(t.children) == 0 {
-    return t.keys[len(t.keys)-1]
+    return t.key(len(t.keys)-1)
   }
   return t.children[len(t.children)-1].max()
 }
 
 func (t *BTree) min() Row {
   if len(t.children) == 0 {
-    return t.keys[0]
+    return t.key(0)
   }
   return t.children[0].min()
 }
@@ -172,44 +292,120 @@ func (t *BTree) height() int {
   return 1 + t.children[0].height()
 }
 
+// rough number of rows in the tree, assuming every node is as full as the
+// leftmost one on its level, so only one path is visited
+func (t *BTree) estimatedSize() float64 {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  if len(t.children) == 0 {
+    return float64(len(t.keys))
+  }
+  return float64(len(t.keys)) + float64(len(t.children))*t.children[0].estimatedSize()
+}
+
 func (t *BTree) AssertWellFormed() {
+  if err := t.CheckWellFormed(); err != nil {
+    panic(err.Error())
+  }
+}
+
+// Like AssertWellFormed, but returns the first broken invariant as an error.
+func (t *BTree) CheckWellFormed() error {
   t.mutex.RLock()
   defer t.mutex.RUnlock()
-  t.assertWellFormed(true)
+  return t.checkWellFormed(true)
 }
 
-func (t *BTree) assertWellFormed(isRoot bool) {
+func (t *BTree) checkWellFormed(isRoot bool) error {
   if len(t.keys) > MAX_NODE_SIZE {
-    panic(fmt.Sprintf("too many keys in node %s", t))
+    return fmt.Errorf("too many keys in node %s", t)
   }
   if !isRoot {
     if len(t.keys) < MAX_NODE_SIZE/2 {
-      panic(fmt.Sprintf("too few keys in node %s", t))
+      return fmt.Errorf("too few keys in node %s", t)
     }
   }
   height := t.height()
   if len(t.children) > 0 {
     if len(t.children) != len(t.keys)+1 {
-      panic(fmt.Sprintf("wrong number of children in node %s", t))
+      return fmt.Errorf("wrong number of children in node %s", t)
     }
-    for i, k := range t.keys {
-      t.children[i].assertWellFormed(false)
-      if t.children[i].height() + 1 != height {
-        panic(fmt.Sprintf("tree height uneven at index %d in node %s", i, t))
+    for i, child := range t.children {
+      if err := child.checkWellFormed(false); err != nil {
+        return err
       }
+      if child.height() + 1 != height {
+        return fmt.Errorf("tree height uneven at index %d in node %s", i, t)
+      }
+    }
+    for i := range t.keys {
+      k := t.key(i)
       if !t.children[i].max().lessThan(k) {
-        panic(fmt.Sprintf("tree out of order at index %d in node %s", i, t))
+        return fmt.Errorf("tree out of order at index %d in node %s", i, t)
       }
       if !k.lessThan(t.children[i+1].min()) {
-        panic(fmt.Sprintf("tree out of order (type 2) at index %d in node %s", i, t))
+        return fmt.Errorf("tree out of order (type 2) at index %d in node %s", i, t)
       }
     }
   } else {
     for i := 0; i < len(t.keys)-1; i++ {
       if !t.keys[i].lessThan(t.keys[i+1]) {
-        panic(fmt.Sprintf("tree out of order at index %d in leaf %s", i, t))
+        return fmt.Errorf("tree out of order at index %d in leaf %s", i, t)
+      }
+    }
+  }
+  return nil
+}
+
+// first row with the given prefix, if there is one
+func (t *BTree) find(prefix Row) (Row, bool) {
+  output := make(chan Row, 1)
+  t.TraverseBounded(&QueryPredicate{
+    LowerBound: InclusiveBound(prefix),
+    UpperBound: ExclusiveBound(prefix),
+    Limit: Limit(1),
+  }, output)
+  close(output)
+  row, ok := <-output
+  return row, ok
+}
+
+// Looks up the first row with each of prefixes, which must be sorted, in one
+// pass down the tree instead of one descent per prefix. Returns the rows in the
+// order of prefixes, nil for prefixes no row has.
+func (t *BTree) findSorted(prefixes []Row) []Row {
+  found := make([]Row, len(prefixes))
+  t.findAll(prefixes, found)
+  return found
+}
+
+func (t *BTree) findAll(prefixes []Row, found []Row) {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  for i := range t.keys {
+    if len(prefixes) == 0 {
+      return
+    }
+    // the prefixes up to k, whose rows are either left of k or k itself
+    n := 0
+    for n < len(prefixes) && t.compareKey(i, prefixes[n]) >= 0 {
+      n++
+    }
+    if n == 0 {
+      continue
+    }
+    if !t.IsLeaf() {
+      t.children[i].findAll(prefixes[:n], found[:n])
+    }
+    for j := 0; j < n; j++ {
+      if found[j] == nil && t.compareKey(i, prefixes[j]) == 0 {
+        found[j] = t.key(i)
       }
     }
+    prefixes, found = prefixes[n:], found[n:]
+  }
+  if !t.IsLeaf() && len(prefixes) > 0 {
+    t.children[len(t.children)-1].findAll(prefixes, found)
   }
 }
 
@@ -235,35 +431,164 @@ func (t *BTree) TraversePaginated(
   batchSize int,
   output chan<- []Row,
 ) error {
-  predChunk := pred
+  return t.TraversePaginatedContext(context.Background(), pred, batchSize, output)
+}
+
+// Like TraversePaginated, but stops once ctx is done, even while waiting for
+// output to take a batch, and returns ctx.Err().
+func (t *BTree) TraversePaginatedContext(
+  ctx context.Context,
+  pred QueryPredicate,
+  batchSize int,
+  output chan<- []Row,
+) error {
+  return traversePaginated(ctx, func() *BTree { return t }, pred, batchSize, output)
+}
+
+// root is called for each batch to get the tree to traverse
+func traversePaginated(
+  ctx context.Context,
+  root func() *BTree,
+  pred QueryPredicate,
+  batchSize int,
+  output chan<- []Row,
+) error {
+  ranges := newRangeCursor(root, pred)
   limitRemaining := pred.Limit
   for {
-    outputChan := make(chan Row, batchSize)
-    predChunk.Limit = minLimit(Limit(batchSize), limitRemaining)
-    t.TraverseBounded(&predChunk, outputChan)
-    close(outputChan)
-
     outputRows := make([]Row, 0, batchSize)
-    for row := range outputChan {
-      limitRemaining.decrement()
-      outputRows = append(outputRows, row)
+    for len(outputRows) < batchSize && !limitRemaining.usedUp() {
+      keyRange, ok := ranges.current()
+      if !ok {
+        break
+      }
+      predChunk := pred
+      predChunk.LowerBound, predChunk.UpperBound = keyRange.LowerBound, keyRange.UpperBound
+      predChunk.Limit = minLimit(Limit(batchSize-len(outputRows)), limitRemaining)
+      // room for every row, so the tree is never locked waiting on output
+      outputChan := make(chan Row, batchSize)
+      if err := root().TraverseBoundedContext(ctx, &predChunk, outputChan); err != nil {
+        return err
+      }
+      close(outputChan)
+
+      for row := range outputChan {
+        limitRemaining.decrement()
+        outputRows = append(outputRows, row)
+      }
+      if predChunk.Limit.usedUp() {
+        // the range may have more rows after the last one
+        ranges.resume(outputRows[len(outputRows)-1])
+      } else {
+        ranges.next()
+      }
     }
     if len(outputRows) == 0 {
       return nil
     }
-    predChunk.LowerBound = ExclusiveBound(
-      outputRows[len(outputRows)-1],
-    )
-    output <- outputRows
-    if limitRemaining.usedUp() {
-      return nil
+    select {
+    case output <- outputRows:
+    case <-ctx.Done():
+      return ctx.Err()
     }
-    if !predChunk.Limit.usedUp() {
+    if len(outputRows) < batchSize || limitRemaining.usedUp() {
       return nil
     }
   }
 }
 
+// The key ranges a predicate reads, in order. A skip scan finds the next
+// distinct value of its leading columns when it's done with the last one.
+type rangeCursor struct {
+  root func() *BTree
+  pred QueryPredicate
+  ranges []KeyRange
+  // where the next distinct value of the leading columns starts, nil once
+  // there are none left or the scan doesn't skip
+  skipFrom RowBound
+}
+
+func newRangeCursor(root func() *BTree, pred QueryPredicate) *rangeCursor {
+  c := &rangeCursor{root: root, pred: pred}
+  switch {
+  case pred.Skip == 0:
+    c.ranges = rangesAfter(pred.keyRanges(), pred.After)
+  case pred.After == nil:
+    c.skipFrom = NegativeInfinity{}
+  default:
+    c.within(pred.After[:pred.Skip])
+    c.ranges = rangesAfter(c.ranges, pred.After)
+  }
+  return c
+}
+
+// ranges without the rows up to and including row, all of them if it's nil
+func rangesAfter(ranges []KeyRange, row Row) []KeyRange {
+  if row == nil {
+    return ranges
+  }
+  remaining := make([]KeyRange, 0, len(ranges))
+  for _, r := range ranges {
+    if r.UpperBound.rowGreaterThan(row) {
+      // every row of r comes before it
+      continue
+    }
+    if r.LowerBound.rowGreaterThan(row) {
+      r.LowerBound = ExclusiveBound(row)
+    }
+    remaining = append(remaining, r)
+  }
+  return remaining
+}
+
+// the range being read, false once every one has been
+func (c *rangeCursor) current() (KeyRange, bool) {
+  for len(c.ranges) == 0 && c.skipFrom != nil {
+    c.skip()
+  }
+  if len(c.ranges) == 0 {
+    return KeyRange{}, false
+  }
+  return c.ranges[0], true
+}
+
+// continues the range being read after row
+func (c *rangeCursor) resume(row Row) {
+  c.ranges[0].LowerBound = ExclusiveBound(row)
+}
+
+// moves on from the range being read
+func (c *rangeCursor) next() {
+  c.ranges = c.ranges[1:]
+}
+
+// moves on to the ranges within the next distinct value of the leading columns
+func (c *rangeCursor) skip() {
+  found := make(chan Row, 1)
+  c.root().TraverseBounded(&QueryPredicate{
+    LowerBound: c.skipFrom,
+    UpperBound: Infinity{},
+    Limit: Limit(1),
+  }, found)
+  close(found)
+  row, ok := <-found
+  if !ok {
+    c.skipFrom = nil
+    return
+  }
+  c.within(row[:c.pred.Skip])
+}
+
+// reads the ranges within the rows that start with prefix next, and then
+// skips past them
+func (c *rangeCursor) within(prefix Row) {
+  prefix = append(Row{}, prefix...)
+  for _, keyRange := range c.pred.keyRanges() {
+    c.ranges = append(c.ranges, keyRange.within(prefix))
+  }
+  c.skipFrom = ExclusiveBound(prefix)
+}
+
 // Can be compared to Rows.
 // A bound cannot be equal to a row.
 type RowBound interface {
@@ -325,12 +650,64 @@ func minLimit(a Limit, b Limit) Limit {
   return b
 }
 
+// Rows between LowerBound and UpperBound.
+type KeyRange struct {
+  LowerBound RowBound
+  UpperBound RowBound
+}
+
+// the range of rows that start with prefix, followed by a row in r
+func (r KeyRange) within(prefix Row) KeyRange {
+  return KeyRange{
+    LowerBound: prefixedBound(prefix, r.LowerBound),
+    UpperBound: prefixedBound(prefix, r.UpperBound),
+  }
+}
+
+func prefixedBound(prefix Row, bound RowBound) RowBound {
+  switch b := bound.(type) {
+  case InclusiveBound:
+    return InclusiveBound(append(append(Row{}, prefix...), b...))
+  case ExclusiveBound:
+    return ExclusiveBound(append(append(Row{}, prefix...), b...))
+  case NegativeInfinity:
+    return InclusiveBound(prefix)
+  default:
+    return ExclusiveBound(prefix)
+  }
+}
+
+// a range no row is in
+var emptyRange = KeyRange{LowerBound: Infinity{}, UpperBound: NegativeInfinity{}}
+
 type QueryPredicate struct {
   UpperBound RowBound
   LowerBound RowBound
+  // If not empty, rows are read from each of these in turn instead of from
+  // LowerBound to UpperBound. They must be sorted and must not overlap.
+  Ranges []KeyRange
+  // Number of leading columns the bounds leave out. The scan skips from each
+  // distinct value of them to the next, and reads the rows within it that
+  // the bounds, which are on the columns after them, are around.
+  Skip int
+  // If not nil, only rows after this one, a row of the tree, are read, as
+  // when resuming a scan.
+  After Row
   Filter func(Row) bool
   Limit Limit
   Descending bool
+  // Names of the only table columns the caller reads, nil for all of them.
+  // A secondary index that has all of them answers the query alone, and the
+  // other columns of its rows are NULL.
+  Columns []string
+}
+
+// the ranges the predicate reads, see Ranges
+func (p QueryPredicate) keyRanges() []KeyRange {
+  if len(p.Ranges) == 0 {
+    return []KeyRange{{LowerBound: p.LowerBound, UpperBound: p.UpperBound}}
+  }
+  return append([]KeyRange{}, p.Ranges...)
 }
 
 // Returns everything to output between lower and upper
@@ -339,31 +716,53 @@ func (t *BTree) TraverseBounded(
   pred *QueryPredicate,
   output chan<- Row,
 ) {
+  t.TraverseBoundedContext(context.Background(), pred, output)
+}
+
+// Like TraverseBounded, but stops once ctx is done, even while waiting for
+// output to take a row, and returns ctx.Err(). The tree is unlocked by the
+// time it returns.
+func (t *BTree) TraverseBoundedContext(
+  ctx context.Context,
+  pred *QueryPredicate,
+  output chan<- Row,
+) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
   t.mutex.RLock()
   defer t.mutex.RUnlock()
-  for i, k := range t.keys {
+  for i := range t.keys {
     if pred.Limit.usedUp() {
-      return
+      return nil
     }
     // look to the left of k if k > lower.
-    if !t.IsLeaf() && pred.LowerBound.rowGreaterThan(k) {
-      t.children[i].TraverseBounded(pred, output)
+    if !t.IsLeaf() && t.keyAfter(pred.LowerBound, i) {
+      if err := t.children[i].TraverseBoundedContext(ctx, pred, output); err != nil {
+        return err
+      }
     }
     // if k > upper, we're done.
-    if pred.Limit.usedUp() || pred.UpperBound.rowGreaterThan(k) {
-      return
+    if pred.Limit.usedUp() || t.keyAfter(pred.UpperBound, i) {
+      return nil
     }
-    // k is in range if k > lower.
-    if pred.LowerBound.rowGreaterThan(k) {
+    // k is in range if k > lower. Only keys in range are built whole.
+    if t.keyAfter(pred.LowerBound, i) {
+      k := t.key(i)
       if pred.Filter == nil || pred.Filter(k) {
         pred.Limit.decrement()
-        output <- k
+        select {
+        case output <- k:
+        case <-ctx.Done():
+          return ctx.Err()
+        }
       }
     }
   }
   if !t.IsLeaf() {
-    t.children[len(t.children)-1].TraverseBounded(pred, output)
+    return t.children[len(t.children)-1].TraverseBoundedContext(ctx, pred, output)
   }
+  return nil
 }
 
 var insertInjection func() chan struct{}
@@ -384,7 +783,7 @@ func (t *BTree) Insert(k Row) (*BTree) {
   // root has split, need to create a new root
   if rTree != nil {
     //
-    return &BTree{keys: []Row{r}, children: []*BTree{lTree, rTree}}
+    return &BTree{keys: []Row{r}, children: []*BTree{lTree, rTree}, uncompressed: t.uncompressed}
   }
   return t
 }
@@ -405,65 +804,51 @@ func copyNodes(nodes []*BTree) []*BTree {
 
 // helper function to Insert
 func (t *BTree) insert(k Row) (*BTree, *BTree, Row) {
-  isLeaf := t.IsLeaf()
-  found := false
-  for i, key := range t.keys {
-    if k.lessThan(key) {
-      if isLeaf {
-        suffix := copyKeys(t.keys[i:])
-        t.keys = append(append(t.keys[:i], k), suffix...)
-      } else {
-        lTree, rTree, newK := t.children[i].insert(k)
-        if rTree == nil {
-          t.children[i] = lTree
-        } else {
-          // split happened
-          suffix := copyKeys(t.keys[i:])
-          t.keys = append(append(t.keys[:i], newK), suffix...)
-          childrenSuffix := copyNodes(t.children[i+1:])
-          t.children = append(append(t.children[:i], lTree, rTree), childrenSuffix...)
-        }
-      }
-      found = true
-      break
-    } else if k.equals(key) {
-      found = true
+  i := 0
+  for ; i < len(t.keys); i++ {
+    c := t.compareKey(i, k)
+    if c == 0 {
+      // already in the tree
+      return t, nil, nil
+    } else if c > 0 {
       break
     }
   }
-
-  // rightmost child 
-  if !found {
-    if isLeaf {
-      t.keys = append(t.keys, k)
+  if t.IsLeaf() {
+    t.insertKey(i, k)
+  } else {
+    lTree, rTree, newK := t.children[i].insert(k)
+    if rTree == nil {
+      t.children[i] = lTree
     } else {
-      i := len(t.children)-1
-      lTree, rTree, newK := t.children[i].insert(k)
-      if rTree == nil {
-        t.children[i] = lTree
-      } else {
-        // split happened
-        t.keys = append(t.keys, newK)
-        t.children = append(t.children[:i], lTree, rTree)
-      }
+      // split happened
+      t.insertKey(i, newK)
+      childrenSuffix := copyNodes(t.children[i+1:])
+      t.children = append(append(t.children[:i], lTree, rTree), childrenSuffix...)
     }
   }
 
   if len(t.keys) > MAX_NODE_SIZE {
     // need to split
+    t.expand()
     lTree := BTree {
       keys: copyKeys(t.keys[:MAX_NODE_SIZE / 2]),
+      uncompressed: t.uncompressed,
     }
     rTree := BTree {
       keys: copyKeys(t.keys[MAX_NODE_SIZE / 2+1:]),
+      uncompressed: t.uncompressed,
     }
     if !t.IsLeaf() {
       lTree.children = copyNodes(t.children[:MAX_NODE_SIZE / 2 + 1])
       rTree.children = copyNodes(t.children[MAX_NODE_SIZE / 2 + 1:])
     }
+    lTree.compress()
+    rTree.compress()
     return &lTree, &rTree, t.keys[MAX_NODE_SIZE / 2]
   }
 
+  t.compress()
   return t, nil, nil
 }
 
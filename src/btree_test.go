@@ -1,8 +1,11 @@
 package sql_planner
 
 import (
+  "context"
   "fmt"
+  "runtime"
   "testing"
+  "time"
 )
 
 func intKey(i int) Row {
@@ -97,3 +100,241 @@ func TestRandomAccessInsertDelete(t *testing.T) {
   }
   assertRowsEqual(t, allKeys(tree), []Row{})
 }
+
+func TestCompressedKeys(t *testing.T) {
+  tree := &BTree{}
+  var rows []Row
+  for group := 0; group < 4; group++ {
+    for i := 0; i < 30; i++ {
+      rows = append(rows, Row{IntField(group), StringField("pusheen"), IntField(i)})
+    }
+  }
+  for i := range rows {
+    tree = tree.Insert(rows[(i*7) % len(rows)])
+    tree.AssertWellFormed()
+  }
+  assertRowsEqual(t, allKeys(tree), rows)
+  // leaves hold keys from a single group, so they share the first two fields
+  leaf := tree
+  for !leaf.IsLeaf() {
+    leaf = leaf.children[0]
+  }
+  if len(leaf.prefix) != 2 || len(leaf.keys[0]) != 1 {
+    t.Error(leaf.prefix, leaf.keys)
+  }
+  // bounds shorter and longer than the prefixes
+  output := make(chan Row, len(rows))
+  tree.TraversePrefix(Row{IntField(2)}, output)
+  tree.TraverseBounded(&QueryPredicate{
+    LowerBound: InclusiveBound{IntField(3), StringField("pusheen"), IntField(10)},
+    UpperBound: ExclusiveBound{IntField(3), StringField("pusheen"), IntField(19)},
+    Limit: NoLimit,
+  }, output)
+  close(output)
+  var read []Row
+  for row := range output {
+    read = append(read, row)
+  }
+  assertRowsEqual(t, read, append(append([]Row{}, rows[60:90]...), rows[100:110]...))
+  // keys are only built whole to be read, so looking for a missing one costs
+  // no more than it does in a tree that stores them whole
+  uncompressed := &BTree{uncompressed: true}
+  for _, row := range rows {
+    uncompressed = uncompressed.Insert(row)
+  }
+  missing := Row{IntField(3), StringField("pusheen"), IntField(40)}
+  allocs := testing.AllocsPerRun(10, func() { tree.find(missing) })
+  if expected := testing.AllocsPerRun(10, func() { uncompressed.find(missing) }); allocs > expected {
+    t.Error(allocs, expected)
+  }
+  for i := range rows {
+    tree = tree.Delete(rows[(i*11) % len(rows)])
+    tree.AssertWellFormed()
+  }
+  assertRowsEqual(t, allKeys(tree), []Row{})
+}
+
+func TestUncompressedKeys(t *testing.T) {
+  tree := &BTree{uncompressed: true}
+  var rows []Row
+  for group := 0; group < 4; group++ {
+    for i := 0; i < 30; i++ {
+      rows = append(rows, Row{IntField(group), StringField("pusheen"), IntField(i)})
+    }
+  }
+  for i := range rows {
+    tree = tree.Insert(rows[(i*7) % len(rows)])
+    tree.AssertWellFormed()
+  }
+  assertRowsEqual(t, allKeys(tree), rows)
+  var check func(node *BTree)
+  check = func(node *BTree) {
+    if !node.uncompressed || len(node.prefix) != 0 {
+      t.Error(node.prefix, node.keys)
+    }
+    for _, child := range node.children {
+      check(child)
+    }
+  }
+  check(tree)
+  for i := range rows {
+    tree = tree.Delete(rows[(i*11) % len(rows)])
+    tree.AssertWellFormed()
+    check(tree)
+  }
+  assertRowsEqual(t, allKeys(tree), []Row{})
+}
+
+func TestFindSorted(t *testing.T) {
+  tree := &BTree{}
+  for i := 0; i < 500; i++ {
+    tree = tree.Insert(Row{IntField(i * 2), IntField(i * 10)})
+  }
+  prefixes := make([]Row, 0)
+  for i := -3; i < 1005; i += 3 {
+    prefixes = append(prefixes, intKey(i))
+    if i%9 == 0 {
+      prefixes = append(prefixes, intKey(i))
+    }
+  }
+  found := tree.findSorted(prefixes)
+  if len(found) != len(prefixes) {
+    t.Fatal(len(found), len(prefixes))
+  }
+  for i, prefix := range prefixes {
+    expected, ok := tree.find(prefix)
+    if !ok {
+      expected = nil
+    }
+    if (expected == nil) != (found[i] == nil) || (expected != nil && !expected.equals(found[i])) {
+      t.Error(prefix, expected, found[i])
+    }
+  }
+  if len(tree.findSorted(nil)) != 0 {
+    t.Error("found rows for no prefixes")
+  }
+}
+
+func paginatedKeys(t *testing.T, tree *BTree, pred QueryPredicate) []Row {
+  output := make(chan []Row)
+  go func() {
+    defer close(output)
+    if err := tree.TraversePaginated(pred, 3, output); err != nil {
+      t.Error(err)
+    }
+  }()
+  var rows []Row
+  for batch := range output {
+    rows = append(rows, batch...)
+  }
+  return rows
+}
+
+func TestTraverseRanges(t *testing.T) {
+  tree := &BTree{}
+  pair := func(a int, b int) Row {
+    return Row{IntField(a), IntField(b)}
+  }
+  for a := 0; a < 10; a++ {
+    for b := 0; b < 10; b++ {
+      tree = tree.Insert(pair(a, b))
+    }
+  }
+
+  // a = 2 or (a = 5 and b >= 7), across batches
+  pred := QueryPredicate{
+    Ranges: []KeyRange{
+      {LowerBound: InclusiveBound(intKey(2)), UpperBound: ExclusiveBound(intKey(2))},
+      {LowerBound: InclusiveBound(pair(5, 7)), UpperBound: ExclusiveBound(intKey(5))},
+    },
+    Limit: NoLimit,
+  }
+  expected := make([]Row, 0)
+  for b := 0; b < 10; b++ {
+    expected = append(expected, pair(2, b))
+  }
+  expected = append(expected, pair(5, 7), pair(5, 8), pair(5, 9))
+  assertRowsEqual(t, expected, paginatedKeys(t, tree, pred))
+  pred.Limit = 11
+  assertRowsEqual(t, expected[:11], paginatedKeys(t, tree, pred))
+
+  // 3 <= b <= 4 for every a
+  pred = QueryPredicate{
+    LowerBound: InclusiveBound(intKey(3)),
+    UpperBound: ExclusiveBound(intKey(4)),
+    Limit: NoLimit,
+    Skip: 1,
+  }
+  expected = make([]Row, 0)
+  for a := 0; a < 10; a++ {
+    expected = append(expected, pair(a, 3), pair(a, 4))
+  }
+  assertRowsEqual(t, expected, paginatedKeys(t, tree, pred))
+
+  // b = 1 or b = 8, for as many as the limit
+  pred.Ranges = []KeyRange{
+    {LowerBound: InclusiveBound(intKey(1)), UpperBound: ExclusiveBound(intKey(1))},
+    {LowerBound: InclusiveBound(intKey(8)), UpperBound: ExclusiveBound(intKey(8))},
+  }
+  pred.Limit = 5
+  assertRowsEqual(t, []Row{pair(0, 1), pair(0, 8), pair(1, 1), pair(1, 8), pair(2, 1)}, paginatedKeys(t, tree, pred))
+
+  pred.Ranges = []KeyRange{emptyRange}
+  pred.Skip = 0
+  assertRowsEqual(t, nil, paginatedKeys(t, tree, pred))
+}
+
+// fails t unless the goroutines started since baseline finish soon
+func requireNoLeaks(t *testing.T, baseline int) {
+  deadline := time.Now().Add(time.Second)
+  for runtime.NumGoroutine() > baseline {
+    if time.Now().After(deadline) {
+      t.Fatal("goroutines left running:", runtime.NumGoroutine()-baseline)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func TestTraverseCancel(t *testing.T) {
+  tree := &BTree{}
+  for i := 0; i < 1000; i++ {
+    tree = tree.Insert(intKey(i))
+  }
+  baseline := runtime.NumGoroutine()
+
+  // the consumer goes away after a few rows
+  ctx, cancel := context.WithCancel(context.Background())
+  output := make(chan Row)
+  errs := make(chan error, 1)
+  go func() {
+    errs <- tree.TraverseBoundedContext(ctx, &QueryPredicate{
+      LowerBound: NegativeInfinity{},
+      UpperBound: Infinity{},
+      Limit: NoLimit,
+    }, output)
+  }()
+  for i := 0; i < 3; i++ {
+    <-output
+  }
+  cancel()
+  if err := <-errs; err != context.Canceled {
+    t.Fatal(err)
+  }
+  // the read locks are released, or this would block
+  tree = tree.Insert(intKey(1000))
+  requireNoLeaks(t, baseline)
+
+  // nothing reads the batches before the deadline
+  ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+  err := tree.TraversePaginatedContext(ctx, QueryPredicate{
+    LowerBound: NegativeInfinity{},
+    UpperBound: Infinity{},
+    Limit: NoLimit,
+  }, 10, make(chan []Row))
+  if err != context.DeadlineExceeded {
+    t.Fatal(err)
+  }
+  tree = tree.Insert(intKey(1001))
+  requireNoLeaks(t, baseline)
+}
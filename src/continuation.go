@@ -0,0 +1,361 @@
+package sql_planner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Continuation tokens, which let a scan of a table be read a page at a time
+// across requests. A token holds everything needed to read the next page:
+//
+// token:  tokenMagic, version byte, index name, uvarint column count, each
+//         column as (name, type tag), index condition ("" for none), then
+//         the predicate
+// pred:   uvarint range count, each range as two bounds, uvarint Skip,
+//         varint Limit (-1 for NoLimit), the Columns as a byte (0 for nil)
+//         and a uvarint count of names, and the key of the last row read as
+//         a row
+// bound:  boundTag, followed by a row for inclusive and exclusive bounds
+//
+// Tokens aren't signed, so whoever holds one can change what it reads,
+// such as its ranges or columns, within the index it names. They're only
+// checked to be safe to scan with, and are to be trusted as much as a
+// predicate from the same client would be.
+
+var tokenMagic = []byte("NSPC")
+
+const (
+  negativeInfinityTag byte = 0
+  infinityTag         byte = 1
+  inclusiveTag        byte = 2
+  exclusiveTag        byte = 3
+)
+
+var ErrInvalidToken = errors.New("invalid continuation token")
+
+// One page of the rows of a scan.
+type Page struct {
+  Rows []Row
+  // reads the rows after Rows with Table.ResumeScan, nil if there are none
+  Token []byte
+}
+
+// Reads the first pageSize rows of index within pred, like Scan, and a token
+// for reading the rest. pred can't have a Filter, which a token can't hold,
+// and can't be Descending, as scans only read indices in ascending order.
+func (t *Table) ScanPage(index *Index, pred QueryPredicate, pageSize int) (*Page, error) {
+  if pageSize <= 0 {
+    return nil, errors.New("page size must be positive")
+  }
+  if pred.Filter != nil {
+    return nil, errors.New("can not page through a scan with a filter")
+  }
+  if pred.Descending {
+    return nil, errors.New("can not page through a descending scan")
+  }
+  // one more row than the page says whether there are more
+  read := pred
+  read.Limit = minLimit(Limit(pageSize+1), pred.Limit)
+  keys, err := collectRows(func(output chan<- []Row) error {
+    return index.traversePaginated(context.Background(), read, pageSize+1, output)
+  })
+  if err != nil {
+    return nil, err
+  }
+  more := len(keys) > pageSize
+  if more {
+    keys = keys[:pageSize]
+  }
+  page := &Page{Rows: t.tableRows(index, t.schemasOf(index), pred.Columns, keys)}
+  if !more {
+    return page, nil
+  }
+  next := pred
+  next.After = keys[len(keys)-1]
+  if next.Limit != NoLimit {
+    next.Limit -= Limit(len(keys))
+  }
+  var buf bytes.Buffer
+  if err := writeToken(&buf, index, next); err != nil {
+    return nil, err
+  }
+  page.Token = buf.Bytes()
+  return page, nil
+}
+
+// Reads the next pageSize rows of the scan token continues, see ScanPage.
+// Writes to the table since the token was made show up in the rows after it.
+func (t *Table) ResumeScan(token []byte, pageSize int) (*Page, error) {
+  reader := bytes.NewReader(token)
+  index, pred, err := t.readToken(reader)
+  if err != nil {
+    if errors.Is(err, ErrInvalidToken) {
+      return nil, err
+    }
+    return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+  }
+  if reader.Len() > 0 {
+    return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidToken, reader.Len())
+  }
+  return t.ScanPage(index, pred, pageSize)
+}
+
+func writeToken(w io.Writer, index *Index, pred QueryPredicate) error {
+  if _, err := w.Write(append(append([]byte{}, tokenMagic...), encodingVersion)); err != nil {
+    return err
+  }
+  if err := writeString(w, index.Name()); err != nil {
+    return err
+  }
+  schema := index.Schema()
+  if err := writeUvarint(w, uint64(len(schema))); err != nil {
+    return err
+  }
+  for _, col := range schema {
+    if err := writeString(w, col.Name); err != nil {
+      return err
+    }
+    if _, err := w.Write([]byte{byte(col.ColumnType)}); err != nil {
+      return err
+    }
+  }
+  if err := writeString(w, indexCondition(index)); err != nil {
+    return err
+  }
+
+  ranges := pred.keyRanges()
+  if err := writeUvarint(w, uint64(len(ranges))); err != nil {
+    return err
+  }
+  for _, r := range ranges {
+    if err := writeBound(w, r.LowerBound); err != nil {
+      return err
+    }
+    if err := writeBound(w, r.UpperBound); err != nil {
+      return err
+    }
+  }
+  if err := writeUvarint(w, uint64(pred.Skip)); err != nil {
+    return err
+  }
+  var buf [binary.MaxVarintLen64]byte
+  n := binary.PutVarint(buf[:], int64(pred.Limit))
+  if _, err := w.Write(buf[:n]); err != nil {
+    return err
+  }
+  hasColumns := byte(0)
+  if pred.Columns != nil {
+    hasColumns = 1
+  }
+  if _, err := w.Write([]byte{hasColumns}); err != nil {
+    return err
+  }
+  if err := writeUvarint(w, uint64(len(pred.Columns))); err != nil {
+    return err
+  }
+  for _, name := range pred.Columns {
+    if err := writeString(w, name); err != nil {
+      return err
+    }
+  }
+  return writeRow(w, pred.After)
+}
+
+// The index of the table and the predicate token holds. The index must still
+// be the one the token was made for.
+func (t *Table) readToken(r encodeReader) (*Index, QueryPredicate, error) {
+  pred := QueryPredicate{}
+  if err := readMagic(r, tokenMagic); err != nil {
+    return nil, pred, err
+  }
+  name, err := readString(r)
+  if err != nil {
+    return nil, pred, err
+  }
+  count, err := binary.ReadUvarint(r)
+  if err != nil {
+    return nil, pred, truncated(err)
+  }
+  schema := make([]Column, 0)
+  for c := uint64(0); c < count; c++ {
+    column, err := readString(r)
+    if err != nil {
+      return nil, pred, err
+    }
+    tag, err := r.ReadByte()
+    if err != nil {
+      return nil, pred, truncated(err)
+    }
+    schema = append(schema, Column{Name: column, ColumnType: ColumnType(tag)})
+  }
+  condition, err := readString(r)
+  if err != nil {
+    return nil, pred, err
+  }
+  var index *Index
+  for _, candidate := range append([]*Index{t.PrimaryIndex()}, t.Indices()...) {
+    if candidate.Name() == name && sameSchema(candidate.Schema(), schema) && indexCondition(candidate) == condition {
+      index = candidate
+    }
+  }
+  if index == nil {
+    return nil, pred, fmt.Errorf("%w: the index it scans no longer exists", ErrInvalidToken)
+  }
+
+  count, err = binary.ReadUvarint(r)
+  if err != nil {
+    return nil, pred, truncated(err)
+  }
+  for k := uint64(0); k < count; k++ {
+    lower, err := readBound(r)
+    if err != nil {
+      return nil, pred, err
+    }
+    upper, err := readBound(r)
+    if err != nil {
+      return nil, pred, err
+    }
+    pred.Ranges = append(pred.Ranges, KeyRange{LowerBound: lower, UpperBound: upper})
+  }
+  if len(pred.Ranges) == 0 {
+    return nil, pred, corrupt("no key ranges")
+  }
+  // keep single ranges as bounds, the way scans are usually planned
+  if len(pred.Ranges) == 1 {
+    pred.LowerBound, pred.UpperBound, pred.Ranges = pred.Ranges[0].LowerBound, pred.Ranges[0].UpperBound, nil
+  }
+  skip, err := binary.ReadUvarint(r)
+  if err != nil {
+    return nil, pred, truncated(err)
+  }
+  if skip >= uint64(len(schema)) {
+    return nil, pred, corrupt("skips %d of %d columns", skip, len(schema))
+  }
+  pred.Skip = int(skip)
+  limit, err := binary.ReadVarint(r)
+  if err != nil {
+    return nil, pred, truncated(err)
+  }
+  if limit < int64(NoLimit) {
+    return nil, pred, corrupt("limit %d", limit)
+  }
+  pred.Limit = Limit(limit)
+  hasColumns, err := r.ReadByte()
+  if err != nil {
+    return nil, pred, truncated(err)
+  }
+  count, err = binary.ReadUvarint(r)
+  if err != nil {
+    return nil, pred, truncated(err)
+  }
+  if hasColumns == 1 {
+    pred.Columns = make([]string, 0)
+  }
+  for c := uint64(0); c < count; c++ {
+    column, err := readString(r)
+    if err != nil {
+      return nil, pred, err
+    }
+    pred.Columns = append(pred.Columns, column)
+  }
+  pred.After, err = readRow(r)
+  if err != nil {
+    return nil, pred, err
+  }
+
+  // rows that don't match the index could panic comparing with its rows
+  if len(pred.After) != len(schema) || !keyMatches(pred.After, schema) {
+    return nil, pred, corrupt("last row %v does not match the index", pred.After)
+  }
+  for _, keyRange := range pred.keyRanges() {
+    for _, bound := range []RowBound{keyRange.LowerBound, keyRange.UpperBound} {
+      if !boundMatches(bound, schema[pred.Skip:]) {
+        return nil, pred, corrupt("bound %v does not match the index", bound)
+      }
+    }
+  }
+  return index, pred, nil
+}
+
+// the condition of a partial index as text, "" for any other index
+func indexCondition(index *Index) string {
+  if index.Where() == nil {
+    return ""
+  }
+  return index.Where().String()
+}
+
+func writeBound(w io.Writer, bound RowBound) error {
+  switch b := bound.(type) {
+  case NegativeInfinity:
+    _, err := w.Write([]byte{negativeInfinityTag})
+    return err
+  case Infinity:
+    _, err := w.Write([]byte{infinityTag})
+    return err
+  case InclusiveBound:
+    if _, err := w.Write([]byte{inclusiveTag}); err != nil {
+      return err
+    }
+    return writeRow(w, Row(b))
+  case ExclusiveBound:
+    if _, err := w.Write([]byte{exclusiveTag}); err != nil {
+      return err
+    }
+    return writeRow(w, Row(b))
+  default:
+    return fmt.Errorf("can not encode bound of type %T", bound)
+  }
+}
+
+func readBound(r encodeReader) (RowBound, error) {
+  tag, err := r.ReadByte()
+  if err != nil {
+    return nil, truncated(err)
+  }
+  switch tag {
+  case negativeInfinityTag:
+    return NegativeInfinity{}, nil
+  case infinityTag:
+    return Infinity{}, nil
+  case inclusiveTag, exclusiveTag:
+    row, err := readRow(r)
+    if err != nil {
+      return nil, err
+    }
+    if tag == inclusiveTag {
+      return InclusiveBound(row), nil
+    }
+    return ExclusiveBound(row), nil
+  default:
+    return nil, corrupt("unknown bound tag %d", tag)
+  }
+}
+
+// whether the fields of key have the types of the leading columns of schema,
+// none of them NULL, which keys are compared with as if they weren't
+func keyMatches(key Row, schema []Column) bool {
+  if len(key) > len(schema) {
+    return false
+  }
+  for i, f := range key {
+    if f == nil || f.columnType() != schema[i].ColumnType {
+      return false
+    }
+  }
+  return true
+}
+
+func boundMatches(bound RowBound, schema []Column) bool {
+  switch b := bound.(type) {
+  case InclusiveBound:
+    return keyMatches(Row(b), schema)
+  case ExclusiveBound:
+    return keyMatches(Row(b), schema)
+  }
+  return true
+}
@@ -0,0 +1,142 @@
+package sql_planner
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// every row of the scan, a page at a time, and the number of pages
+func readPages(t *testing.T, table *Table, index *Index, pred QueryPredicate, pageSize int) ([]Row, int) {
+  page, err := table.ScanPage(index, pred, pageSize)
+  require.NoError(t, err)
+  rows, pages := page.Rows, 1
+  for page.Token != nil {
+    require.Len(t, page.Rows, pageSize)
+    page, err = table.ResumeScan(page.Token, pageSize)
+    require.NoError(t, err)
+    rows = append(rows, page.Rows...)
+    pages++
+  }
+  return rows, pages
+}
+
+func TestScanPage(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 20)
+  all := func(index *Index, pred QueryPredicate) []Row {
+    rows, err := collectRows(table.Scan(index, pred, 7))
+    require.NoError(t, err)
+    return rows
+  }
+  pred := QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit}
+  rows, pages := readPages(t, table, table.primaryIndex, pred, 3)
+  require.Equal(t, all(table.primaryIndex, pred), rows)
+  require.Equal(t, 7, pages)
+
+  // a secondary index, in several ranges, up to a limit
+  email := table.Indices()[0]
+  pred.Ranges = []KeyRange{
+    {LowerBound: InclusiveBound(Row{StringField("doodle@sheen.com"), IntField(20)}), UpperBound: ExclusiveBound(Row{StringField("doodle@sheen.com")})},
+    {LowerBound: InclusiveBound(Row{StringField("toto@sheen.com")}), UpperBound: ExclusiveBound(Row{StringField("toto@sheen.com")})},
+  }
+  pred.Limit = 13
+  rows, _ = readPages(t, table, email, pred, 4)
+  require.Len(t, rows, 13)
+  require.Equal(t, all(email, pred), rows)
+
+  // skipping over the email, with only the columns the index has
+  pred = QueryPredicate{
+    LowerBound: InclusiveBound(Row{IntField(30)}),
+    UpperBound: ExclusiveBound(Row{IntField(60)}),
+    Limit: NoLimit,
+    Skip: 1,
+    Columns: []string{"email", "id"},
+  }
+  rows, _ = readPages(t, table, email, pred, 2)
+  require.Equal(t, all(email, pred), rows)
+  require.Nil(t, rows[0][1])
+
+  // rows written between pages show up once the scan gets to them
+  pred = QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit}
+  page, err := table.ScanPage(table.primaryIndex, pred, 5)
+  require.NoError(t, err)
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(5), IntField(0), BoolField(true)}))
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(5), IntField(1000), BoolField(true)}))
+  rest, _ := readPages(t, table, table.primaryIndex, pred, 100)
+  resumed, err := table.ResumeScan(page.Token, 100)
+  require.NoError(t, err)
+  require.Nil(t, resumed.Token)
+  // not the row before where the scan was
+  require.Equal(t, rest[6:], resumed.Rows)
+  require.Equal(t, Row{StringField("momo@sheen.com"), IntField(5), IntField(1000), BoolField(true)}, resumed.Rows[len(resumed.Rows)-1])
+
+  _, err = table.ScanPage(table.primaryIndex, QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Filter: func(Row) bool { return true }}, 5)
+  require.Error(t, err)
+  // scans are only read in ascending order, which tokens don't say
+  _, err = table.ScanPage(table.primaryIndex, QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit, Descending: true}, 5)
+  require.Error(t, err)
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+  table := createTable(t)
+  email := table.Indices()[0]
+  pred := QueryPredicate{
+    Ranges: []KeyRange{
+      {LowerBound: NegativeInfinity{}, UpperBound: ExclusiveBound(Row{StringField("doodle@sheen.com")})},
+      {LowerBound: InclusiveBound(Row{StringField("toto@sheen.com"), IntField(2)}), UpperBound: Infinity{}},
+    },
+    Limit: 7,
+    Columns: []string{"email", "id"},
+    After: Row{StringField("doodle@sheen.com"), IntField(8), BoolField(true)},
+  }
+  var token bytes.Buffer
+  require.NoError(t, writeToken(&token, email, pred))
+  index, read, err := table.readToken(bytes.NewReader(token.Bytes()))
+  require.NoError(t, err)
+  require.Same(t, email, index)
+  require.Equal(t, pred, read)
+}
+
+func TestResumeScanInvalid(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 20)
+  index, err := table.AddIndex([]string{"age"})
+  require.NoError(t, err)
+  page, err := table.ScanPage(index, QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit}, 5)
+  require.NoError(t, err)
+  require.NotNil(t, page.Token)
+
+  for i := range page.Token {
+    corrupted := append([]byte{}, page.Token...)
+    corrupted[i] ^= 0xff
+    // either rejected, or a token that still reads the index safely
+    if _, err := table.ResumeScan(corrupted, 5); err != nil {
+      require.ErrorIs(t, err, ErrInvalidToken)
+    }
+  }
+  _, err = table.ResumeScan(page.Token[:len(page.Token)-1], 5)
+  require.ErrorIs(t, err, ErrInvalidToken)
+  _, err = table.ResumeScan(append(page.Token, 0), 5)
+  require.ErrorIs(t, err, ErrInvalidToken)
+
+  // NULLs in the last row read or a bound are rejected, not compared with
+  for _, change := range []func(pred *QueryPredicate){
+    func(pred *QueryPredicate) { pred.After[0] = nil },
+    func(pred *QueryPredicate) { pred.LowerBound = InclusiveBound(Row{nil}) },
+    func(pred *QueryPredicate) { pred.UpperBound = ExclusiveBound(Row{IntField(3), nil}) },
+  } {
+    _, pred, err := table.readToken(bytes.NewReader(page.Token))
+    require.NoError(t, err)
+    change(&pred)
+    var corrupted bytes.Buffer
+    require.NoError(t, writeToken(&corrupted, index, pred))
+    _, err = table.ResumeScan(corrupted.Bytes(), 5)
+    require.ErrorIs(t, err, ErrInvalidToken)
+  }
+
+  require.NoError(t, table.DropIndex(index))
+  _, err = table.ResumeScan(page.Token, 5)
+  require.ErrorIs(t, err, ErrInvalidToken)
+}
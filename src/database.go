@@ -0,0 +1,213 @@
+package sql_planner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Catalog of named tables and indices. Tables and indices share one namespace,
+// and every table's primary index is registered as "<table>_pkey".
+type Database struct {
+  tables map[string]*Table
+  indices map[string]*catalogIndex
+  // from ANALYZE, by table name
+  stats map[string]*TableStats
+  mutex sync.RWMutex
+}
+
+type catalogIndex struct {
+  table string
+  index *Index
+}
+
+var ErrNameTaken = errors.New("name already in use")
+var ErrTableNotFound = errors.New("table not found")
+var ErrIndexNotFound = errors.New("index not found")
+
+func NewDatabase() *Database {
+  return &Database{
+    tables:  make(map[string]*Table),
+    indices: make(map[string]*catalogIndex),
+    stats:   make(map[string]*TableStats),
+  }
+}
+
+func primaryIndexName(table string) string {
+  return table + "_pkey"
+}
+
+func (d *Database) nameTaken(name string) bool {
+  _, isTable := d.tables[name]
+  _, isIndex := d.indices[name]
+  return isTable || isIndex
+}
+
+func (d *Database) CreateTable(name string, schema []Column, primaryKey []string) (*Table, error) {
+  if name == "" {
+    return nil, errors.New("table name can not be empty")
+  }
+  d.mutex.Lock()
+  defer d.mutex.Unlock()
+  if d.nameTaken(name) {
+    return nil, fmt.Errorf("%w: %s", ErrNameTaken, name)
+  }
+  if d.nameTaken(primaryIndexName(name)) {
+    return nil, fmt.Errorf("%w: %s", ErrNameTaken, primaryIndexName(name))
+  }
+  table, err := CreateTable(schema, primaryKey)
+  if err != nil {
+    return nil, err
+  }
+  table.name = name
+  table.primaryIndex.name = primaryIndexName(name)
+  d.tables[name] = table
+  d.indices[table.primaryIndex.name] = &catalogIndex{table: name, index: table.primaryIndex}
+  return table, nil
+}
+
+// Drops the table along with all of its indices.
+func (d *Database) DropTable(name string) error {
+  d.mutex.Lock()
+  defer d.mutex.Unlock()
+  if _, exists := d.tables[name]; !exists {
+    return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+  }
+  delete(d.tables, name)
+  delete(d.stats, name)
+  for indexName, entry := range d.indices {
+    if entry.table == name {
+      delete(d.indices, indexName)
+    }
+  }
+  return nil
+}
+
+func (d *Database) Table(name string) (*Table, error) {
+  d.mutex.RLock()
+  defer d.mutex.RUnlock()
+  table, exists := d.tables[name]
+  if !exists {
+    return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+  }
+  return table, nil
+}
+
+// names of all tables, sorted
+func (d *Database) TableNames() []string {
+  d.mutex.RLock()
+  defer d.mutex.RUnlock()
+  names := make([]string, 0, len(d.tables))
+  for name := range d.tables {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// Columns of the named table, in order.
+func (d *Database) Schema(tableName string) ([]Column, error) {
+  table, err := d.Table(tableName)
+  if err != nil {
+    return nil, err
+  }
+  return table.Schema(), nil
+}
+
+// Builds a new secondary index on the named table, see Table.AddIndex.
+func (d *Database) CreateIndex(name string, tableName string, columns []string) (*Index, error) {
+  return d.CreateIndexIncluding(name, tableName, columns, nil)
+}
+
+// Builds a new secondary index that also stores the include columns, see
+// Table.AddIndexIncluding.
+func (d *Database) CreateIndexIncluding(name string, tableName string, columns []string, include []string) (*Index, error) {
+  return d.CreatePartialIndex(name, tableName, columns, include, nil)
+}
+
+// Builds a new secondary index of only the rows where is true for, see
+// Table.AddPartialIndex.
+func (d *Database) CreatePartialIndex(name string, tableName string, columns []string, include []string, where Expr) (*Index, error) {
+  keys := make([]Expr, 0, len(columns))
+  for _, column := range columns {
+    keys = append(keys, ColumnRef(column))
+  }
+  return d.CreateExpressionIndex(name, tableName, keys, include, where)
+}
+
+// Builds a new secondary index on expressions over the table's columns, see
+// Table.AddExpressionIndex.
+func (d *Database) CreateExpressionIndex(name string, tableName string, keys []Expr, include []string, where Expr) (*Index, error) {
+  return d.createIndex(name, tableName, func(table *Table) (*Index, error) {
+    return table.AddExpressionIndex(keys, include, where)
+  })
+}
+
+// Builds a new secondary index that no two rows share the values of columns
+// in, see Table.AddUniqueIndex.
+func (d *Database) CreateUniqueIndex(name string, tableName string, columns []string) (*Index, error) {
+  return d.createIndex(name, tableName, func(table *Table) (*Index, error) {
+    return table.AddUniqueIndex(columns)
+  })
+}
+
+// names the index add builds on the named table
+func (d *Database) createIndex(name string, tableName string, add func(*Table) (*Index, error)) (*Index, error) {
+  if name == "" {
+    return nil, errors.New("index name can not be empty")
+  }
+  d.mutex.Lock()
+  table, exists := d.tables[tableName]
+  if !exists {
+    d.mutex.Unlock()
+    return nil, fmt.Errorf("%w: %s", ErrTableNotFound, tableName)
+  }
+  if d.nameTaken(name) {
+    d.mutex.Unlock()
+    return nil, fmt.Errorf("%w: %s", ErrNameTaken, name)
+  }
+  // hold the name while the index builds, without blocking the catalog
+  entry := &catalogIndex{table: tableName}
+  d.indices[name] = entry
+  d.mutex.Unlock()
+
+  index, err := add(table)
+
+  d.mutex.Lock()
+  defer d.mutex.Unlock()
+  if err != nil {
+    if d.indices[name] == entry {
+      delete(d.indices, name)
+    }
+    return nil, err
+  }
+  index.setName(name)
+  entry.index = index
+  return index, nil
+}
+
+func (d *Database) DropIndex(name string) error {
+  d.mutex.Lock()
+  defer d.mutex.Unlock()
+  entry, exists := d.indices[name]
+  if !exists || entry.index == nil {
+    return fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+  }
+  if err := d.tables[entry.table].DropIndex(entry.index); err != nil {
+    return err
+  }
+  delete(d.indices, name)
+  return nil
+}
+
+// Looks up an index by name, along with the table it belongs to.
+func (d *Database) Index(name string) (*Table, *Index, error) {
+  d.mutex.RLock()
+  defer d.mutex.RUnlock()
+  entry, exists := d.indices[name]
+  if !exists || entry.index == nil {
+    return nil, nil, fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+  }
+  return d.tables[entry.table], entry.index, nil
+}
@@ -0,0 +1,124 @@
+package sql_planner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var userSchema = []Column{
+  {Name: "email", ColumnType: STRING},
+  {Name: "age", ColumnType: INT},
+  {Name: "id", ColumnType: INT},
+  {Name: "isActive", ColumnType: BOOL},
+}
+
+func TestDatabaseTables(t *testing.T) {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", userSchema, []string{"id"})
+  require.NoError(t, err)
+  require.Equal(t, "users", users.Name())
+  _, err = db.CreateTable("users", userSchema, []string{"id"})
+  require.ErrorIs(t, err, ErrNameTaken)
+  _, err = db.CreateTable("", userSchema, []string{"id"})
+  require.Error(t, err)
+  _, err = db.CreateTable("pets", nil, []string{"id"})
+  require.Error(t, err)
+
+  _, err = db.CreateTable("pets", []Column{{Name: "name", ColumnType: STRING}}, []string{"name"})
+  require.NoError(t, err)
+  require.Equal(t, []string{"pets", "users"}, db.TableNames())
+
+  table, err := db.Table("users")
+  require.NoError(t, err)
+  require.Same(t, users, table)
+  schema, err := db.Schema("users")
+  require.NoError(t, err)
+  require.Equal(t, userSchema, schema)
+
+  require.NoError(t, db.DropTable("users"))
+  _, err = db.Table("users")
+  require.ErrorIs(t, err, ErrTableNotFound)
+  _, err = db.Schema("users")
+  require.ErrorIs(t, err, ErrTableNotFound)
+  require.ErrorIs(t, db.DropTable("users"), ErrTableNotFound)
+  require.Equal(t, []string{"pets"}, db.TableNames())
+}
+
+func TestDatabaseIndices(t *testing.T) {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", userSchema, []string{"id"})
+  require.NoError(t, err)
+  require.NoError(t, users.Insert(Row{StringField("doodle@sheen.com"), IntField(3), IntField(1), BoolField(true)}))
+
+  table, primary, err := db.Index("users_pkey")
+  require.NoError(t, err)
+  require.Same(t, users, table)
+  require.Same(t, users.PrimaryIndex(), primary)
+
+  index, err := db.CreateIndex("users_by_email", "users", []string{"email"})
+  require.NoError(t, err)
+  require.Equal(t, "users_by_email", index.Name())
+  require.Equal(t, []*Index{index}, users.Indices())
+  require.Len(t, users.ListWithIndex(index, Row{StringField("doodle@sheen.com")}), 1)
+
+  // tables and indices share names
+  _, err = db.CreateIndex("users_by_email", "users", []string{"age"})
+  require.ErrorIs(t, err, ErrNameTaken)
+  _, err = db.CreateIndex("users", "users", []string{"age"})
+  require.ErrorIs(t, err, ErrNameTaken)
+  _, err = db.CreateTable("users_by_email", userSchema, []string{"id"})
+  require.ErrorIs(t, err, ErrNameTaken)
+  _, err = db.CreateIndex("pets_by_name", "pets", []string{"name"})
+  require.ErrorIs(t, err, ErrTableNotFound)
+  // a failed build doesn't keep the name
+  _, err = db.CreateIndex("users_by_height", "users", []string{"height"})
+  require.Error(t, err)
+  _, _, err = db.Index("users_by_height")
+  require.ErrorIs(t, err, ErrIndexNotFound)
+
+  require.NoError(t, db.DropIndex("users_by_email"))
+  require.Empty(t, users.Indices())
+  require.ErrorIs(t, db.DropIndex("users_by_email"), ErrIndexNotFound)
+  require.Error(t, db.DropIndex("users_pkey"))
+
+  _, err = db.CreateIndex("users_by_age", "users", []string{"age"})
+  require.NoError(t, err)
+  require.NoError(t, db.DropTable("users"))
+  _, _, err = db.Index("users_by_age")
+  require.ErrorIs(t, err, ErrIndexNotFound)
+  _, _, err = db.Index("users_pkey")
+  require.ErrorIs(t, err, ErrIndexNotFound)
+}
+
+func TestCreateIndexWhileReading(t *testing.T) {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", userSchema, []string{"id"})
+  require.NoError(t, err)
+  require.NoError(t, users.Insert(Row{StringField("doodle@sheen.com"), IntField(3), IntField(1), BoolField(true)}))
+
+  // indices are in Indices before the catalog names them
+  stop := make(chan struct{})
+  done := make(chan struct{})
+  go func() {
+    defer close(done)
+    for {
+      select {
+      case <-stop:
+        return
+      default:
+      }
+      for _, index := range users.Indices() {
+        name := index.Name()
+        require.True(t, name == "" || name == "users_by_age", name)
+      }
+    }
+  }()
+  for i := 0; i < 50; i++ {
+    _, err := db.CreateIndex("users_by_age", "users", []string{"age"})
+    require.NoError(t, err)
+    require.NoError(t, db.DropIndex("users_by_age"))
+  }
+  close(stop)
+  <-done
+}
@@ -0,0 +1,448 @@
+package sql_planner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary encoding of rows, trees and indices.
+//
+// field:  type tag (the ColumnType as one byte) followed by the payload
+//           INT:    zig-zag varint
+//           STRING: uvarint length, then the bytes
+//           BOOL:   one byte, 0 or 1
+//         or nullTag with no payload for a NULL (nil) field
+// row:    uvarint field count, then the fields
+// tree:   treeMagic, version byte, then rows in key order, each preceded by
+//         rowMarker, terminated by endMarker
+// index:  indexMagic, version byte, uvarint column count, each column as
+//         (uvarint name length, name, type tag), then the tree encoding
+// Row.MarshalBinary prefixes a single row with the version byte.
+
+const encodingVersion = 1
+
+const (
+  endMarker byte = 0
+  rowMarker byte = 1
+)
+
+// not a ColumnType
+const nullTag byte = 0
+
+var (
+  treeMagic  = []byte("NSPT")
+  indexMagic = []byte("NSPI")
+)
+
+var ErrCorruptEncoding = errors.New("corrupt encoding")
+var ErrUnsupportedVersion = errors.New("unsupported encoding version")
+
+func corrupt(format string, args ...interface{}) error {
+  return fmt.Errorf("%w: %s", ErrCorruptEncoding, fmt.Sprintf(format, args...))
+}
+
+// reading past the end of the input in the middle of a value is corruption,
+// not a clean end of stream
+func truncated(err error) error {
+  if err == io.EOF || err == io.ErrUnexpectedEOF {
+    return corrupt("unexpected end of input")
+  }
+  return err
+}
+
+type encodeReader interface {
+  io.Reader
+  io.ByteReader
+}
+
+func newEncodeReader(r io.Reader) encodeReader {
+  if er, ok := r.(encodeReader); ok {
+    return er
+  }
+  return bufio.NewReader(r)
+}
+
+func writeUvarint(w io.Writer, x uint64) error {
+  var buf [binary.MaxVarintLen64]byte
+  n := binary.PutUvarint(buf[:], x)
+  _, err := w.Write(buf[:n])
+  return err
+}
+
+func writeString(w io.Writer, s string) error {
+  if err := writeUvarint(w, uint64(len(s))); err != nil {
+    return err
+  }
+  _, err := io.WriteString(w, s)
+  return err
+}
+
+func readString(r encodeReader) (string, error) {
+  length, err := binary.ReadUvarint(r)
+  if err != nil {
+    return "", truncated(err)
+  }
+  if length > 1<<62 {
+    return "", corrupt("string length %d too large", length)
+  }
+  // copy through a buffer rather than allocating length bytes up front, so a
+  // corrupted length can't make us allocate more than the input holds
+  var buf bytes.Buffer
+  if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+    return "", truncated(err)
+  }
+  return buf.String(), nil
+}
+
+func writeField(w io.Writer, f Field) error {
+  if f == nil {
+    _, err := w.Write([]byte{nullTag})
+    return err
+  }
+  var buf [1 + binary.MaxVarintLen64]byte
+  buf[0] = byte(f.columnType())
+  switch v := f.(type) {
+  case IntField:
+    n := binary.PutVarint(buf[1:], int64(v))
+    _, err := w.Write(buf[:1+n])
+    return err
+  case StringField:
+    if _, err := w.Write(buf[:1]); err != nil {
+      return err
+    }
+    return writeString(w, string(v))
+  case BoolField:
+    if v {
+      buf[1] = 1
+    }
+    _, err := w.Write(buf[:2])
+    return err
+  default:
+    return fmt.Errorf("can not encode field of type %T", f)
+  }
+}
+
+func readField(r encodeReader) (Field, error) {
+  tag, err := r.ReadByte()
+  if err != nil {
+    return nil, truncated(err)
+  }
+  if tag == nullTag {
+    return nil, nil
+  }
+  switch ColumnType(tag) {
+  case INT:
+    v, err := binary.ReadVarint(r)
+    if err != nil {
+      return nil, truncated(err)
+    }
+    return IntField(v), nil
+  case STRING:
+    s, err := readString(r)
+    if err != nil {
+      return nil, err
+    }
+    return StringField(s), nil
+  case BOOL:
+    b, err := r.ReadByte()
+    if err != nil {
+      return nil, truncated(err)
+    }
+    if b > 1 {
+      return nil, corrupt("invalid bool value %d", b)
+    }
+    return BoolField(b == 1), nil
+  default:
+    return nil, corrupt("unknown field type tag %d", tag)
+  }
+}
+
+func writeRow(w io.Writer, row Row) error {
+  if err := writeUvarint(w, uint64(len(row))); err != nil {
+    return err
+  }
+  for _, f := range row {
+    if err := writeField(w, f); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func readRow(r encodeReader) (Row, error) {
+  count, err := binary.ReadUvarint(r)
+  if err != nil {
+    return nil, truncated(err)
+  }
+  row := make(Row, 0)
+  for i := uint64(0); i < count; i++ {
+    f, err := readField(r)
+    if err != nil {
+      return nil, err
+    }
+    row = append(row, f)
+  }
+  return row, nil
+}
+
+func readVersion(r encodeReader) error {
+  version, err := r.ReadByte()
+  if err != nil {
+    return truncated(err)
+  }
+  if version != encodingVersion {
+    return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+  }
+  return nil
+}
+
+func readMagic(r encodeReader, magic []byte) error {
+  header := make([]byte, len(magic))
+  if _, err := io.ReadFull(r, header); err != nil {
+    return truncated(err)
+  }
+  if !bytes.Equal(header, magic) {
+    return corrupt("bad header %q", header)
+  }
+  return readVersion(r)
+}
+
+func (r Row) MarshalBinary() ([]byte, error) {
+  var buf bytes.Buffer
+  buf.WriteByte(encodingVersion)
+  if err := writeRow(&buf, r); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+func (r *Row) UnmarshalBinary(data []byte) error {
+  reader := bytes.NewReader(data)
+  if err := readVersion(reader); err != nil {
+    return err
+  }
+  row, err := readRow(reader)
+  if err != nil {
+    return err
+  }
+  if reader.Len() > 0 {
+    return corrupt("%d trailing bytes after row", reader.Len())
+  }
+  *r = row
+  return nil
+}
+
+// Writes every row of the tree in key order.
+func (t *BTree) Serialize(w io.Writer) error {
+  bw := bufio.NewWriter(w)
+  if _, err := bw.Write(treeMagic); err != nil {
+    return err
+  }
+  if err := bw.WriteByte(encodingVersion); err != nil {
+    return err
+  }
+  if err := t.writeRows(bw); err != nil {
+    return err
+  }
+  return bw.Flush()
+}
+
+func (t *BTree) writeRows(w *bufio.Writer) error {
+  rows := make(chan Row)
+  go func() {
+    defer close(rows)
+    t.TraverseAll(rows)
+  }()
+  var err error
+  for row := range rows {
+    // keep draining after a failure so the traversal can finish
+    if err != nil {
+      continue
+    }
+    if err = w.WriteByte(rowMarker); err == nil {
+      err = writeRow(w, row)
+    }
+  }
+  if err != nil {
+    return err
+  }
+  return w.WriteByte(endMarker)
+}
+
+func DeserializeBTree(r io.Reader) (*BTree, error) {
+  reader := newEncodeReader(r)
+  if err := readMagic(reader, treeMagic); err != nil {
+    return nil, err
+  }
+  rows, err := readSortedRows(reader, nil)
+  if err != nil {
+    return nil, err
+  }
+  return bulkLoad(rows, false), nil
+}
+
+// reads the row stream of a tree. Rows must be strictly increasing, and
+// match schema if it's given, otherwise match the first row's types.
+func readSortedRows(r encodeReader, schema []Column) ([]Row, error) {
+  var rows []Row
+  for {
+    marker, err := r.ReadByte()
+    if err != nil {
+      return nil, truncated(err)
+    }
+    if marker == endMarker {
+      return rows, nil
+    }
+    if marker != rowMarker {
+      return nil, corrupt("invalid row marker %d", marker)
+    }
+    row, err := readRow(r)
+    if err != nil {
+      return nil, err
+    }
+    for _, f := range row {
+      if f == nil {
+        return nil, corrupt("row %d has a NULL field", len(rows))
+      }
+    }
+    if schema != nil {
+      if err := rowMatchSchema(row, schema); err != nil {
+        return nil, corrupt("row %d: %v", len(rows), err)
+      }
+    } else if len(rows) > 0 && !rowTypesMatch(row, rows[0]) {
+      return nil, corrupt("row %d has different types from row 0", len(rows))
+    }
+    if len(rows) > 0 && !rows[len(rows)-1].lessThan(row) {
+      return nil, corrupt("row %d out of order", len(rows))
+    }
+    rows = append(rows, row)
+  }
+}
+
+func rowTypesMatch(a Row, b Row) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i].columnType() != b[i].columnType() {
+      return false
+    }
+  }
+  return true
+}
+
+// Builds a well-formed tree from rows that are already sorted and unique,
+// level by level from the leaves up, without going through Insert. Its nodes
+// store keys whole if uncompressed is set.
+func bulkLoad(rows []Row, uncompressed bool) *BTree {
+  keys := rows
+  var children []*BTree
+  for {
+    // fewest nodes that can hold the keys, leaving one separator between
+    // each pair of neighbours
+    nodeCount := (len(keys) + MAX_NODE_SIZE + 1) / (MAX_NODE_SIZE + 1)
+    if nodeCount <= 1 {
+      root := &BTree{keys: copyKeys(keys), children: children, uncompressed: uncompressed}
+      root.compress()
+      return root
+    }
+    perNode := (len(keys) - (nodeCount - 1)) / nodeCount
+    extra := (len(keys) - (nodeCount - 1)) % nodeCount
+    parents := make([]*BTree, 0, nodeCount)
+    separators := make([]Row, 0, nodeCount-1)
+    keyIndex, childIndex := 0, 0
+    for n := 0; n < nodeCount; n++ {
+      count := perNode
+      if n < extra {
+        count++
+      }
+      node := &BTree{keys: copyKeys(keys[keyIndex : keyIndex+count]), uncompressed: uncompressed}
+      if children != nil {
+        node.children = copyNodes(children[childIndex : childIndex+count+1])
+        childIndex += count + 1
+      }
+      node.compress()
+      keyIndex += count
+      if n < nodeCount-1 {
+        separators = append(separators, keys[keyIndex])
+        keyIndex++
+      }
+      parents = append(parents, node)
+    }
+    keys, children = separators, parents
+  }
+}
+
+// Writes the index's schema followed by its tree.
+func (i *Index) Serialize(w io.Writer) error {
+  bw := bufio.NewWriter(w)
+  if _, err := bw.Write(indexMagic); err != nil {
+    return err
+  }
+  if err := bw.WriteByte(encodingVersion); err != nil {
+    return err
+  }
+  if err := writeUvarint(bw, uint64(len(i.schema))); err != nil {
+    return err
+  }
+  for _, col := range i.schema {
+    if err := writeString(bw, col.Name); err != nil {
+      return err
+    }
+    if err := bw.WriteByte(byte(col.ColumnType)); err != nil {
+      return err
+    }
+  }
+  if _, err := bw.Write(treeMagic); err != nil {
+    return err
+  }
+  if err := bw.WriteByte(encodingVersion); err != nil {
+    return err
+  }
+  if err := i.tree().writeRows(bw); err != nil {
+    return err
+  }
+  return bw.Flush()
+}
+
+func DeserializeIndex(r io.Reader) (*Index, error) {
+  reader := newEncodeReader(r)
+  if err := readMagic(reader, indexMagic); err != nil {
+    return nil, err
+  }
+  count, err := binary.ReadUvarint(reader)
+  if err != nil {
+    return nil, truncated(err)
+  }
+  schema := make([]Column, 0)
+  for c := uint64(0); c < count; c++ {
+    name, err := readString(reader)
+    if err != nil {
+      return nil, err
+    }
+    tag, err := reader.ReadByte()
+    if err != nil {
+      return nil, truncated(err)
+    }
+    colType := ColumnType(tag)
+    if colType.String() == "unknown" {
+      return nil, corrupt("unknown column type %d for column %q", tag, name)
+    }
+    schema = append(schema, Column{Name: name, ColumnType: colType})
+  }
+  if len(schema) == 0 {
+    return nil, corrupt("index schema is empty")
+  }
+  if err := readMagic(reader, treeMagic); err != nil {
+    return nil, err
+  }
+  rows, err := readSortedRows(reader, schema)
+  if err != nil {
+    return nil, err
+  }
+  return &Index{schema: schema, btree: bulkLoad(rows, false)}, nil
+}
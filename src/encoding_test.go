@@ -0,0 +1,169 @@
+package sql_planner
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRowRoundTrip(t *testing.T) {
+  rows := []Row{
+    {},
+    {IntField(0), IntField(-1), IntField(math.MaxInt64), IntField(math.MinInt64)},
+    {StringField(""), StringField("doodle@sheen.com"), StringField("ünïcødé ✓")},
+    {BoolField(true), BoolField(false)},
+    {nil, IntField(1), nil},
+    {StringField("toto@sheen.com"), IntField(21), IntField(2), BoolField(true)},
+  }
+  for _, row := range rows {
+    data, err := row.MarshalBinary()
+    require.NoError(t, err)
+    var decoded Row
+    require.NoError(t, decoded.UnmarshalBinary(data))
+    require.Equal(t, row, decoded)
+  }
+}
+
+func TestRowUnmarshalCorrupt(t *testing.T) {
+  data, err := Row{StringField("pusheen"), IntField(300), BoolField(true)}.MarshalBinary()
+  require.NoError(t, err)
+
+  var row Row
+  // every strict prefix is truncated
+  for i := 0; i < len(data); i++ {
+    require.Error(t, row.UnmarshalBinary(data[:i]), "prefix of length %d", i)
+  }
+  require.ErrorIs(t, row.UnmarshalBinary(append(data, 0)), ErrCorruptEncoding)
+
+  badVersion := append([]byte{}, data...)
+  badVersion[0] = encodingVersion + 1
+  require.ErrorIs(t, row.UnmarshalBinary(badVersion), ErrUnsupportedVersion)
+
+  badTag := append([]byte{}, data...)
+  badTag[2] = 42
+  require.ErrorIs(t, row.UnmarshalBinary(badTag), ErrCorruptEncoding)
+
+  badBool, err := Row{BoolField(true)}.MarshalBinary()
+  require.NoError(t, err)
+  badBool[len(badBool)-1] = 2
+  require.ErrorIs(t, row.UnmarshalBinary(badBool), ErrCorruptEncoding)
+
+  hugeString := []byte{encodingVersion, 1, byte(STRING), 0xff, 0xff, 0xff, 0xff, 0x0f}
+  require.ErrorIs(t, row.UnmarshalBinary(hugeString), ErrCorruptEncoding)
+}
+
+func TestBTreeRoundTrip(t *testing.T) {
+  for _, count := range []int{0, 1, 6, 7, 8, 20, 49, 50, 343, 1000} {
+    tree := &BTree{}
+    for i := 0; i < count; i++ {
+      tree = tree.Insert(Row{IntField((i * 7) % count), StringField("x"), BoolField(i%2 == 0)})
+    }
+    var buf bytes.Buffer
+    require.NoError(t, tree.Serialize(&buf))
+
+    decoded, err := DeserializeBTree(&buf)
+    require.NoError(t, err)
+    decoded.AssertWellFormed()
+    require.Equal(t, allKeys(tree), allKeys(decoded))
+
+    // a bulk loaded tree keeps working with regular inserts and deletes
+    for i := 0; i < count; i += 3 {
+      decoded = decoded.Delete(Row{IntField((i * 7) % count), StringField("x"), BoolField(i%2 == 0)})
+      decoded.AssertWellFormed()
+    }
+    for i := count; i < count+20; i++ {
+      decoded = decoded.Insert(Row{IntField(i), StringField("y"), BoolField(false)})
+      decoded.AssertWellFormed()
+    }
+  }
+}
+
+func TestBTreeDeserializeCorrupt(t *testing.T) {
+  tree := &BTree{}
+  for i := 0; i < 10; i++ {
+    tree = tree.Insert(intKey(i))
+  }
+  var buf bytes.Buffer
+  require.NoError(t, tree.Serialize(&buf))
+  data := buf.Bytes()
+
+  for i := 0; i < len(data); i++ {
+    _, err := DeserializeBTree(bytes.NewReader(data[:i]))
+    require.Error(t, err, "prefix of length %d", i)
+  }
+
+  badMagic := append([]byte{}, data...)
+  badMagic[0] = 'X'
+  _, err := DeserializeBTree(bytes.NewReader(badMagic))
+  require.ErrorIs(t, err, ErrCorruptEncoding)
+
+  badVersion := append([]byte{}, data...)
+  badVersion[len(treeMagic)] = 0
+  _, err = DeserializeBTree(bytes.NewReader(badVersion))
+  require.ErrorIs(t, err, ErrUnsupportedVersion)
+
+  badMarker := append([]byte{}, data...)
+  badMarker[len(treeMagic)+1] = 7
+  _, err = DeserializeBTree(bytes.NewReader(badMarker))
+  require.ErrorIs(t, err, ErrCorruptEncoding)
+
+  // rows out of order
+  var unordered bytes.Buffer
+  unordered.Write(treeMagic)
+  unordered.WriteByte(encodingVersion)
+  for _, row := range []Row{intKey(2), intKey(1)} {
+    unordered.WriteByte(rowMarker)
+    require.NoError(t, writeRow(&unordered, row))
+  }
+  unordered.WriteByte(endMarker)
+  _, err = DeserializeBTree(&unordered)
+  require.ErrorIs(t, err, ErrCorruptEncoding)
+
+  // rows of differing types
+  var mixed bytes.Buffer
+  mixed.Write(treeMagic)
+  mixed.WriteByte(encodingVersion)
+  for _, row := range []Row{intKey(1), {StringField("2")}} {
+    mixed.WriteByte(rowMarker)
+    require.NoError(t, writeRow(&mixed, row))
+  }
+  mixed.WriteByte(endMarker)
+  _, err = DeserializeBTree(&mixed)
+  require.ErrorIs(t, err, ErrCorruptEncoding)
+
+  // NULLs can't be compared, so they can't be keys
+  var null bytes.Buffer
+  null.Write(treeMagic)
+  null.WriteByte(encodingVersion)
+  null.WriteByte(rowMarker)
+  require.NoError(t, writeRow(&null, Row{nil}))
+  null.WriteByte(endMarker)
+  _, err = DeserializeBTree(&null)
+  require.ErrorIs(t, err, ErrCorruptEncoding)
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 100)
+
+  for _, index := range append([]*Index{table.primaryIndex}, table.indices...) {
+    var buf bytes.Buffer
+    require.NoError(t, index.Serialize(&buf))
+    decoded, err := DeserializeIndex(&buf)
+    require.NoError(t, err)
+    decoded.btree.AssertWellFormed()
+    require.Equal(t, index.schema, decoded.schema)
+    require.Equal(t, allKeys(index.btree), allKeys(decoded.btree))
+  }
+
+  // rows that don't match the encoded schema are rejected
+  var buf bytes.Buffer
+  require.NoError(t, (&Index{
+    schema: []Column{{Name: "id", ColumnType: STRING}},
+    btree:  new(BTree).Insert(intKey(1)),
+  }).Serialize(&buf))
+  _, err := DeserializeIndex(&buf)
+  require.ErrorIs(t, err, ErrCorruptEncoding)
+}
@@ -0,0 +1,216 @@
+package sql_planner
+
+import (
+	"context"
+	"sync"
+)
+
+// Produces rows in batches to output and returns once it's done, like
+// TraverseWithIndexPaginated. Operators take their inputs as RowSources and
+// are RowSources themselves. Rows are positional; a nil field is NULL.
+type RowSource func(output chan<- []Row) error
+
+// RowSource of the rows matching pred on index, in the order of the table schema
+func (t *Table) Scan(index *Index, pred QueryPredicate, batchSize int) RowSource {
+  return t.ScanContext(context.Background(), index, pred, batchSize)
+}
+
+// like Scan, but the scan stops once ctx is done, see
+// TraverseWithIndexPaginatedContext
+func (t *Table) ScanContext(ctx context.Context, index *Index, pred QueryPredicate, batchSize int) RowSource {
+  return func(output chan<- []Row) error {
+    return t.TraverseWithIndexPaginatedContext(ctx, index, pred, batchSize, output)
+  }
+}
+
+// RowSource of rows that are already in memory
+func rowsSource(rows []Row, batchSize int) RowSource {
+  return func(output chan<- []Row) error {
+    for start := 0; start < len(rows); start += batchSize {
+      end := start + batchSize
+      if end > len(rows) {
+        end = len(rows)
+      }
+      output <- rows[start:end]
+    }
+    return nil
+  }
+}
+
+// Runs src and calls each on every batch. src is always run to the end; the
+// first error from either is returned.
+func drain(src RowSource, each func([]Row) error) error {
+  output := make(chan []Row)
+  srcErr := make(chan error, 1)
+  go func() {
+    defer close(output)
+    srcErr <- src(output)
+  }()
+  var err error
+  for batch := range output {
+    if err == nil {
+      err = each(batch)
+    }
+  }
+  if e := <-srcErr; e != nil && err == nil {
+    err = e
+  }
+  return err
+}
+
+// Goroutines that fail together, like errgroup: the first error is kept and
+// ctx is cancelled, so the others can stop early.
+type group struct {
+  ctx context.Context
+  cancel context.CancelFunc
+  wait sync.WaitGroup
+  once sync.Once
+  err error
+}
+
+func newGroup(ctx context.Context) *group {
+  ctx, cancel := context.WithCancel(ctx)
+  return &group{ctx: ctx, cancel: cancel}
+}
+
+func (g *group) fail(err error) {
+  g.once.Do(func() {
+    g.err = err
+    g.cancel()
+  })
+}
+
+func (g *group) run(f func(ctx context.Context) error) {
+  g.wait.Add(1)
+  go func() {
+    defer g.wait.Done()
+    if err := f(g.ctx); err != nil {
+      g.fail(err)
+    }
+  }()
+}
+
+// waits for every goroutine and returns the first error
+func (g *group) finish() error {
+  g.wait.Wait()
+  g.cancel()
+  return g.err
+}
+
+// Runs src in a goroutine and calls each on every batch it produces. Once
+// either fails, or ctx is done, src is cancelled, the rest of its batches are
+// dropped and the first error is returned.
+func pipe(ctx context.Context, src func(ctx context.Context, output chan<- []Row) error, each func([]Row) error) error {
+  g := newGroup(ctx)
+  output := make(chan []Row)
+  g.run(func(ctx context.Context) error {
+    defer close(output)
+    return src(ctx, output)
+  })
+  failed := false
+  for batch := range output {
+    if failed {
+      continue
+    }
+    if err := each(batch); err != nil {
+      failed = true
+      g.fail(err)
+    }
+  }
+  return g.finish()
+}
+
+func collectRows(src RowSource) ([]Row, error) {
+  rows := make([]Row, 0)
+  err := drain(src, func(batch []Row) error {
+    rows = append(rows, batch...)
+    return nil
+  })
+  return rows, err
+}
+
+// regroups rows added one at a time into batches of size
+type batcher struct {
+  output chan<- []Row
+  size int
+  batch []Row
+}
+
+func newBatcher(output chan<- []Row, size int) *batcher {
+  if size <= 0 {
+    size = DefaultBatchSize
+  }
+  return &batcher{output: output, size: size}
+}
+
+func (b *batcher) add(row Row) {
+  b.batch = append(b.batch, row)
+  if len(b.batch) >= b.size {
+    b.flush()
+  }
+}
+
+func (b *batcher) flush() {
+  if len(b.batch) > 0 {
+    b.output <- b.batch
+    b.batch = nil
+  }
+}
+
+// rough number of bytes a row takes up in memory, for memory budgets
+func estimatedRowBytes(row Row) int64 {
+  // slice header, plus an interface value per field
+  size := int64(24 + 16*len(row))
+  for _, f := range row {
+    switch v := f.(type) {
+    case IntField:
+      size += 8
+    case StringField:
+      size += 16 + int64(len(v))
+    case BoolField:
+      size += 1
+    }
+  }
+  return size
+}
+
+// Reads a RowSource one row at a time, for operators that consume more than
+// one input at once.
+type rowCursor struct {
+  batches chan []Row
+  err chan error
+  batch []Row
+  position int
+}
+
+func newRowCursor(src RowSource) *rowCursor {
+  c := &rowCursor{batches: make(chan []Row), err: make(chan error, 1)}
+  go func() {
+    defer close(c.batches)
+    c.err <- src(c.batches)
+  }()
+  return c
+}
+
+// the next row without consuming it, false at the end
+func (c *rowCursor) peek() (Row, bool) {
+  for c.position >= len(c.batch) {
+    batch, ok := <-c.batches
+    if !ok {
+      return nil, false
+    }
+    c.batch, c.position = batch, 0
+  }
+  return c.batch[c.position], true
+}
+
+func (c *rowCursor) advance() {
+  c.position++
+}
+
+// runs the source to the end and returns its error
+func (c *rowCursor) close() error {
+  for range c.batches {
+  }
+  return <-c.err
+}
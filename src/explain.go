@@ -0,0 +1,71 @@
+package sql_planner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describes plan as a tree, one node per line with its inputs indented below
+// it, along with the optimizer's estimates of its output rows and cost.
+func Explain(plan Plan) string {
+  var b strings.Builder
+  explainNode(&b, plan, 0)
+  return b.String()
+}
+
+func explainNode(b *strings.Builder, plan Plan, depth int) {
+  estimate := plan.estimated()
+  fmt.Fprintf(b, "%s%s (rows=%.1f cost=%.1f)\n", strings.Repeat("  ", depth), plan.describe(), estimate.rows, estimate.cost)
+  for _, input := range plan.inputs() {
+    explainNode(b, input, depth+1)
+  }
+}
+
+// The chosen plan, followed by the alternatives and their costs.
+func (p *QueryPlan) Explain() string {
+  explained := Explain(p.Root)
+  if len(p.Alternatives) > 0 {
+    explained += "alternatives:\n"
+    for _, alternative := range p.Alternatives {
+      explained += fmt.Sprintf("  %s (cost=%.1f)\n", summarize(alternative), alternative.estimated().cost)
+    }
+  }
+  return explained
+}
+
+// EXPLAIN for the query, see Database.Plan.
+func (d *Database) Explain(query Query) (string, error) {
+  plan, err := d.Plan(query)
+  if err != nil {
+    return "", err
+  }
+  return plan.Explain(), nil
+}
+
+// one line form of a plan, naming only the tables, indices and join methods
+func summarize(plan Plan) string {
+  switch p := plan.(type) {
+  case *ScanPlan:
+    if p.Index == p.Table.PrimaryIndex() {
+      return p.Table.Name()
+    }
+    return fmt.Sprintf("%s using %s", p.Table.Name(), p.Index.Name())
+  case *JoinPlan:
+    return fmt.Sprintf("(%s %s %s)", summarize(p.Left), p.Method, summarize(p.Right))
+  case *AggregatePlan:
+    if p.Streaming {
+      return fmt.Sprintf("stream aggregate(%s)", summarize(p.Input))
+    }
+    return fmt.Sprintf("hash aggregate(%s)", summarize(p.Input))
+  case *SortPlan:
+    return fmt.Sprintf("sort(%s)", summarize(p.Input))
+  case *LimitPlan:
+    return fmt.Sprintf("limit(%s)", summarize(p.Input))
+  case *FilterPlan:
+    return fmt.Sprintf("filter(%s)", summarize(p.Input))
+  case *ProjectPlan:
+    return summarize(p.Input)
+  default:
+    return plan.describe()
+  }
+}
@@ -0,0 +1,750 @@
+package sql_planner
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Scalar expression over the columns of a row. Expressions are built with the
+// functions below, and checked against the columns they'll see with Compile.
+// They follow SQL's rules for NULL: an expression with a NULL operand is NULL,
+// except for AND, OR, IS NULL and CASE.
+type Expr interface {
+  compile(columns []Column) (*CompiledExpr, error)
+  // names of the columns the expression reads
+  references() []string
+  // the same expression reading the columns rename gives for each name
+  withColumns(rename func(string) string) Expr
+  String() string
+}
+
+// Expression checked against a set of columns, ready to evaluate on rows of
+// them.
+type CompiledExpr struct {
+  Type ColumnType
+  eval func(Row) (Field, error)
+}
+
+func (c *CompiledExpr) Eval(row Row) (Field, error) {
+  return c.eval(row)
+}
+
+func Compile(e Expr, columns []Column) (*CompiledExpr, error) {
+  return e.compile(columns)
+}
+
+// Compiles a BOOL expression into a function that says whether a row passes,
+// as used by QueryPredicate.Filter. Rows it's NULL for, or that it fails to
+// evaluate on, such as by dividing by zero, don't pass.
+func CompileFilter(e Expr, columns []Column) (func(Row) bool, error) {
+  compiled, err := e.compile(columns)
+  if err != nil {
+    return nil, err
+  }
+  if compiled.Type != BOOL {
+    return nil, fmt.Errorf("filter %s is a %s, not a bool", e, compiled.Type)
+  }
+  return func(row Row) bool {
+    f, err := compiled.eval(row)
+    return err == nil && f == BoolField(true)
+  }, nil
+}
+
+var ErrDivisionByZero = errors.New("division by zero")
+
+type columnRef struct {
+  name string
+}
+
+// Value of the named column, named like in Plan.Columns.
+func ColumnRef(name string) Expr {
+  return columnRef{name: name}
+}
+
+func (c columnRef) compile(columns []Column) (*CompiledExpr, error) {
+  position, err := resolveColumn(columns, c.name)
+  if err != nil {
+    return nil, err
+  }
+  return &CompiledExpr{
+    Type: columns[position].ColumnType,
+    eval: func(row Row) (Field, error) {
+      if position >= len(row) {
+        return nil, fmt.Errorf("row has no column %s", c.name)
+      }
+      return row[position], nil
+    },
+  }, nil
+}
+
+func (c columnRef) references() []string {
+  return []string{c.name}
+}
+
+func (c columnRef) withColumns(rename func(string) string) Expr {
+  return columnRef{name: rename(c.name)}
+}
+
+func (c columnRef) String() string {
+  return c.name
+}
+
+type literal struct {
+  value Field
+  columnType ColumnType
+}
+
+func Literal(f Field) Expr {
+  return literal{value: f, columnType: f.columnType()}
+}
+
+// NULL of the given type
+func Null(t ColumnType) Expr {
+  return literal{columnType: t}
+}
+
+func (l literal) compile(columns []Column) (*CompiledExpr, error) {
+  return &CompiledExpr{Type: l.columnType, eval: func(Row) (Field, error) { return l.value, nil }}, nil
+}
+
+func (l literal) references() []string {
+  return nil
+}
+
+func (l literal) withColumns(rename func(string) string) Expr {
+  return l
+}
+
+func (l literal) String() string {
+  switch v := l.value.(type) {
+  case nil:
+    return "NULL"
+  case StringField:
+    return "'" + strings.ReplaceAll(string(v), "'", "''") + "'"
+  default:
+    return fmt.Sprint(v)
+  }
+}
+
+// compiles each operand, checking each has type t, or any type if t is 0
+func compileOperands(columns []Column, t ColumnType, operands ...Expr) ([]*CompiledExpr, error) {
+  compiled := make([]*CompiledExpr, 0, len(operands))
+  for _, operand := range operands {
+    c, err := operand.compile(columns)
+    if err != nil {
+      return nil, err
+    }
+    if t != 0 && c.Type != t {
+      return nil, fmt.Errorf("%s is a %s, not a %s", operand, c.Type, t)
+    }
+    compiled = append(compiled, c)
+  }
+  return compiled, nil
+}
+
+// evaluates each operand, returning nil fields if any of them is NULL
+func evalOperands(row Row, operands []*CompiledExpr) ([]Field, error) {
+  fields := make([]Field, 0, len(operands))
+  for _, operand := range operands {
+    f, err := operand.eval(row)
+    if err != nil || f == nil {
+      return nil, err
+    }
+    fields = append(fields, f)
+  }
+  return fields, nil
+}
+
+func withColumns(operands []Expr, rename func(string) string) []Expr {
+  renamed := make([]Expr, 0, len(operands))
+  for _, operand := range operands {
+    renamed = append(renamed, operand.withColumns(rename))
+  }
+  return renamed
+}
+
+func referencesOf(operands ...Expr) []string {
+  names := make([]string, 0)
+  for _, operand := range operands {
+    if operand != nil {
+      names = append(names, operand.references()...)
+    }
+  }
+  return names
+}
+
+type ArithmeticOp int
+
+const (
+  Plus ArithmeticOp = iota + 1
+  Minus
+  Times
+  Divide
+  Modulo
+)
+
+func (o ArithmeticOp) String() string {
+  switch o {
+  case Plus:
+    return "+"
+  case Minus:
+    return "-"
+  case Times:
+    return "*"
+  case Divide:
+    return "/"
+  case Modulo:
+    return "%"
+  default:
+    return "?"
+  }
+}
+
+type arithmetic struct {
+  op ArithmeticOp
+  left Expr
+  right Expr
+}
+
+// INT arithmetic, division truncates
+func Arithmetic(op ArithmeticOp, left Expr, right Expr) Expr {
+  return arithmetic{op: op, left: left, right: right}
+}
+
+func (a arithmetic) compile(columns []Column) (*CompiledExpr, error) {
+  if a.op < Plus || a.op > Modulo {
+    return nil, errors.New("unknown arithmetic operator")
+  }
+  operands, err := compileOperands(columns, INT, a.left, a.right)
+  if err != nil {
+    return nil, err
+  }
+  return &CompiledExpr{Type: INT, eval: func(row Row) (Field, error) {
+    fields, err := evalOperands(row, operands)
+    if fields == nil {
+      return nil, err
+    }
+    x, y := fields[0].(IntField), fields[1].(IntField)
+    switch a.op {
+    case Plus:
+      return x + y, nil
+    case Minus:
+      return x - y, nil
+    case Times:
+      return x * y, nil
+    case Divide:
+      if y == 0 {
+        return nil, ErrDivisionByZero
+      }
+      return x / y, nil
+    default:
+      if y == 0 {
+        return nil, ErrDivisionByZero
+      }
+      return x % y, nil
+    }
+  }}, nil
+}
+
+func (a arithmetic) references() []string {
+  return referencesOf(a.left, a.right)
+}
+
+func (a arithmetic) withColumns(rename func(string) string) Expr {
+  return arithmetic{op: a.op, left: a.left.withColumns(rename), right: a.right.withColumns(rename)}
+}
+
+func (a arithmetic) String() string {
+  return fmt.Sprintf("(%s %s %s)", a.left, a.op, a.right)
+}
+
+type comparison struct {
+  op CompareOp
+  left Expr
+  right Expr
+}
+
+// left compared to right, which must have the same type
+func Compare(op CompareOp, left Expr, right Expr) Expr {
+  return comparison{op: op, left: left, right: right}
+}
+
+func (c comparison) compile(columns []Column) (*CompiledExpr, error) {
+  if c.op < Equal || c.op > NotEqual {
+    return nil, errors.New("unknown comparison operator")
+  }
+  operands, err := compileOperands(columns, 0, c.left, c.right)
+  if err != nil {
+    return nil, err
+  }
+  if operands[0].Type != operands[1].Type {
+    return nil, fmt.Errorf("can not compare %s with %s of a different type", c.left, c.right)
+  }
+  return &CompiledExpr{Type: BOOL, eval: func(row Row) (Field, error) {
+    fields, err := evalOperands(row, operands)
+    if fields == nil {
+      return nil, err
+    }
+    return BoolField(c.op.holds(fields[0], fields[1])), nil
+  }}, nil
+}
+
+func (c comparison) references() []string {
+  return referencesOf(c.left, c.right)
+}
+
+func (c comparison) withColumns(rename func(string) string) Expr {
+  return comparison{op: c.op, left: c.left.withColumns(rename), right: c.right.withColumns(rename)}
+}
+
+func (c comparison) String() string {
+  return fmt.Sprintf("%s %s %s", c.left, c.op, c.right)
+}
+
+type logical struct {
+  // AND if not OR
+  or bool
+  operands []Expr
+}
+
+// true if every operand is, false if any is, and otherwise NULL
+func And(operands ...Expr) Expr {
+  return logical{operands: operands}
+}
+
+// true if any operand is, false if every one is, and otherwise NULL
+func Or(operands ...Expr) Expr {
+  return logical{or: true, operands: operands}
+}
+
+// whether e equals one of values, as an Or of the comparisons
+func In(e Expr, values ...Expr) Expr {
+  operands := make([]Expr, 0, len(values))
+  for _, value := range values {
+    operands = append(operands, Compare(Equal, e, value))
+  }
+  return Or(operands...)
+}
+
+func (l logical) compile(columns []Column) (*CompiledExpr, error) {
+  operands, err := compileOperands(columns, BOOL, l.operands...)
+  if err != nil {
+    return nil, err
+  }
+  // the value that decides the result as soon as an operand has it
+  decisive := BoolField(l.or)
+  return &CompiledExpr{Type: BOOL, eval: func(row Row) (Field, error) {
+    var result Field = !decisive
+    for _, operand := range operands {
+      f, err := operand.eval(row)
+      if err != nil {
+        return nil, err
+      }
+      if f == nil {
+        result = nil
+      } else if f == decisive {
+        return decisive, nil
+      }
+    }
+    return result, nil
+  }}, nil
+}
+
+func (l logical) references() []string {
+  return referencesOf(l.operands...)
+}
+
+func (l logical) withColumns(rename func(string) string) Expr {
+  return logical{or: l.or, operands: withColumns(l.operands, rename)}
+}
+
+func (l logical) String() string {
+  parts := make([]string, 0, len(l.operands))
+  for _, operand := range l.operands {
+    parts = append(parts, operand.String())
+  }
+  if l.or {
+    return "(" + strings.Join(parts, " OR ") + ")"
+  }
+  return "(" + strings.Join(parts, " AND ") + ")"
+}
+
+type not struct {
+  operand Expr
+}
+
+func Not(operand Expr) Expr {
+  return not{operand: operand}
+}
+
+func (n not) compile(columns []Column) (*CompiledExpr, error) {
+  operands, err := compileOperands(columns, BOOL, n.operand)
+  if err != nil {
+    return nil, err
+  }
+  return &CompiledExpr{Type: BOOL, eval: func(row Row) (Field, error) {
+    fields, err := evalOperands(row, operands)
+    if fields == nil {
+      return nil, err
+    }
+    return !fields[0].(BoolField), nil
+  }}, nil
+}
+
+func (n not) references() []string {
+  return n.operand.references()
+}
+
+func (n not) withColumns(rename func(string) string) Expr {
+  return not{operand: n.operand.withColumns(rename)}
+}
+
+func (n not) String() string {
+  return fmt.Sprintf("NOT %s", n.operand)
+}
+
+type isNull struct {
+  operand Expr
+}
+
+// whether operand is NULL, never NULL itself
+func IsNull(operand Expr) Expr {
+  return isNull{operand: operand}
+}
+
+func (n isNull) compile(columns []Column) (*CompiledExpr, error) {
+  operand, err := n.operand.compile(columns)
+  if err != nil {
+    return nil, err
+  }
+  return &CompiledExpr{Type: BOOL, eval: func(row Row) (Field, error) {
+    f, err := operand.eval(row)
+    if err != nil {
+      return nil, err
+    }
+    return BoolField(f == nil), nil
+  }}, nil
+}
+
+func (n isNull) references() []string {
+  return n.operand.references()
+}
+
+func (n isNull) withColumns(rename func(string) string) Expr {
+  return isNull{operand: n.operand.withColumns(rename)}
+}
+
+func (n isNull) String() string {
+  return fmt.Sprintf("%s IS NULL", n.operand)
+}
+
+// scalar function of fixed argument types
+type function struct {
+  name string
+  args []Expr
+  argTypes []ColumnType
+  result ColumnType
+  apply func(args []Field) (Field, error)
+}
+
+func (f function) compile(columns []Column) (*CompiledExpr, error) {
+  if len(f.args) != len(f.argTypes) {
+    return nil, fmt.Errorf("%s takes %d arguments", f.name, len(f.argTypes))
+  }
+  operands := make([]*CompiledExpr, 0, len(f.args))
+  for i, arg := range f.args {
+    compiled, err := compileOperands(columns, f.argTypes[i], arg)
+    if err != nil {
+      return nil, err
+    }
+    operands = append(operands, compiled[0])
+  }
+  return &CompiledExpr{Type: f.result, eval: func(row Row) (Field, error) {
+    fields, err := evalOperands(row, operands)
+    if fields == nil {
+      return nil, err
+    }
+    return f.apply(fields)
+  }}, nil
+}
+
+func (f function) references() []string {
+  return referencesOf(f.args...)
+}
+
+func (f function) withColumns(rename func(string) string) Expr {
+  f.args = withColumns(f.args, rename)
+  return f
+}
+
+func (f function) String() string {
+  args := make([]string, 0, len(f.args))
+  for _, arg := range f.args {
+    args = append(args, arg.String())
+  }
+  return fmt.Sprintf("%s(%s)", f.name, strings.Join(args, ", "))
+}
+
+func Lower(s Expr) Expr {
+  return function{name: "LOWER", args: []Expr{s}, argTypes: []ColumnType{STRING}, result: STRING,
+    apply: func(args []Field) (Field, error) {
+      return StringField(strings.ToLower(string(args[0].(StringField)))), nil
+    },
+  }
+}
+
+func Upper(s Expr) Expr {
+  return function{name: "UPPER", args: []Expr{s}, argTypes: []ColumnType{STRING}, result: STRING,
+    apply: func(args []Field) (Field, error) {
+      return StringField(strings.ToUpper(string(args[0].(StringField)))), nil
+    },
+  }
+}
+
+// number of characters in s
+func Length(s Expr) Expr {
+  return function{name: "LENGTH", args: []Expr{s}, argTypes: []ColumnType{STRING}, result: INT,
+    apply: func(args []Field) (Field, error) {
+      return IntField(len([]rune(string(args[0].(StringField))))), nil
+    },
+  }
+}
+
+// The length characters of s from start, counting from 1 like SQL. Parts of
+// the range outside s are ignored.
+func Substr(s Expr, start Expr, length Expr) Expr {
+  return function{name: "SUBSTR", args: []Expr{s, start, length}, argTypes: []ColumnType{STRING, INT, INT}, result: STRING,
+    apply: func(args []Field) (Field, error) {
+      runes := []rune(string(args[0].(StringField)))
+      begin, count := int64(args[1].(IntField))-1, int64(args[2].(IntField))
+      if count < 0 {
+        return nil, errors.New("negative substring length")
+      }
+      end := begin + count
+      if begin < 0 {
+        begin = 0
+      }
+      if end > int64(len(runes)) {
+        end = int64(len(runes))
+      }
+      if begin >= end {
+        return StringField(""), nil
+      }
+      return StringField(string(runes[begin:end])), nil
+    },
+  }
+}
+
+// Whether s matches pattern, where % matches any characters, _ matches one,
+// and \ makes the character after it match only itself.
+func Like(s Expr, pattern Expr) Expr {
+  return function{name: "LIKE", args: []Expr{s, pattern}, argTypes: []ColumnType{STRING, STRING}, result: BOOL,
+    apply: func(args []Field) (Field, error) {
+      return BoolField(likeMatch([]rune(string(args[0].(StringField))), []rune(string(args[1].(StringField))))), nil
+    },
+  }
+}
+
+func likeMatch(s []rune, pattern []rune) bool {
+  // position after the last %, and in s where its match ends, to backtrack to
+  star, starMatch := -1, 0
+  i, p := 0, 0
+  for i < len(s) {
+    switch {
+    case p < len(pattern) && pattern[p] == '%':
+      star, starMatch = p, i
+      p++
+    case p < len(pattern) && pattern[p] == '\\' && p+1 < len(pattern) && pattern[p+1] == s[i]:
+      i, p = i+1, p+2
+    case p < len(pattern) && pattern[p] != '\\' && (pattern[p] == '_' || pattern[p] == s[i]):
+      i, p = i+1, p+1
+    case star >= 0:
+      // let the last % match one more character
+      starMatch++
+      i, p = starMatch, star+1
+    default:
+      return false
+    }
+  }
+  for p < len(pattern) && pattern[p] == '%' {
+    p++
+  }
+  return p == len(pattern)
+}
+
+type When struct {
+  Condition Expr
+  Result Expr
+}
+
+type caseExpr struct {
+  whens []When
+  otherwise Expr
+}
+
+// Result of the first When whose condition is true, otherwise the value of
+// otherwise, which is NULL if it's nil. Every result has the same type.
+func Case(whens []When, otherwise Expr) Expr {
+  return caseExpr{whens: whens, otherwise: otherwise}
+}
+
+func (c caseExpr) compile(columns []Column) (*CompiledExpr, error) {
+  if len(c.whens) == 0 {
+    return nil, errors.New("CASE needs a WHEN")
+  }
+  conditions := make([]*CompiledExpr, 0, len(c.whens))
+  results := make([]*CompiledExpr, 0, len(c.whens)+1)
+  for _, when := range c.whens {
+    condition, err := compileOperands(columns, BOOL, when.Condition)
+    if err != nil {
+      return nil, err
+    }
+    conditions = append(conditions, condition[0])
+    result, err := compileOperands(columns, 0, when.Result)
+    if err != nil {
+      return nil, err
+    }
+    results = append(results, result[0])
+  }
+  resultType := results[0].Type
+  if c.otherwise != nil {
+    otherwise, err := c.otherwise.compile(columns)
+    if err != nil {
+      return nil, err
+    }
+    results = append(results, otherwise)
+  }
+  for _, result := range results {
+    if result.Type != resultType {
+      return nil, fmt.Errorf("results of %s have different types", c)
+    }
+  }
+  return &CompiledExpr{Type: resultType, eval: func(row Row) (Field, error) {
+    for i, condition := range conditions {
+      f, err := condition.eval(row)
+      if err != nil {
+        return nil, err
+      }
+      if f == BoolField(true) {
+        return results[i].eval(row)
+      }
+    }
+    if c.otherwise == nil {
+      return nil, nil
+    }
+    return results[len(results)-1].eval(row)
+  }}, nil
+}
+
+func (c caseExpr) references() []string {
+  names := make([]string, 0)
+  for _, when := range c.whens {
+    names = append(names, referencesOf(when.Condition, when.Result)...)
+  }
+  return append(names, referencesOf(c.otherwise)...)
+}
+
+func (c caseExpr) withColumns(rename func(string) string) Expr {
+  whens := make([]When, 0, len(c.whens))
+  for _, when := range c.whens {
+    whens = append(whens, When{Condition: when.Condition.withColumns(rename), Result: when.Result.withColumns(rename)})
+  }
+  renamed := caseExpr{whens: whens}
+  if c.otherwise != nil {
+    renamed.otherwise = c.otherwise.withColumns(rename)
+  }
+  return renamed
+}
+
+func (c caseExpr) String() string {
+  var b strings.Builder
+  b.WriteString("CASE")
+  for _, when := range c.whens {
+    fmt.Fprintf(&b, " WHEN %s THEN %s", when.Condition, when.Result)
+  }
+  if c.otherwise != nil {
+    fmt.Fprintf(&b, " ELSE %s", c.otherwise)
+  }
+  b.WriteString(" END")
+  return b.String()
+}
+
+type cast struct {
+  operand Expr
+  to ColumnType
+}
+
+// operand converted to another type. Strings convert to INT and BOOL the way
+// they're written, and fail if they can't; INTs are true if they aren't 0.
+func Cast(operand Expr, to ColumnType) Expr {
+  return cast{operand: operand, to: to}
+}
+
+func (c cast) compile(columns []Column) (*CompiledExpr, error) {
+  if c.to.String() == "unknown" {
+    return nil, fmt.Errorf("can not cast to unknown type %d", c.to)
+  }
+  operands, err := compileOperands(columns, 0, c.operand)
+  if err != nil {
+    return nil, err
+  }
+  return &CompiledExpr{Type: c.to, eval: func(row Row) (Field, error) {
+    fields, err := evalOperands(row, operands)
+    if fields == nil {
+      return nil, err
+    }
+    return castField(fields[0], c.to)
+  }}, nil
+}
+
+func castField(f Field, to ColumnType) (Field, error) {
+  switch v := f.(type) {
+  case IntField:
+    switch to {
+    case STRING:
+      return StringField(strconv.FormatInt(int64(v), 10)), nil
+    case BOOL:
+      return BoolField(v != 0), nil
+    }
+  case StringField:
+    switch to {
+    case INT:
+      i, err := strconv.ParseInt(strings.TrimSpace(string(v)), 10, 64)
+      if err != nil {
+        return nil, fmt.Errorf("can not cast %q to int", string(v))
+      }
+      return IntField(i), nil
+    case BOOL:
+      b, err := strconv.ParseBool(strings.TrimSpace(string(v)))
+      if err != nil {
+        return nil, fmt.Errorf("can not cast %q to bool", string(v))
+      }
+      return BoolField(b), nil
+    }
+  case BoolField:
+    switch to {
+    case INT:
+      if v {
+        return IntField(1), nil
+      }
+      return IntField(0), nil
+    case STRING:
+      return StringField(strconv.FormatBool(bool(v))), nil
+    }
+  }
+  return f, nil
+}
+
+func (c cast) references() []string {
+  return c.operand.references()
+}
+
+func (c cast) withColumns(rename func(string) string) Expr {
+  return cast{operand: c.operand.withColumns(rename), to: c.to}
+}
+
+func (c cast) String() string {
+  return fmt.Sprintf("CAST(%s AS %s)", c.operand, c.to)
+}
@@ -0,0 +1,174 @@
+package sql_planner
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var exprColumns = []Column{
+  {Name: "t.n", ColumnType: INT},
+  {Name: "t.s", ColumnType: STRING},
+  {Name: "t.b", ColumnType: BOOL},
+}
+
+func evalExpr(t *testing.T, e Expr, row Row) Field {
+  compiled, err := Compile(e, exprColumns)
+  require.NoError(t, err)
+  f, err := compiled.Eval(row)
+  require.NoError(t, err)
+  return f
+}
+
+func TestExprEval(t *testing.T) {
+  row := Row{IntField(7), StringField("Hello"), BoolField(true)}
+  n, s, b := ColumnRef("n"), ColumnRef("t.s"), ColumnRef("b")
+  cases := []struct {
+    e Expr
+    expected Field
+  }{
+    {Arithmetic(Plus, n, Literal(IntField(3))), IntField(10)},
+    {Arithmetic(Minus, n, Arithmetic(Times, Literal(IntField(2)), n)), IntField(-7)},
+    {Arithmetic(Divide, n, Literal(IntField(2))), IntField(3)},
+    {Arithmetic(Modulo, n, Literal(IntField(4))), IntField(3)},
+    {Compare(Greater, n, Literal(IntField(3))), BoolField(true)},
+    {Compare(NotEqual, s, Literal(StringField("Hello"))), BoolField(false)},
+    {And(b, Compare(Less, n, Literal(IntField(3)))), BoolField(false)},
+    {Or(Not(b), Compare(Equal, n, Literal(IntField(7)))), BoolField(true)},
+    {In(n, Literal(IntField(1)), Literal(IntField(7))), BoolField(true)},
+    {Lower(s), StringField("hello")},
+    {Upper(s), StringField("HELLO")},
+    {Length(Literal(StringField("héllo"))), IntField(5)},
+    {Substr(s, Literal(IntField(2)), Literal(IntField(3))), StringField("ell")},
+    {Substr(s, Literal(IntField(0)), Literal(IntField(2))), StringField("H")},
+    {Substr(s, Literal(IntField(4)), Literal(IntField(10))), StringField("lo")},
+    {Like(s, Literal(StringField("H%o"))), BoolField(true)},
+    {Like(s, Literal(StringField("_el%"))), BoolField(true)},
+    {Like(s, Literal(StringField("%x%"))), BoolField(false)},
+    {Like(Literal(StringField("50%")), Literal(StringField("50\\%"))), BoolField(true)},
+    {Like(Literal(StringField("500")), Literal(StringField("50\\%"))), BoolField(false)},
+    {Case([]When{
+      {Condition: Compare(Less, n, Literal(IntField(5))), Result: Literal(StringField("small"))},
+      {Condition: Compare(Less, n, Literal(IntField(10))), Result: Literal(StringField("medium"))},
+    }, Literal(StringField("large"))), StringField("medium")},
+    {Case([]When{{Condition: Not(b), Result: n}}, nil), nil},
+    {Cast(n, STRING), StringField("7")},
+    {Cast(Literal(StringField(" 42 ")), INT), IntField(42)},
+    {Cast(Literal(StringField("true")), BOOL), BoolField(true)},
+    {Cast(b, INT), IntField(1)},
+    {Cast(Literal(IntField(0)), BOOL), BoolField(false)},
+  }
+  for _, c := range cases {
+    require.Equal(t, c.expected, evalExpr(t, c.e, row), c.e.String())
+  }
+}
+
+func TestExprNulls(t *testing.T) {
+  row := Row{nil, nil, nil}
+  n, s, b := ColumnRef("n"), ColumnRef("s"), ColumnRef("b")
+  for _, e := range []Expr{
+    Arithmetic(Plus, n, Literal(IntField(1))),
+    Compare(Equal, n, n),
+    Not(b),
+    Upper(s),
+    Like(s, Literal(StringField("%"))),
+    Cast(n, STRING),
+    And(b, Literal(BoolField(true))),
+    Or(b, Literal(BoolField(false))),
+  } {
+    require.Nil(t, evalExpr(t, e, row), e.String())
+  }
+  require.Equal(t, BoolField(false), evalExpr(t, And(b, Literal(BoolField(false))), row))
+  require.Equal(t, BoolField(true), evalExpr(t, Or(b, Literal(BoolField(true))), row))
+  require.Equal(t, BoolField(true), evalExpr(t, IsNull(n), row))
+  require.Equal(t, BoolField(false), evalExpr(t, IsNull(Literal(IntField(1))), row))
+
+  filter, err := CompileFilter(Compare(Equal, n, Literal(IntField(1))), exprColumns)
+  require.NoError(t, err)
+  require.False(t, filter(row))
+  require.True(t, filter(Row{IntField(1), nil, nil}))
+}
+
+func TestExprInvalid(t *testing.T) {
+  n, s := ColumnRef("n"), ColumnRef("s")
+  for _, e := range []Expr{
+    ColumnRef("missing"),
+    Arithmetic(Plus, n, s),
+    Compare(Equal, n, s),
+    And(n),
+    Upper(n),
+    Like(s, n),
+    Case([]When{{Condition: Literal(BoolField(true)), Result: n}}, s),
+    Case(nil, n),
+    Substr(s, n, s),
+  } {
+    _, err := Compile(e, exprColumns)
+    require.Error(t, err, e.String())
+  }
+  _, err := CompileFilter(n, exprColumns)
+  require.Error(t, err)
+
+  compiled, err := Compile(Arithmetic(Divide, n, Literal(IntField(0))), exprColumns)
+  require.NoError(t, err)
+  _, err = compiled.Eval(Row{IntField(1), nil, nil})
+  require.ErrorIs(t, err, ErrDivisionByZero)
+  compiled, err = Compile(Cast(s, INT), exprColumns)
+  require.NoError(t, err)
+  _, err = compiled.Eval(Row{nil, StringField("x"), nil})
+  require.Error(t, err)
+}
+
+func TestQueryWhereSelect(t *testing.T) {
+  db := createQueryDatabase(t)
+  query := Query{
+    Tables: []string{"users", "pets"},
+    Joins: []JoinCondition{{Left: "users.id", Right: "pets.ownerId"}},
+    Where: And(
+      Compare(Less, ColumnRef("users.age"), Literal(IntField(5))),
+      Like(ColumnRef("name"), Literal(StringField("pet1%"))),
+      Compare(NotEqual, Arithmetic(Modulo, ColumnRef("pets.ownerId"), Literal(IntField(2))), ColumnRef("users.age")),
+    ),
+    Select: []SelectColumn{
+      {Expr: ColumnRef("pets.name")},
+      {Expr: Upper(ColumnRef("pets.name")), Name: "upper"},
+      {Expr: Arithmetic(Plus, ColumnRef("age"), Literal(IntField(1)))},
+    },
+  }
+  plan, err := db.Plan(query)
+  require.NoError(t, err)
+  columns := plan.Root.Columns()
+  require.Equal(t, []Column{
+    {Name: "pets.name", ColumnType: STRING},
+    {Name: "upper", ColumnType: STRING},
+    {Name: "(age + 1)", ColumnType: INT},
+  }, columns)
+
+  // pet i belongs to user 7i % 250, whose age is that % 20
+  expected := make([]Row, 0)
+  for i := 0; i < 300; i++ {
+    name := fmt.Sprintf("pet%d", i)
+    owner := (i * 7) % 250
+    if owner < 200 && owner%20 < 5 && strings.HasPrefix(name, "pet1") && owner%2 != owner%20 {
+      expected = append(expected, Row{StringField(name), StringField(strings.ToUpper(name)), IntField(owner%20 + 1)})
+    }
+  }
+  require.NotEmpty(t, expected)
+  rows, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  require.ElementsMatch(t, expected, rows)
+
+  // conditions on one table are checked as it's scanned
+  explained := plan.Explain()
+  require.Contains(t, explained, "users.age < 5")
+  require.Contains(t, explained, "LIKE(name, 'pet1%')")
+  require.Contains(t, explained, "filter (pets.ownerId % 2) <> users.age")
+
+  query.Where = Upper(ColumnRef("name"))
+  _, err = db.Plan(query)
+  require.Error(t, err)
+  query.Where = Compare(Equal, ColumnRef("id"), Literal(IntField(1)))
+  _, err = db.Plan(Query{Tables: []string{"users", "toys"}, Where: query.Where})
+  require.Error(t, err)
+}
@@ -0,0 +1,284 @@
+package sql_planner
+
+import (
+	"bytes"
+	"hash/fnv"
+)
+
+// bytes of build side rows a HashJoin holds in memory if MemoryBudget isn't set
+const DefaultMemoryBudget = 64 << 20
+
+// once the build side doesn't fit in memory, both sides are split into this
+// many partitions on disk, and each pair of partitions is joined on its own
+const spillPartitionCount = 8
+
+// partitions that are still too big are split again, up to this many times.
+// After that they're joined in memory anyway, since rows that all have the
+// same key can't be split.
+const maxSpillDepth = 3
+
+// Equi-join that builds a hash table on one side and probes it with the
+// other. Output rows are the left row followed by the right row, or only the
+// left row for SemiJoin and AntiJoin.
+type HashJoin struct {
+  Type JoinType
+  Left RowSource
+  Right RowSource
+  // positions of the join key in left and right rows
+  LeftKey []int
+  RightKey []int
+  // columns on each side, for checking the key and padding outer joins
+  // with NULLs
+  LeftSchema []Column
+  RightSchema []Column
+  // estimated number of rows on each side, the hash table is built on the
+  // smaller one. If either is unknown (0), it's built on Right.
+  LeftRows int
+  RightRows int
+  // further condition a pair of rows has to meet, may be nil
+  Residual func(left Row, right Row) bool
+  // bytes of build side rows to hold in memory before spilling to TempDir
+  MemoryBudget int64
+  TempDir string
+  BatchSize int
+}
+
+type hashJoinSide struct {
+  src RowSource
+  key []int
+  isLeft bool
+}
+
+type hashEntry struct {
+  row Row
+  matched bool
+}
+
+type hashTable struct {
+  buckets map[string][]*hashEntry
+  // every row in the order it was added, including ones with a NULL key
+  entries []*hashEntry
+  bytes int64
+}
+
+func newHashTable() *hashTable {
+  return &hashTable{buckets: make(map[string][]*hashEntry)}
+}
+
+// encoding of a join key, equal keys have equal encodings
+func encodeKey(key Row) string {
+  var buf bytes.Buffer
+  writeRow(&buf, key)
+  return buf.String()
+}
+
+func (t *hashTable) add(row Row, key Row) {
+  entry := &hashEntry{row: row}
+  t.entries = append(t.entries, entry)
+  t.bytes += estimatedRowBytes(row)
+  if key != nil {
+    encoded := encodeKey(key)
+    t.buckets[encoded] = append(t.buckets[encoded], entry)
+  }
+}
+
+func (j *HashJoin) validate() error {
+  return validateEquiJoin(j.Type, j.LeftKey, j.RightKey, j.LeftSchema, j.RightSchema)
+}
+
+func (j *HashJoin) Run(output chan<- []Row) error {
+  if err := j.validate(); err != nil {
+    return err
+  }
+  build := hashJoinSide{src: j.Right, key: j.RightKey}
+  probe := hashJoinSide{src: j.Left, key: j.LeftKey, isLeft: true}
+  if j.LeftRows > 0 && j.RightRows > 0 && j.LeftRows < j.RightRows {
+    build, probe = probe, build
+  }
+  out := newBatcher(output, j.BatchSize)
+  err := j.join(build, probe, 0, out)
+  out.flush()
+  return err
+}
+
+func (j *HashJoin) memoryBudget() int64 {
+  if j.MemoryBudget <= 0 {
+    return DefaultMemoryBudget
+  }
+  return j.MemoryBudget
+}
+
+func (j *HashJoin) join(build hashJoinSide, probe hashJoinSide, depth int, out *batcher) error {
+  table := newHashTable()
+  var partitions []*hashPartition
+  defer func() {
+    for _, p := range partitions {
+      p.remove()
+    }
+  }()
+  err := drain(build.src, func(batch []Row) error {
+    for _, row := range batch {
+      key := joinKey(row, build.key)
+      if partitions != nil {
+        if err := partitions[j.partitionOf(key, depth)].build.write(row); err != nil {
+          return err
+        }
+        continue
+      }
+      table.add(row, key)
+      if table.bytes > j.memoryBudget() && depth < maxSpillDepth {
+        var err error
+        if partitions, err = j.newPartitions(); err != nil {
+          return err
+        }
+        // move everything so far to disk too
+        for _, entry := range table.entries {
+          p := partitions[j.partitionOf(joinKey(entry.row, build.key), depth)]
+          if err := p.build.write(entry.row); err != nil {
+            return err
+          }
+        }
+        table = nil
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  if partitions == nil {
+    return j.probe(table, build, probe, out)
+  }
+
+  err = drain(probe.src, func(batch []Row) error {
+    for _, row := range batch {
+      p := partitions[j.partitionOf(joinKey(row, probe.key), depth)]
+      if err := p.probe.write(row); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  for _, p := range partitions {
+    if err := p.build.finish(); err != nil {
+      return err
+    }
+    if err := p.probe.finish(); err != nil {
+      return err
+    }
+  }
+  // rows can only match within a partition
+  for _, p := range partitions {
+    err := j.join(
+      hashJoinSide{src: p.build.source(out.size), key: build.key, isLeft: build.isLeft},
+      hashJoinSide{src: p.probe.source(out.size), key: probe.key, isLeft: probe.isLeft},
+      depth+1,
+      out,
+    )
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (j *HashJoin) padded(row Row, isLeft bool) Row {
+  return padRow(row, isLeft, len(j.LeftSchema), len(j.RightSchema))
+}
+
+func (j *HashJoin) probe(table *hashTable, build hashJoinSide, probe hashJoinSide, out *batcher) error {
+  leftOnly := j.Type.leftOnly()
+  err := drain(probe.src, func(batch []Row) error {
+    for _, row := range batch {
+      var candidates []*hashEntry
+      if key := joinKey(row, probe.key); key != nil {
+        candidates = table.buckets[encodeKey(key)]
+      }
+      matched := false
+      for _, entry := range candidates {
+        left, right := row, entry.row
+        if !probe.isLeft {
+          left, right = right, left
+        }
+        if j.Residual != nil && !j.Residual(left, right) {
+          continue
+        }
+        matched = true
+        entry.matched = true
+        if !leftOnly {
+          out.add(joinRows(left, right))
+        }
+      }
+      switch {
+      case leftOnly && probe.isLeft:
+        if matched == (j.Type == SemiJoin) {
+          out.add(row)
+        }
+      case !matched && j.Type.preserves(probe.isLeft):
+        out.add(j.padded(row, probe.isLeft))
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  for _, entry := range table.entries {
+    switch {
+    case leftOnly && build.isLeft:
+      if entry.matched == (j.Type == SemiJoin) {
+        out.add(entry.row)
+      }
+    case !entry.matched && j.Type.preserves(build.isLeft):
+      out.add(j.padded(entry.row, build.isLeft))
+    }
+  }
+  return nil
+}
+
+type hashPartition struct {
+  build *spillFile
+  probe *spillFile
+}
+
+func (p *hashPartition) remove() {
+  if p.build != nil {
+    p.build.remove()
+  }
+  if p.probe != nil {
+    p.probe.remove()
+  }
+}
+
+func (j *HashJoin) newPartitions() ([]*hashPartition, error) {
+  partitions := make([]*hashPartition, 0, spillPartitionCount)
+  for i := 0; i < spillPartitionCount; i++ {
+    p := &hashPartition{}
+    // appended first so it's removed on failure
+    partitions = append(partitions, p)
+    var err error
+    if p.build, err = newSpillFile(j.TempDir); err != nil {
+      return partitions, err
+    }
+    if p.probe, err = newSpillFile(j.TempDir); err != nil {
+      return partitions, err
+    }
+  }
+  return partitions, nil
+}
+
+// rows with a NULL key never match, so they can go anywhere
+func (j *HashJoin) partitionOf(key Row, depth int) int {
+  if key == nil {
+    return 0
+  }
+  // a different hash at every depth, so a partition that's split again
+  // doesn't land in a single partition
+  hash := fnv.New64a()
+  hash.Write([]byte{byte(depth)})
+  hash.Write([]byte(encodeKey(key)))
+  return int(hash.Sum64() % spillPartitionCount)
+}
@@ -0,0 +1,136 @@
+package sql_planner
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rows of (key, id), with some NULL keys
+func randomJoinRows(r *rand.Rand, count int, keys int) []Row {
+  rows := make([]Row, 0, count)
+  for i := 0; i < count; i++ {
+    var key Field
+    if r.Intn(10) > 0 {
+      key = IntField(r.Intn(keys))
+    }
+    rows = append(rows, Row{key, IntField(i)})
+  }
+  return rows
+}
+
+// columns of randomJoinRows
+var joinRowsSchema = []Column{{Name: "key", ColumnType: INT}, {Name: "id", ColumnType: INT}}
+
+// every join type the slow way
+func naiveJoin(joinType JoinType, left []Row, right []Row, residual func(Row, Row) bool) []Row {
+  result := make([]Row, 0)
+  rightMatched := make([]bool, len(right))
+  for _, l := range left {
+    matched := false
+    for r, rightRow := range right {
+      if l[0] == nil || rightRow[0] == nil || !l[0].equals(rightRow[0]) || !residual(l, rightRow) {
+        continue
+      }
+      matched = true
+      rightMatched[r] = true
+      if joinType != SemiJoin && joinType != AntiJoin {
+        result = append(result, joinRows(l, rightRow))
+      }
+    }
+    switch {
+    case joinType == SemiJoin && matched, joinType == AntiJoin && !matched:
+      result = append(result, l)
+    case !matched && (joinType == LeftOuterJoin || joinType == FullOuterJoin):
+      result = append(result, joinRows(l, Row{nil, nil}))
+    }
+  }
+  if joinType == RightOuterJoin || joinType == FullOuterJoin {
+    for r, rightRow := range right {
+      if !rightMatched[r] {
+        result = append(result, joinRows(Row{nil, nil}, rightRow))
+      }
+    }
+  }
+  return result
+}
+
+func TestHashJoin(t *testing.T) {
+  r := rand.New(rand.NewSource(7))
+  left := randomJoinRows(r, 300, 40)
+  right := randomJoinRows(r, 200, 40)
+  // drops about a third of the matches
+  residual := func(l Row, r Row) bool { return (int(l[1].(IntField))+int(r[1].(IntField)))%3 > 0 }
+
+  for _, joinType := range []JoinType{InnerJoin, LeftOuterJoin, RightOuterJoin, FullOuterJoin, SemiJoin, AntiJoin} {
+    expected := naiveJoin(joinType, left, right, residual)
+    // a budget of 1 byte spills every partition down to the last level
+    for _, budget := range []int64{0, 1, 2000} {
+      // building on the left, then on the right
+      for _, leftRows := range []int{1, 0} {
+        dir := t.TempDir()
+        rows, err := collectRows((&HashJoin{
+          Type:         joinType,
+          Left:         rowsSource(left, 16),
+          Right:        rowsSource(right, 16),
+          LeftKey:      []int{0},
+          RightKey:     []int{0},
+          LeftSchema:   joinRowsSchema,
+          RightSchema:  joinRowsSchema,
+          LeftRows:     leftRows,
+          RightRows:    len(right),
+          Residual:     residual,
+          MemoryBudget: budget,
+          TempDir:      dir,
+          BatchSize:    16,
+        }).Run)
+        require.NoError(t, err)
+        require.ElementsMatch(t, expected, rows, "%v join, budget %d", joinType, budget)
+
+        // spill files are cleaned up
+        entries, err := os.ReadDir(dir)
+        require.NoError(t, err)
+        require.Empty(t, entries)
+      }
+    }
+  }
+}
+
+func TestHashJoinTables(t *testing.T) {
+  users, pets := createJoinTables(t)
+  rows, err := collectRows((&HashJoin{
+    Type:        FullOuterJoin,
+    Left:        allRows(users),
+    Right:       allRows(pets),
+    LeftKey:     []int{2},
+    RightKey:    []int{1},
+    LeftSchema:  users.Schema(),
+    RightSchema: pets.Schema(),
+  }).Run)
+  require.NoError(t, err)
+  require.ElementsMatch(t, []Row{
+    joinRows(doodle, pusheen),
+    joinRows(doodle, stormy),
+    joinRows(toto, rex),
+    joinRows(momo, Row{nil, nil, nil}),
+    joinRows(Row{nil, nil, nil, nil}, stray),
+  }, rows)
+}
+
+func TestHashJoinInvalid(t *testing.T) {
+  users, pets := createJoinTables(t)
+  for _, join := range []*HashJoin{
+    {Type: JoinType(42), LeftKey: []int{2}, RightKey: []int{1}},
+    {Type: InnerJoin, LeftKey: []int{2}, RightKey: []int{1, 0}},
+    {Type: InnerJoin, LeftKey: []int{4}, RightKey: []int{1}},
+    // users.email is a string, pets.ownerId an int
+    {Type: InnerJoin, LeftKey: []int{0}, RightKey: []int{1}},
+  } {
+    join.Left, join.Right = allRows(users), allRows(pets)
+    join.LeftSchema, join.RightSchema = users.Schema(), pets.Schema()
+    _, err := collectRows(join.Run)
+    require.Error(t, err)
+  }
+}
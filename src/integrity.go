@@ -0,0 +1,164 @@
+package sql_planner
+
+import (
+	"fmt"
+	"strings"
+)
+
+type IntegrityProblemKind int
+
+const (
+  // a BTree invariant doesn't hold
+  MalformedTree IntegrityProblemKind = iota + 1
+  // an index has a different number of rows from the primary index
+  RowCountMismatch
+  // a row doesn't match the column types of its index
+  SchemaMismatch
+  // a secondary index entry has no matching row in the primary index
+  DanglingIndexEntry
+  // a row in the primary index is missing from a secondary index
+  MissingIndexEntry
+)
+
+func (k IntegrityProblemKind) String() string {
+  switch k {
+  case MalformedTree:
+    return "malformed tree"
+  case RowCountMismatch:
+    return "row count mismatch"
+  case SchemaMismatch:
+    return "schema mismatch"
+  case DanglingIndexEntry:
+    return "dangling index entry"
+  case MissingIndexEntry:
+    return "missing index entry"
+  default:
+    return "unknown"
+  }
+}
+
+type IntegrityProblem struct {
+  Kind IntegrityProblemKind
+  // the index the problem was found in
+  Index *Index
+  // offending row in the order of Index's schema, if the problem is about a row
+  Row Row
+  Detail string
+}
+
+func (p IntegrityProblem) String() string {
+  s := fmt.Sprintf("%s in index %v", p.Kind, p.Index.schema)
+  if p.Row != nil {
+    s += fmt.Sprintf(" at row %v", p.Row)
+  }
+  if p.Detail != "" {
+    s += ": " + p.Detail
+  }
+  return s
+}
+
+type IntegrityReport struct {
+  // number of rows found in each index, including the primary index
+  RowCounts map[*Index]int
+  Problems []IntegrityProblem
+}
+
+func (r *IntegrityReport) OK() bool {
+  return len(r.Problems) == 0
+}
+
+func (r *IntegrityReport) String() string {
+  if r.OK() {
+    return "ok"
+  }
+  lines := make([]string, 0, len(r.Problems))
+  for _, p := range r.Problems {
+    lines = append(lines, p.String())
+  }
+  return strings.Join(lines, "\n")
+}
+
+func (r *IntegrityReport) add(kind IntegrityProblemKind, index *Index, row Row, detail string) {
+  r.Problems = append(r.Problems, IntegrityProblem{
+    Kind: kind,
+    Index: index,
+    Row: row,
+    Detail: detail,
+  })
+}
+
+// Checks that the primary index and every secondary index are well formed and
+// agree with each other, collecting every problem found. The table is read
+// index by index, so writes running at the same time can show up as problems.
+func (t *Table) CheckIntegrity() *IntegrityReport {
+  indices := t.Indices()
+  report := &IntegrityReport{RowCounts: make(map[*Index]int, len(indices)+1)}
+
+  for _, index := range append([]*Index{t.primaryIndex}, indices...) {
+    if err := index.tree().CheckWellFormed(); err != nil {
+      report.add(MalformedTree, index, nil, err.Error())
+    }
+  }
+
+  // the primary index has every column of the table, so this also checks rows
+  // against the table schema
+  primaryRows := t.checkIndexRows(t.primaryIndex, report)
+
+  for _, index := range indices {
+    indexRows := t.checkIndexRows(index, report)
+    // rows of the primary index that belong in this one
+    members := primaryRows
+    if index.partial() {
+      members = make([]Row, 0, len(primaryRows))
+      for _, primaryRow := range primaryRows {
+        if rowMatchSchema(primaryRow, t.primaryIndex.schema) != nil {
+          continue
+        }
+        if _, belongs := index.entry(primaryRow, t.primaryIndex.schema); belongs {
+          members = append(members, primaryRow)
+        }
+      }
+    }
+    if len(indexRows) != len(members) {
+      report.add(RowCountMismatch, index, nil, fmt.Sprintf(
+        "%d rows, primary index has %d", len(indexRows), len(members),
+      ))
+    }
+    for _, row := range indexRows {
+      if rowMatchSchema(row, index.schema) != nil {
+        // already reported, and comparing it with other rows could panic
+        continue
+      }
+      primaryRow := t.searchPrimaryIndex(reorderRowBySchema(row, index.schema, t.primaryIndex.schema))
+      if primaryRow == nil {
+        report.add(DanglingIndexEntry, index, row, "")
+      } else if entry, belongs := index.entry(primaryRow, t.primaryIndex.schema); !belongs {
+        report.add(DanglingIndexEntry, index, row, "row does not meet the index condition")
+      } else if !entry.equals(row) {
+        report.add(DanglingIndexEntry, index, row, fmt.Sprintf("primary row is %v", primaryRow))
+      }
+    }
+    for _, primaryRow := range members {
+      row, _ := index.entry(primaryRow, t.primaryIndex.schema)
+      if len(row) < len(index.schema) || rowMatchSchema(row, index.schema) != nil {
+        continue
+      }
+      if _, found := index.tree().find(row); !found {
+        report.add(MissingIndexEntry, index, row, "")
+      }
+    }
+  }
+  return report
+}
+
+// every row of index, checked against the index's schema
+func (t *Table) checkIndexRows(index *Index, report *IntegrityReport) []Row {
+  rows := index.rows()
+  for _, row := range rows {
+    if err := rowMatchSchema(row, index.schema); err != nil {
+      report.add(SchemaMismatch, index, row, err.Error())
+    }
+  }
+  report.RowCounts[index] = len(rows)
+  return rows
+}
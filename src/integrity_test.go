@@ -0,0 +1,51 @@
+package sql_planner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 40)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+  require.Equal(t, 40, report.RowCounts[table.primaryIndex])
+  require.Equal(t, 40, report.RowCounts[table.indices[0]])
+
+  // a row only in the secondary index
+  dangling := Row{StringField("ghost@sheen.com"), IntField(1000), BoolField(true)}
+  table.indices[0].btree = table.indices[0].btree.Insert(dangling)
+  // a row only in the primary index
+  missing := Row{IntField(2000), BoolField(false), StringField("toto@sheen.com"), IntField(5)}
+  table.primaryIndex.btree = table.primaryIndex.btree.Insert(missing)
+  // a row with a string where age should be
+  wrongType := Row{IntField(3000), BoolField(false), StringField("toto@sheen.com"), StringField("5")}
+  table.primaryIndex.btree = table.primaryIndex.btree.Insert(wrongType)
+
+  report = table.CheckIntegrity()
+  require.False(t, report.OK())
+  require.Equal(t, 42, report.RowCounts[table.primaryIndex])
+  require.Equal(t, 41, report.RowCounts[table.indices[0]])
+  require.ElementsMatch(t, []IntegrityProblem{
+    {Kind: SchemaMismatch, Index: table.primaryIndex, Row: wrongType, Detail: "row and table schema type mismatch"},
+    {Kind: RowCountMismatch, Index: table.indices[0], Detail: "41 rows, primary index has 42"},
+    {Kind: DanglingIndexEntry, Index: table.indices[0], Row: dangling},
+    {Kind: MissingIndexEntry, Index: table.indices[0], Row: Row{StringField("toto@sheen.com"), IntField(2000), BoolField(false)}},
+    {Kind: MissingIndexEntry, Index: table.indices[0], Row: Row{StringField("toto@sheen.com"), IntField(3000), BoolField(false)}},
+  }, report.Problems)
+}
+
+func TestCheckIntegrityMalformedTree(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 7)
+  // all seven rows crammed into a single leaf
+  table.primaryIndex.btree = &BTree{keys: allKeys(table.primaryIndex.btree)}
+
+  report := table.CheckIntegrity()
+  require.Len(t, report.Problems, 1, report.String())
+  require.Equal(t, MalformedTree, report.Problems[0].Kind)
+  require.Equal(t, table.primaryIndex, report.Problems[0].Index)
+  require.Equal(t, 7, report.RowCounts[table.primaryIndex])
+}
@@ -0,0 +1,244 @@
+package sql_planner
+
+import (
+	"errors"
+)
+
+type JoinType int
+
+const (
+  InnerJoin JoinType = iota + 1
+  // outer rows without a match are kept, padded with NULLs
+  LeftOuterJoin
+  RightOuterJoin
+  FullOuterJoin
+  // left rows with at least one match, without the right side
+  SemiJoin
+  // left rows without any match
+  AntiJoin
+)
+
+func (j JoinType) String() string {
+  switch j {
+  case InnerJoin:
+    return "inner"
+  case LeftOuterJoin:
+    return "left outer"
+  case RightOuterJoin:
+    return "right outer"
+  case FullOuterJoin:
+    return "full outer"
+  case SemiJoin:
+    return "semi"
+  case AntiJoin:
+    return "anti"
+  default:
+    return "unknown"
+  }
+}
+
+// Joins every row from Outer with the matching rows of Inner. Output rows are
+// the outer row followed by the inner row in the order of Inner's schema.
+type NestedLoopJoin struct {
+  Type JoinType
+  Outer RowSource
+  // columns of outer rows
+  OuterSchema []Column
+  Inner *Table
+  // positions of the join key in outer rows, and of the matching columns in
+  // the inner table's schema. Rows match if all of them are equal.
+  OuterKey []int
+  InnerKey []int
+  // If set, inner rows are looked up with the outer row's key as a prefix of
+  // this index, whose leading columns must be InnerKey's in order. Otherwise
+  // the inner table is scanned once per batch of outer rows.
+  InnerIndex *Index
+  // further condition a pair of rows has to meet, may be nil
+  Residual func(outer Row, inner Row) bool
+  BatchSize int
+}
+
+func (j *NestedLoopJoin) validate() error {
+  if j.Type != InnerJoin && j.Type != LeftOuterJoin {
+    return errors.New("unsupported join type")
+  }
+  innerSchema := j.Inner.Schema()
+  if err := validateJoinKey(j.OuterKey, j.InnerKey, j.OuterSchema, innerSchema); err != nil {
+    return err
+  }
+  if j.InnerIndex == nil {
+    return nil
+  }
+  indices := append(j.Inner.Indices(), j.Inner.primaryIndex)
+  belongs := false
+  for _, index := range indices {
+    belongs = belongs || index == j.InnerIndex
+  }
+  if !belongs {
+    return errors.New("index does not belong to inner table")
+  }
+  if j.InnerIndex.partial() {
+    return errors.New("can not look up rows in a partial index")
+  }
+  indexSchema := j.InnerIndex.Schema()
+  if len(j.InnerKey) == 0 || len(j.InnerKey) > len(indexSchema) {
+    return errors.New("join key does not match index")
+  }
+  for i, position := range j.InnerKey {
+    if indexSchema[i] != innerSchema[position] {
+      return errors.New("join key does not match index")
+    }
+  }
+  return nil
+}
+
+// whether unmatched rows of the left or right side are kept by an outer join
+func (j JoinType) preserves(isLeft bool) bool {
+  if isLeft {
+    return j == LeftOuterJoin || j == FullOuterJoin
+  }
+  return j == RightOuterJoin || j == FullOuterJoin
+}
+
+// semi and anti joins only output left rows
+func (j JoinType) leftOnly() bool {
+  return j == SemiJoin || j == AntiJoin
+}
+
+// row of one side of a join, padded with NULLs for the other side
+func padRow(row Row, isLeft bool, leftWidth int, rightWidth int) Row {
+  if isLeft {
+    return joinRows(row, make(Row, rightWidth))
+  }
+  return joinRows(make(Row, leftWidth), row)
+}
+
+// checks the parts that equi-joins of two RowSources have in common
+func validateEquiJoin(joinType JoinType, leftKey []int, rightKey []int, leftSchema []Column, rightSchema []Column) error {
+  switch joinType {
+  case InnerJoin, LeftOuterJoin, RightOuterJoin, FullOuterJoin, SemiJoin, AntiJoin:
+  default:
+    return errors.New("unsupported join type")
+  }
+  return validateJoinKey(leftKey, rightKey, leftSchema, rightSchema)
+}
+
+// checks that the key columns exist on both sides, pairwise of the same type,
+// since fields of different types never compare equal
+func validateJoinKey(leftKey []int, rightKey []int, leftSchema []Column, rightSchema []Column) error {
+  if len(leftKey) != len(rightKey) {
+    return errors.New("join key lengths differ")
+  }
+  for i := range leftKey {
+    if leftKey[i] < 0 || leftKey[i] >= len(leftSchema) || rightKey[i] < 0 || rightKey[i] >= len(rightSchema) {
+      return errors.New("join key column out of range")
+    }
+    if leftSchema[leftKey[i]].ColumnType != rightSchema[rightKey[i]].ColumnType {
+      return errors.New("join key column types differ")
+    }
+  }
+  return nil
+}
+
+// fields of row at positions, or nil if one of them is NULL, since NULL
+// doesn't equal anything
+func joinKey(row Row, positions []int) Row {
+  key := make(Row, len(positions))
+  for i, position := range positions {
+    if row[position] == nil {
+      return nil
+    }
+    key[i] = row[position]
+  }
+  return key
+}
+
+func joinRows(outer Row, inner Row) Row {
+  joined := make(Row, 0, len(outer)+len(inner))
+  return append(append(joined, outer...), inner...)
+}
+
+func (j *NestedLoopJoin) matches(outer Row, outerKey Row, inner Row) bool {
+  innerKey := joinKey(inner, j.InnerKey)
+  if outerKey == nil || innerKey == nil || !outerKey.equals(innerKey) {
+    return false
+  }
+  return j.Residual == nil || j.Residual(outer, inner)
+}
+
+func (j *NestedLoopJoin) Run(output chan<- []Row) error {
+  if err := j.validate(); err != nil {
+    return err
+  }
+  out := newBatcher(output, j.BatchSize)
+  nulls := make(Row, len(j.Inner.Schema()))
+  err := drain(j.Outer, func(outerBatch []Row) error {
+    matched := make([]bool, len(outerBatch))
+    var err error
+    if j.InnerIndex != nil {
+      err = j.lookupBatch(outerBatch, matched, out)
+    } else {
+      err = j.scanBatch(outerBatch, matched, out)
+    }
+    if j.Type == LeftOuterJoin {
+      for i, outer := range outerBatch {
+        if !matched[i] {
+          out.add(joinRows(outer, nulls))
+        }
+      }
+    }
+    return err
+  })
+  out.flush()
+  return err
+}
+
+// one index lookup per outer row
+func (j *NestedLoopJoin) lookupBatch(outerBatch []Row, matched []bool, out *batcher) error {
+  for i, outer := range outerBatch {
+    key := joinKey(outer, j.OuterKey)
+    if key == nil {
+      continue
+    }
+    err := drain(j.Inner.Scan(j.InnerIndex, QueryPredicate{
+      LowerBound: InclusiveBound(key),
+      UpperBound: ExclusiveBound(key),
+      Limit:      NoLimit,
+    }, out.size), func(innerBatch []Row) error {
+      for _, inner := range innerBatch {
+        if j.Residual == nil || j.Residual(outer, inner) {
+          matched[i] = true
+          out.add(joinRows(outer, inner))
+        }
+      }
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// one scan of the inner table for the whole batch of outer rows
+func (j *NestedLoopJoin) scanBatch(outerBatch []Row, matched []bool, out *batcher) error {
+  outerKeys := make([]Row, len(outerBatch))
+  for i, outer := range outerBatch {
+    outerKeys[i] = joinKey(outer, j.OuterKey)
+  }
+  return drain(j.Inner.Scan(j.Inner.primaryIndex, QueryPredicate{
+    LowerBound: NegativeInfinity{},
+    UpperBound: Infinity{},
+    Limit:      NoLimit,
+  }, out.size), func(innerBatch []Row) error {
+    for i, outer := range outerBatch {
+      for _, inner := range innerBatch {
+        if j.matches(outer, outerKeys[i], inner) {
+          matched[i] = true
+          out.add(joinRows(outer, inner))
+        }
+      }
+    }
+    return nil
+  })
+}
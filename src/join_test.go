@@ -0,0 +1,123 @@
+package sql_planner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+  doodle = Row{StringField("doodle@sheen.com"), IntField(3), IntField(1), BoolField(true)}
+  toto = Row{StringField("toto@sheen.com"), IntField(21), IntField(2), BoolField(true)}
+  momo = Row{StringField("momo@sheen.com"), IntField(5), IntField(3), BoolField(false)}
+  pusheen = Row{StringField("pusheen"), IntField(1), StringField("cat")}
+  stormy = Row{StringField("stormy"), IntField(1), StringField("cat")}
+  rex = Row{StringField("rex"), IntField(2), StringField("dog")}
+  stray = Row{StringField("stray"), IntField(9), StringField("cat")}
+)
+
+// users joined with pets on users.id = pets.ownerId
+func createJoinTables(t *testing.T) (*Table, *Table) {
+  users := createTable(t)
+  require.NoError(t, users.BatchInsert([]Row{doodle, toto, momo}))
+  pets, err := CreateTable(
+    []Column{
+      {Name: "name", ColumnType: STRING},
+      {Name: "ownerId", ColumnType: INT},
+      {Name: "species", ColumnType: STRING},
+    },
+    []string{"name"},
+    []string{"ownerId"},
+  )
+  require.NoError(t, err)
+  require.NoError(t, pets.BatchInsert([]Row{pusheen, stormy, rex, stray}))
+  return users, pets
+}
+
+func allRows(table *Table) RowSource {
+  return table.Scan(table.primaryIndex, QueryPredicate{
+    LowerBound: NegativeInfinity{},
+    UpperBound: Infinity{},
+    Limit:      NoLimit,
+  }, 2)
+}
+
+func TestNestedLoopJoin(t *testing.T) {
+  users, pets := createJoinTables(t)
+  for _, index := range []*Index{nil, pets.indices[0]} {
+    rows, err := collectRows((&NestedLoopJoin{
+      Type:        InnerJoin,
+      Outer:       allRows(users),
+      OuterSchema: users.Schema(),
+      Inner:       pets,
+      OuterKey:    []int{2},
+      InnerKey:    []int{1},
+      InnerIndex:  index,
+      BatchSize:   2,
+    }).Run)
+    require.NoError(t, err)
+    require.ElementsMatch(t, []Row{
+      joinRows(doodle, pusheen),
+      joinRows(doodle, stormy),
+      joinRows(toto, rex),
+    }, rows)
+  }
+}
+
+func TestLeftOuterJoin(t *testing.T) {
+  users, pets := createJoinTables(t)
+  onlyCats := func(outer Row, inner Row) bool {
+    return inner[2].equals(StringField("cat"))
+  }
+  for _, index := range []*Index{nil, pets.indices[0]} {
+    rows, err := collectRows((&NestedLoopJoin{
+      Type:        LeftOuterJoin,
+      Outer:       allRows(users),
+      OuterSchema: users.Schema(),
+      Inner:       pets,
+      OuterKey:    []int{2},
+      InnerKey:    []int{1},
+      InnerIndex:  index,
+      Residual:    onlyCats,
+    }).Run)
+    require.NoError(t, err)
+    require.ElementsMatch(t, []Row{
+      joinRows(doodle, pusheen),
+      joinRows(doodle, stormy),
+      joinRows(toto, Row{nil, nil, nil}),
+      joinRows(momo, Row{nil, nil, nil}),
+    }, rows)
+  }
+
+  // NULL keys never match
+  rows, err := collectRows((&NestedLoopJoin{
+    Type:        LeftOuterJoin,
+    Outer:       rowsSource([]Row{{nil}}, 1),
+    OuterSchema: []Column{{Name: "ownerId", ColumnType: INT}},
+    Inner:       pets,
+    OuterKey:    []int{0},
+    InnerKey:    []int{1},
+  }).Run)
+  require.NoError(t, err)
+  require.Equal(t, []Row{{nil, nil, nil, nil}}, rows)
+}
+
+func TestNestedLoopJoinInvalid(t *testing.T) {
+  users, pets := createJoinTables(t)
+  for _, join := range []*NestedLoopJoin{
+    {Type: InnerJoin, Outer: allRows(users), Inner: pets, OuterKey: []int{2}},
+    {Type: InnerJoin, Outer: allRows(users), Inner: pets, OuterKey: []int{2}, InnerKey: []int{5}},
+    {Type: JoinType(42), Outer: allRows(users), Inner: pets, OuterKey: []int{2}, InnerKey: []int{1}},
+    // index leads with ownerId, not species
+    {Type: InnerJoin, Outer: allRows(users), Inner: pets, OuterKey: []int{2}, InnerKey: []int{2}, InnerIndex: pets.indices[0]},
+    {Type: InnerJoin, Outer: allRows(users), Inner: pets, OuterKey: []int{2}, InnerKey: []int{1}, InnerIndex: users.indices[0]},
+    // outer rows only have 4 columns
+    {Type: InnerJoin, Outer: allRows(users), Inner: pets, OuterKey: []int{4}, InnerKey: []int{1}},
+    // users.email is a string, pets.ownerId an int
+    {Type: InnerJoin, Outer: allRows(users), Inner: pets, OuterKey: []int{0}, InnerKey: []int{1}},
+  } {
+    join.OuterSchema = users.Schema()
+    _, err := collectRows(join.Run)
+    require.Error(t, err)
+  }
+}
@@ -0,0 +1,168 @@
+package sql_planner
+
+import (
+	"errors"
+)
+
+var errUnsortedMergeInput = errors.New("merge join input is not sorted on the join key")
+
+// Equi-join of two inputs that are both sorted ascending on their join key,
+// such as index scans whose leading columns are the key. Both are read once,
+// side by side, holding only the right rows of one key in memory. Output rows
+// are the left row followed by the right row, or only the left row for
+// SemiJoin and AntiJoin, in the order of the left input.
+type MergeJoin struct {
+  Type JoinType
+  Left RowSource
+  Right RowSource
+  // positions of the join key in left and right rows
+  LeftKey []int
+  RightKey []int
+  // columns on each side, for checking the key and padding outer joins
+  // with NULLs
+  LeftSchema []Column
+  RightSchema []Column
+  // further condition a pair of rows has to meet, may be nil
+  Residual func(left Row, right Row) bool
+  BatchSize int
+}
+
+func (j *MergeJoin) validate() error {
+  return validateEquiJoin(j.Type, j.LeftKey, j.RightKey, j.LeftSchema, j.RightSchema)
+}
+
+func (j *MergeJoin) Run(output chan<- []Row) error {
+  if err := j.validate(); err != nil {
+    return err
+  }
+  left, right := newRowCursor(j.Left), newRowCursor(j.Right)
+  out := newBatcher(output, j.BatchSize)
+  err := j.merge(left, right, out)
+  out.flush()
+  leftErr, rightErr := left.close(), right.close()
+  if err == nil {
+    err = leftErr
+  }
+  if err == nil {
+    err = rightErr
+  }
+  return err
+}
+
+// side of the join being merged
+type mergeInput struct {
+  cursor *rowCursor
+  key []int
+  isLeft bool
+  // last key read, to check the input is sorted
+  last Row
+}
+
+// the next row and its key. Rows with a NULL key can't match anything, so
+// they're handed to unmatched and skipped, wherever the input sorted them.
+func (j *MergeJoin) next(input *mergeInput, out *batcher) (Row, Row, bool) {
+  for {
+    row, ok := input.cursor.peek()
+    if !ok {
+      return nil, nil, false
+    }
+    key := joinKey(row, input.key)
+    if key != nil {
+      return row, key, true
+    }
+    j.unmatched(row, input.isLeft, out)
+    input.cursor.advance()
+  }
+}
+
+// consumes the row at the cursor, whose key is key
+func (input *mergeInput) advance(key Row) error {
+  if input.last != nil && key.lessThan(input.last) {
+    return errUnsortedMergeInput
+  }
+  input.last = key
+  input.cursor.advance()
+  return nil
+}
+
+func (j *MergeJoin) unmatched(row Row, isLeft bool, out *batcher) {
+  switch {
+  case j.Type == AntiJoin && isLeft:
+    out.add(row)
+  case j.Type.preserves(isLeft):
+    out.add(padRow(row, isLeft, len(j.LeftSchema), len(j.RightSchema)))
+  }
+}
+
+func (j *MergeJoin) merge(leftCursor *rowCursor, rightCursor *rowCursor, out *batcher) error {
+  left := &mergeInput{cursor: leftCursor, key: j.LeftKey, isLeft: true}
+  right := &mergeInput{cursor: rightCursor, key: j.RightKey}
+  for {
+    leftRow, leftKey, leftOK := j.next(left, out)
+    rightRow, rightKey, rightOK := j.next(right, out)
+    switch {
+    case !leftOK && !rightOK:
+      return nil
+    case !rightOK || (leftOK && leftKey.lessThan(rightKey)):
+      j.unmatched(leftRow, true, out)
+      if err := left.advance(leftKey); err != nil {
+        return err
+      }
+    case !leftOK || rightKey.lessThan(leftKey):
+      j.unmatched(rightRow, false, out)
+      if err := right.advance(rightKey); err != nil {
+        return err
+      }
+    default:
+      if err := j.mergeGroup(left, right, leftKey, out); err != nil {
+        return err
+      }
+    }
+  }
+}
+
+// joins the left and right rows whose key is key
+func (j *MergeJoin) mergeGroup(left *mergeInput, right *mergeInput, key Row, out *batcher) error {
+  group := make([]*hashEntry, 0)
+  for {
+    row, rowKey, ok := j.next(right, out)
+    if !ok || !rowKey.equals(key) {
+      break
+    }
+    group = append(group, &hashEntry{row: row})
+    if err := right.advance(rowKey); err != nil {
+      return err
+    }
+  }
+  for {
+    row, rowKey, ok := j.next(left, out)
+    if !ok || !rowKey.equals(key) {
+      break
+    }
+    matched := false
+    for _, entry := range group {
+      if j.Residual != nil && !j.Residual(row, entry.row) {
+        continue
+      }
+      matched = true
+      entry.matched = true
+      if !j.Type.leftOnly() {
+        out.add(joinRows(row, entry.row))
+      }
+    }
+    if matched && j.Type == SemiJoin {
+      out.add(row)
+    } else if !matched {
+      j.unmatched(row, true, out)
+    }
+    if err := left.advance(rowKey); err != nil {
+      return err
+    }
+  }
+  for _, entry := range group {
+    if !entry.matched {
+      j.unmatched(entry.row, false, out)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,100 @@
+package sql_planner
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sorted on the key in the first column, NULLs first
+func sortedJoinRows(rows []Row) []Row {
+  sorted := append([]Row{}, rows...)
+  sort.SliceStable(sorted, func(i, j int) bool {
+    if sorted[i][0] == nil || sorted[j][0] == nil {
+      return sorted[i][0] == nil && sorted[j][0] != nil
+    }
+    return sorted[i][0].lessThan(sorted[j][0])
+  })
+  return sorted
+}
+
+func TestMergeJoin(t *testing.T) {
+  r := rand.New(rand.NewSource(11))
+  // few keys, so both sides have groups of duplicates
+  left := sortedJoinRows(randomJoinRows(r, 200, 30))
+  right := sortedJoinRows(randomJoinRows(r, 150, 30))
+  residual := func(l Row, r Row) bool { return (int(l[1].(IntField))+int(r[1].(IntField)))%3 > 0 }
+
+  for _, joinType := range []JoinType{InnerJoin, LeftOuterJoin, RightOuterJoin, FullOuterJoin, SemiJoin, AntiJoin} {
+    for _, batchSize := range []int{1, 7} {
+      rows, err := collectRows((&MergeJoin{
+        Type:        joinType,
+        Left:        rowsSource(left, batchSize),
+        Right:       rowsSource(right, batchSize),
+        LeftKey:     []int{0},
+        RightKey:    []int{0},
+        LeftSchema:  joinRowsSchema,
+        RightSchema: joinRowsSchema,
+        Residual:    residual,
+        BatchSize:   batchSize,
+      }).Run)
+      require.NoError(t, err)
+      require.ElementsMatch(t, naiveJoin(joinType, left, right, residual), rows, "%v join", joinType)
+    }
+  }
+}
+
+func TestMergeJoinKeepsLeftOrder(t *testing.T) {
+  users, pets := createJoinTables(t)
+  rows, err := collectRows((&MergeJoin{
+    Type:        LeftOuterJoin,
+    // ordered by users.id and pets.ownerId
+    Left:        allRows(users),
+    Right:       IndexScan(pets, pets.indices[0]).Run,
+    LeftKey:     []int{2},
+    RightKey:    []int{1},
+    LeftSchema:  users.Schema(),
+    RightSchema: pets.Schema(),
+  }).Run)
+  require.NoError(t, err)
+  require.Equal(t, []Row{
+    joinRows(doodle, pusheen),
+    joinRows(doodle, stormy),
+    joinRows(toto, rex),
+    joinRows(momo, Row{nil, nil, nil}),
+  }, rows)
+}
+
+func TestMergeJoinUnsorted(t *testing.T) {
+  left := []Row{{IntField(1)}, {IntField(3)}, {IntField(2)}}
+  right := []Row{{IntField(1)}, {IntField(2)}}
+  _, err := collectRows((&MergeJoin{
+    Type:        InnerJoin,
+    Left:        rowsSource(left, 1),
+    Right:       rowsSource(right, 1),
+    LeftKey:     []int{0},
+    RightKey:    []int{0},
+    LeftSchema:  joinRowsSchema[:1],
+    RightSchema: joinRowsSchema[:1],
+  }).Run)
+  require.ErrorIs(t, err, errUnsortedMergeInput)
+}
+
+func TestMergeJoinInvalid(t *testing.T) {
+  users, pets := createJoinTables(t)
+  // out of range, and a string key joined with an int one
+  for _, leftKey := range []int{4, 0} {
+    _, err := collectRows((&MergeJoin{
+      Type:        InnerJoin,
+      Left:        allRows(users),
+      Right:       allRows(pets),
+      LeftKey:     []int{leftKey},
+      RightKey:    []int{1},
+      LeftSchema:  users.Schema(),
+      RightSchema: pets.Schema(),
+    }).Run)
+    require.Error(t, err)
+  }
+}
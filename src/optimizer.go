@@ -0,0 +1,1150 @@
+package sql_planner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+type CompareOp int
+
+const (
+  Equal CompareOp = iota + 1
+  Less
+  LessOrEqual
+  Greater
+  GreaterOrEqual
+  NotEqual
+)
+
+func (o CompareOp) String() string {
+  switch o {
+  case Equal:
+    return "="
+  case Less:
+    return "<"
+  case LessOrEqual:
+    return "<="
+  case Greater:
+    return ">"
+  case GreaterOrEqual:
+    return ">="
+  case NotEqual:
+    return "<>"
+  default:
+    return "?"
+  }
+}
+
+// the operator that holds for value op f when o holds for f op value
+func (o CompareOp) flipped() CompareOp {
+  switch o {
+  case Less:
+    return Greater
+  case LessOrEqual:
+    return GreaterOrEqual
+  case Greater:
+    return Less
+  case GreaterOrEqual:
+    return LessOrEqual
+  default:
+    return o
+  }
+}
+
+// whether f compared to value holds, which it never does for NULL
+func (o CompareOp) holds(f Field, value Field) bool {
+  if f == nil {
+    return false
+  }
+  switch o {
+  case Equal:
+    return f.equals(value)
+  case Less:
+    return f.lessThan(value)
+  case LessOrEqual:
+    return !value.lessThan(f)
+  case Greater:
+    return value.lessThan(f)
+  case GreaterOrEqual:
+    return !f.lessThan(value)
+  case NotEqual:
+    return !f.equals(value)
+  default:
+    return false
+  }
+}
+
+// Keeps rows whose Column compares to Value with Op.
+type ColumnFilter struct {
+  // "table.column"
+  Column string
+  Op CompareOp
+  Value Field
+}
+
+func (f ColumnFilter) String() string {
+  return fmt.Sprintf("%s %s %v", f.Column, f.Op, f.Value)
+}
+
+// whether every value that passes f also passes other, a filter on the same
+// column
+func (f ColumnFilter) implies(other ColumnFilter) bool {
+  v, w := f.Value, other.Value
+  if v.columnType() != w.columnType() {
+    return false
+  }
+  if f.Op == Equal {
+    return other.Op.holds(v, w)
+  }
+  switch other.Op {
+  case NotEqual:
+    switch f.Op {
+    case NotEqual:
+      return v.equals(w)
+    case Less:
+      return !w.lessThan(v)
+    case LessOrEqual:
+      return v.lessThan(w)
+    case Greater:
+      return !v.lessThan(w)
+    case GreaterOrEqual:
+      return w.lessThan(v)
+    }
+  case Less:
+    switch f.Op {
+    case Less:
+      return !w.lessThan(v)
+    case LessOrEqual:
+      return v.lessThan(w)
+    }
+  case LessOrEqual:
+    if f.Op == Less || f.Op == LessOrEqual {
+      return !w.lessThan(v)
+    }
+  case Greater:
+    switch f.Op {
+    case Greater:
+      return !v.lessThan(w)
+    case GreaterOrEqual:
+      return w.lessThan(v)
+    }
+  case GreaterOrEqual:
+    if f.Op == Greater || f.Op == GreaterOrEqual {
+      return !v.lessThan(w)
+    }
+  }
+  return false
+}
+
+// Left = Right, for columns "table.column" of two different tables
+type JoinCondition struct {
+  Left string
+  Right string
+}
+
+// Inner join of the named tables on every condition in Joins, keeping the
+// rows that pass every filter. The planned rows have the columns of every
+// table, in the order the optimizer joined them; look them up by name in
+// Plan.Columns.
+//
+// With GroupBy or Aggregates, the joined rows are then grouped and aggregated
+// instead, see PlanAggregate. With Select, the rows that come out are the
+// selected expressions instead.
+type Query struct {
+  Tables []string
+  Joins []JoinCondition
+  Filters []ColumnFilter
+  // Condition on the joined rows, may be nil. Parts of it ANDed together
+  // that only read one table are checked as that table is scanned.
+  Where Expr
+  // "table.column"
+  GroupBy []string
+  Aggregates []AggregateColumn
+  // condition on aggregated rows, may be nil
+  Having func(Row) bool
+  // columns of the joined or aggregated rows
+  OrderBy []OrderColumn
+  // at most this many rows are returned, if it's more than 0
+  Limit int
+  // the first this many rows are skipped, before Limit
+  Offset int
+  // expressions over the rows that would otherwise come out, in their place
+  Select []SelectColumn
+}
+
+// Chosen plan for a query, along with the other plans the optimizer costed for
+// the whole query.
+type QueryPlan struct {
+  Root Plan
+  // cheapest first, at most maxAlternatives of them
+  Alternatives []Plan
+}
+
+func (p *QueryPlan) Run(output chan<- []Row) error {
+  return p.Root.Run(output)
+}
+
+// queries of more tables than this are joined greedily, one table at a time,
+// instead of by trying every order
+const maxDynamicProgrammingTables = 10
+
+const maxAlternatives = 10
+
+// Costs are in units of reading one row from an index.
+const (
+  // producing an output row
+  outputCost = 0.1
+  // adding a row to a hash table, and looking one up in it
+  hashBuildCost = 2.0
+  hashProbeCost = 1.0
+  // comparing a row against the other side of a merge join
+  mergeRowCost = 0.5
+  // adding a row to the current group of a stream aggregate
+  aggregateRowCost = 0.5
+  // comparing two rows while sorting
+  sortCompareCost = 0.2
+  // writing a row to a spill file and reading it back
+  spillCost = 4.0
+  // rough size of a column in memory, for memory budgets
+  columnBytes = 24
+)
+
+// Selectivity guesses for when there are no statistics.
+const (
+  defaultRangeSelectivity = 1.0 / 3
+  // rows per distinct value of a column that isn't unique
+  defaultDuplicates = 10.0
+)
+
+// descending a tree of rows rows
+func seekCost(rows float64) float64 {
+  return math.Log2(rows + 2)
+}
+
+type queryJoin struct {
+  // positions in optimizer.tables
+  left int
+  right int
+  // qualified, and not
+  leftColumn string
+  rightColumn string
+  leftName string
+  rightName string
+}
+
+type optimizer struct {
+  tables []*Table
+  // of each table, nil for tables that were never analyzed
+  stats []*TableStats
+  // filters of each table, with column names not qualified
+  filters [][]ColumnFilter
+  // parts of the WHERE condition that only read one table, for each table,
+  // and compiled against its qualified columns
+  conditions [][]Expr
+  conditionFilters [][]func(Row) bool
+  // conditions of each table that compare an expression over its columns to
+  // a value, with the expression's text as the column, for expression indices
+  keyFilters [][]ColumnFilter
+  // conditions of each table that compare one of its columns to values
+  ranges [][]columnRanges
+  // parts of the WHERE condition that read several tables, or none
+  residual []Expr
+  // columns of each table the query reads, nil if it reads all of them
+  columns [][]string
+  joins []queryJoin
+  // whether every table can be reached from every other one through joins.
+  // If it can, plans with cross products aren't considered.
+  connected bool
+  // ways to read each table, one per index
+  scans [][]Plan
+}
+
+// "table.column" of one of tables, as positions in tables and the column name
+func splitColumn(tables []*Table, name string) (int, string, error) {
+  dot := strings.Index(name, ".")
+  if dot < 0 {
+    return -1, "", fmt.Errorf("column %s is not qualified with a table", name)
+  }
+  for i, table := range tables {
+    if table.Name() == name[:dot] {
+      column := name[dot+1:]
+      if columnPosition(table.Schema(), column) < 0 {
+        return -1, "", fmt.Errorf("column %s not found", name)
+      }
+      return i, column, nil
+    }
+  }
+  return -1, "", fmt.Errorf("%w: %s", ErrTableNotFound, name[:dot])
+}
+
+func columnType(table *Table, column string) ColumnType {
+  schema := table.Schema()
+  return schema[columnPosition(schema, column)].ColumnType
+}
+
+func (d *Database) newOptimizer(query Query) (*optimizer, error) {
+  if len(query.Tables) == 0 {
+    return nil, errors.New("query has no tables")
+  }
+  if len(query.Tables) > 64 {
+    return nil, errors.New("query has too many tables")
+  }
+  o := &optimizer{
+    filters: make([][]ColumnFilter, len(query.Tables)),
+    conditions: make([][]Expr, len(query.Tables)),
+    conditionFilters: make([][]func(Row) bool, len(query.Tables)),
+    keyFilters: make([][]ColumnFilter, len(query.Tables)),
+    ranges: make([][]columnRanges, len(query.Tables)),
+  }
+  seen := make(map[string]bool)
+  for _, name := range query.Tables {
+    if seen[name] {
+      return nil, fmt.Errorf("table %s is in the query twice", name)
+    }
+    seen[name] = true
+    table, err := d.Table(name)
+    if err != nil {
+      return nil, err
+    }
+    o.tables = append(o.tables, table)
+    o.stats = append(o.stats, d.Statistics(name))
+  }
+
+  for _, filter := range query.Filters {
+    i, column, err := splitColumn(o.tables, filter.Column)
+    if err != nil {
+      return nil, err
+    }
+    if filter.Value == nil {
+      return nil, fmt.Errorf("can not compare %s to NULL", filter.Column)
+    }
+    if filter.Value.columnType() != columnType(o.tables[i], column) {
+      return nil, fmt.Errorf("can not compare %s to a value of a different type", filter.Column)
+    }
+    filter.Column = column
+    o.filters[i] = append(o.filters[i], filter)
+  }
+
+  if err := o.splitWhere(query.Where); err != nil {
+    return nil, err
+  }
+  if len(query.Select) > 0 {
+    o.findColumns(query)
+  }
+
+  for _, condition := range query.Joins {
+    left, leftColumn, err := splitColumn(o.tables, condition.Left)
+    if err != nil {
+      return nil, err
+    }
+    right, rightColumn, err := splitColumn(o.tables, condition.Right)
+    if err != nil {
+      return nil, err
+    }
+    if left == right {
+      return nil, fmt.Errorf("join condition %s = %s is within one table", condition.Left, condition.Right)
+    }
+    if columnType(o.tables[left], leftColumn) != columnType(o.tables[right], rightColumn) {
+      return nil, fmt.Errorf("can not join %s with %s of a different type", condition.Left, condition.Right)
+    }
+    o.joins = append(o.joins, queryJoin{
+      left: left,
+      right: right,
+      leftColumn: condition.Left,
+      rightColumn: condition.Right,
+      leftName: leftColumn,
+      rightName: rightColumn,
+    })
+  }
+
+  reached := uint64(1)
+  for grew := true; grew; {
+    grew = false
+    for _, join := range o.joins {
+      if o.joinedBy(join, reached, ^reached) {
+        reached |= 1<<join.left | 1<<join.right
+        grew = true
+      }
+    }
+  }
+  o.connected = reached == o.all()
+
+  for i := range o.tables {
+    o.scans = append(o.scans, o.accessPaths(i))
+  }
+  return o, nil
+}
+
+// Splits where into the conditions ANDed together in it, and gives each
+// condition that only reads one table to that table.
+func (o *optimizer) splitWhere(where Expr) error {
+  if where == nil {
+    return nil
+  }
+  columns, tables := o.allColumns()
+  if _, err := CompileFilter(where, columns); err != nil {
+    return err
+  }
+  for _, condition := range conjuncts(where) {
+    read := uint64(0)
+    for _, name := range condition.references() {
+      position, err := resolveColumn(columns, name)
+      if err != nil {
+        return err
+      }
+      read |= 1 << tables[position]
+    }
+    if bits.OnesCount64(read) != 1 {
+      o.residual = append(o.residual, condition)
+      continue
+    }
+    i := bits.TrailingZeros64(read)
+    filter, err := CompileFilter(condition, qualifiedColumns(o.tables[i]))
+    if err != nil {
+      return err
+    }
+    o.conditions[i] = append(o.conditions[i], condition)
+    o.conditionFilters[i] = append(o.conditionFilters[i], filter)
+    if keyFilter, ok := o.expressionComparison(i, condition); ok {
+      o.keyFilters[i] = append(o.keyFilters[i], keyFilter)
+    }
+    if ranges, ok := o.conditionRanges(i, condition); ok {
+      o.ranges[i] = append(o.ranges[i], ranges)
+    }
+  }
+  return nil
+}
+
+// The condition as a filter on an expression over the columns of table i, if
+// it compares one, that isn't just a column, to a value of its type. The
+// expression is written without the table name, the way an index on it is.
+func (o *optimizer) expressionComparison(i int, condition Expr) (ColumnFilter, bool) {
+  c, ok := condition.(comparison)
+  if !ok {
+    return ColumnFilter{}, false
+  }
+  e, value, op := c.left, c.right, c.op
+  if _, ok := e.(literal); ok {
+    e, value, op = c.right, c.left, c.op.flipped()
+  }
+  lit, ok := value.(literal)
+  if _, isColumn := e.(columnRef); !ok || isColumn || lit.value == nil {
+    return ColumnFilter{}, false
+  }
+  prefix := o.tables[i].Name() + "."
+  e = e.withColumns(func(name string) string {
+    return strings.TrimPrefix(name, prefix)
+  })
+  compiled, err := Compile(e, o.tables[i].Schema())
+  if err != nil || compiled.Type != lit.value.columnType() {
+    return ColumnFilter{}, false
+  }
+  return ColumnFilter{Column: e.String(), Op: op, Value: lit.value}, true
+}
+
+// qualified columns of every table, and the table each one is in
+func (o *optimizer) allColumns() ([]Column, []int) {
+  columns := make([]Column, 0)
+  tables := make([]int, 0)
+  for i, table := range o.tables {
+    for _, col := range qualifiedColumns(table) {
+      columns = append(columns, col)
+      tables = append(tables, i)
+    }
+  }
+  return columns, tables
+}
+
+// Finds the columns of each table a query that selects expressions reads,
+// so indices that have all of them can be read without the table.
+func (o *optimizer) findColumns(query Query) {
+  names := make([]string, 0)
+  for _, join := range query.Joins {
+    names = append(names, join.Left, join.Right)
+  }
+  for _, filter := range query.Filters {
+    names = append(names, filter.Column)
+  }
+  if query.Where != nil {
+    names = append(names, query.Where.references()...)
+  }
+  names = append(names, query.GroupBy...)
+  for _, aggregate := range query.Aggregates {
+    names = append(names, aggregate.Column)
+  }
+  for _, column := range query.OrderBy {
+    names = append(names, column.Column)
+  }
+  for _, column := range query.Select {
+    names = append(names, column.Expr.references()...)
+  }
+  columns, tables := o.allColumns()
+  o.columns = make([][]string, len(o.tables))
+  for i := range o.columns {
+    o.columns[i] = make([]string, 0)
+  }
+  for _, name := range names {
+    // names of aggregated columns, or of no column at all, which planning
+    // the rest of the query rejects
+    position, err := resolveColumn(columns, name)
+    if err != nil {
+      continue
+    }
+    i := tables[position]
+    column := columns[position].Name[len(o.tables[i].Name())+1:]
+    o.columns[i] = appendUnique(o.columns[i], column)
+  }
+}
+
+// conditions that e ANDs together, e itself if it isn't an AND
+func conjuncts(e Expr) []Expr {
+  and, ok := e.(logical)
+  if !ok || and.or {
+    return []Expr{e}
+  }
+  parts := make([]Expr, 0, len(and.operands))
+  for _, operand := range and.operands {
+    parts = append(parts, conjuncts(operand)...)
+  }
+  return parts
+}
+
+// conditions that e ORs together, e itself if it isn't an OR
+func disjuncts(e Expr) []Expr {
+  or, ok := e.(logical)
+  if !ok || !or.or {
+    return []Expr{e}
+  }
+  parts := make([]Expr, 0, len(or.operands))
+  for _, operand := range or.operands {
+    parts = append(parts, disjuncts(operand)...)
+  }
+  return parts
+}
+
+// set of every table, as a bitmask of positions in tables
+func (o *optimizer) all() uint64 {
+  return uint64(1)<<len(o.tables) - 1
+}
+
+// whether join connects a table in one set to a table in the other
+func (o *optimizer) joinedBy(join queryJoin, left uint64, right uint64) bool {
+  return (left&(1<<join.left) != 0 && right&(1<<join.right) != 0) ||
+    (left&(1<<join.right) != 0 && right&(1<<join.left) != 0)
+}
+
+func (o *optimizer) joined(left uint64, right uint64) bool {
+  for _, join := range o.joins {
+    if o.joinedBy(join, left, right) {
+      return true
+    }
+  }
+  return false
+}
+
+// Number of rows in table i, from its statistics, or estimated from the
+// shape of its primary index.
+func (o *optimizer) rows(i int) float64 {
+  if o.stats[i] != nil {
+    return float64(o.stats[i].RowCount)
+  }
+  return o.tables[i].primaryIndex.tree().estimatedSize()
+}
+
+func (o *optimizer) columnStats(i int, column string) *ColumnStats {
+  if o.stats[i] == nil {
+    return nil
+  }
+  return o.stats[i].Columns[column]
+}
+
+// Estimated number of distinct values in column of table i. Without
+// statistics, a column that is the whole primary key is unique, and any other
+// one is assumed to repeat its values.
+func (o *optimizer) distinctValues(i int, column string) float64 {
+  if stats := o.columnStats(i, column); stats != nil {
+    return math.Max(stats.DistinctCount, 1)
+  }
+  rows := o.rows(i)
+  if primaryKey := o.tables[i].primaryKey(); len(primaryKey) == 1 && primaryKey[0] == column {
+    return math.Max(rows, 1)
+  }
+  return math.Max(rows/defaultDuplicates, 1)
+}
+
+// estimated fraction of the rows of table i that pass filter
+func (o *optimizer) filterSelectivity(i int, filter ColumnFilter) float64 {
+  if stats := o.columnStats(i, filter.Column); stats != nil {
+    return stats.selectivity(filter.Op, filter.Value)
+  }
+  switch filter.Op {
+  case Equal:
+    return 1 / o.distinctValues(i, filter.Column)
+  case NotEqual:
+    return 1 - 1/o.distinctValues(i, filter.Column)
+  }
+  return defaultRangeSelectivity
+}
+
+func (o *optimizer) tablePosition(table *Table) int {
+  for i := range o.tables {
+    if o.tables[i] == table {
+      return i
+    }
+  }
+  return -1
+}
+
+// A scan of table i through each of its indices, with as many filters as
+// possible turned into bounds on the index and the rest checked on each row.
+func (o *optimizer) accessPaths(i int) []Plan {
+  table := o.tables[i]
+  rows := o.rows(i)
+  selectivity := 1.0
+  for _, filter := range o.filters[i] {
+    selectivity *= o.filterSelectivity(i, filter)
+  }
+  for _, ranges := range o.ranges[i] {
+    selectivity *= ranges.selectivity
+  }
+  // and the conditions that aren't ranges
+  for range o.conditions[i][len(o.ranges[i]):] {
+    selectivity *= defaultRangeSelectivity
+  }
+  paths := make([]Plan, 0)
+  for _, index := range append([]*Index{table.PrimaryIndex()}, table.Indices()...) {
+    if index.Where() != nil && !o.implies(i, index.Where()) {
+      // the index could be missing rows the query wants
+      continue
+    }
+    if !o.comparesKeys(i, index) {
+      // nor has it rows its expressions are NULL for
+      continue
+    }
+    scan := IndexScan(table, index)
+    bounds := o.bounds(i, index)
+    if len(bounds.ranges) == 1 && bounds.skip == 0 {
+      scan.Predicate.LowerBound, scan.Predicate.UpperBound = bounds.ranges[0].LowerBound, bounds.ranges[0].UpperBound
+    } else {
+      scan.Predicate.Ranges, scan.Predicate.Skip = bounds.ranges, bounds.skip
+    }
+    read := bounds.selectivity
+    if index.Where() != nil {
+      read *= o.whereSelectivity(i, index.Where())
+    }
+    scan.Filter = allOf(append([]func(Row) bool{bounds.filter}, o.conditionFilters[i]...))
+    scan.filters, scan.conditions = o.filters[i], o.conditions[i]
+    if o.columns != nil {
+      scan.Predicate.Columns = o.columns[i]
+    }
+    scan.rows = rows * selectivity
+    // rows read from the index, and looked up in the primary index unless
+    // the index has every column
+    scan.cost = seekCost(rows)*bounds.seeks + rows*read
+    if index != table.PrimaryIndex() && !scan.indexOnly() {
+      scan.cost += rows * read * seekCost(rows)
+    }
+    paths = append(paths, scan)
+  }
+  return paths
+}
+
+// The condition as a filter on a column of table i, if it compares one to a
+// value: column op value, value op column, or a BOOL column or its NOT.
+func (o *optimizer) comparison(i int, condition Expr) (ColumnFilter, bool) {
+  column := func(e Expr) (string, bool) {
+    ref, ok := e.(columnRef)
+    if !ok {
+      return "", false
+    }
+    name := strings.TrimPrefix(ref.name, o.tables[i].Name()+".")
+    return name, columnPosition(o.tables[i].Schema(), name) >= 0
+  }
+  switch e := condition.(type) {
+  case columnRef:
+    if name, ok := column(e); ok && columnType(o.tables[i], name) == BOOL {
+      return ColumnFilter{Column: name, Op: Equal, Value: BoolField(true)}, true
+    }
+  case not:
+    if name, ok := column(e.operand); ok && columnType(o.tables[i], name) == BOOL {
+      return ColumnFilter{Column: name, Op: Equal, Value: BoolField(false)}, true
+    }
+  case comparison:
+    if name, ok := column(e.left); ok {
+      if value, ok := e.right.(literal); ok && value.value != nil {
+        return ColumnFilter{Column: name, Op: e.op, Value: value.value}, true
+      }
+    }
+    if name, ok := column(e.right); ok {
+      if value, ok := e.left.(literal); ok && value.value != nil {
+        return ColumnFilter{Column: name, Op: e.op.flipped(), Value: value.value}, true
+      }
+    }
+  }
+  return ColumnFilter{}, false
+}
+
+// Whether the query's filters and conditions on table i make sure every row
+// it wants meets where, so a partial index with that condition has them all.
+// Each part of where ANDed together must be implied by a comparison the query
+// makes, or be one of its conditions.
+func (o *optimizer) implies(i int, where Expr) bool {
+  facts := append([]ColumnFilter{}, o.filters[i]...)
+  conditions := make(map[string]bool)
+  for _, condition := range o.conditions[i] {
+    for _, part := range conjuncts(condition) {
+      if fact, ok := o.comparison(i, part); ok {
+        facts = append(facts, fact)
+      }
+      conditions[part.String()] = true
+    }
+  }
+  for _, part := range conjuncts(where) {
+    if conditions[part.String()] {
+      continue
+    }
+    wanted, ok := o.comparison(i, part)
+    if !ok {
+      return false
+    }
+    implied := false
+    for _, fact := range facts {
+      implied = implied || (fact.Column == wanted.Column && fact.implies(wanted))
+    }
+    if !implied {
+      return false
+    }
+  }
+  return true
+}
+
+// whether the query compares every expression index computes to a value, so
+// rows that aren't in it, as one of them is NULL for them, aren't wanted
+func (o *optimizer) comparesKeys(i int, index *Index) bool {
+  for _, c := range index.computed {
+    compared := false
+    for _, filter := range o.keyFilters[i] {
+      compared = compared || filter.Column == c.column.Name
+    }
+    if !compared {
+      return false
+    }
+  }
+  return true
+}
+
+// estimated fraction of the rows of table i where is true for
+func (o *optimizer) whereSelectivity(i int, where Expr) float64 {
+  selectivity := 1.0
+  for _, part := range conjuncts(where) {
+    if filter, ok := o.comparison(i, part); ok {
+      selectivity *= o.filterSelectivity(i, filter)
+    } else {
+      selectivity *= defaultRangeSelectivity
+    }
+  }
+  return selectivity
+}
+
+// check that every one of filters passes, ignoring nil ones, nil if they're
+// all nil
+func allOf(filters []func(Row) bool) func(Row) bool {
+  checks := make([]func(Row) bool, 0, len(filters))
+  for _, filter := range filters {
+    if filter != nil {
+      checks = append(checks, filter)
+    }
+  }
+  switch len(checks) {
+  case 0:
+    return nil
+  case 1:
+    return checks[0]
+  }
+  return func(row Row) bool {
+    for _, check := range checks {
+      if !check(row) {
+        return false
+      }
+    }
+    return true
+  }
+}
+
+// every way of joining left, made of the tables in leftSet, with right
+func (o *optimizer) joinPlans(left Plan, right Plan, leftSet uint64, rightSet uint64) ([]*JoinPlan, error) {
+  leftColumns, rightColumns := make([]string, 0), make([]string, 0)
+  joins := make([]queryJoin, 0)
+  for _, join := range o.joins {
+    if !o.joinedBy(join, leftSet, rightSet) {
+      continue
+    }
+    if leftSet&(1<<join.left) != 0 {
+      leftColumns, rightColumns = append(leftColumns, join.leftColumn), append(rightColumns, join.rightColumn)
+    } else {
+      leftColumns, rightColumns = append(leftColumns, join.rightColumn), append(rightColumns, join.leftColumn)
+    }
+    joins = append(joins, join)
+  }
+  // the columns were checked with the query, but the tables can have changed
+  // since
+  plans, err := joinMethods(InnerJoin, left, right, leftColumns, rightColumns, nil)
+  if err != nil {
+    return nil, err
+  }
+  for _, plan := range plans {
+    o.estimateJoin(plan, joins)
+  }
+  return plans, nil
+}
+
+func (o *optimizer) estimateJoin(join *JoinPlan, conditions []queryJoin) {
+  left, right := join.Left.estimated(), join.Right.estimated()
+  join.rows = left.rows * right.rows
+  for _, condition := range conditions {
+    join.rows /= math.Max(
+      o.distinctValues(condition.left, condition.leftName),
+      o.distinctValues(condition.right, condition.rightName),
+    )
+  }
+  output := join.rows * outputCost
+  switch join.Method {
+  case MergeJoinMethod:
+    join.cost = left.cost + right.cost + (left.rows+right.rows)*mergeRowCost + output
+  case IndexNestedLoopMethod:
+    // the right side is never scanned, its rows are looked up instead
+    table := join.Right.(*ScanPlan).Table
+    tableRows := o.rows(o.tablePosition(table))
+    perRow := 1.0
+    if join.Index != table.PrimaryIndex() {
+      perRow += seekCost(tableRows)
+    }
+    join.cost = left.cost + left.rows*seekCost(tableRows) + join.rows*perRow + output
+  case HashJoinMethod:
+    build, probe := math.Min(left.rows, right.rows), math.Max(left.rows, right.rows)
+    join.cost = left.cost + right.cost + build*hashBuildCost + probe*hashProbeCost + output
+    width := len(join.Left.Columns())
+    if right.rows < left.rows {
+      width = len(join.Right.Columns())
+    }
+    if build*float64(width*columnBytes) > float64(DefaultMemoryBudget) {
+      join.cost += (build + probe) * spillCost
+    }
+  }
+}
+
+func cheapest(plans []Plan) Plan {
+  var best Plan
+  for _, plan := range plans {
+    if best == nil || plan.estimated().cost < best.estimated().cost {
+      best = plan
+    }
+  }
+  return best
+}
+
+// Plans the query, picking the order to join tables in, how to join each pair,
+// and which index to read each table through, by their estimated cost.
+func (d *Database) Plan(query Query) (*QueryPlan, error) {
+  o, err := d.newOptimizer(query)
+  if err != nil {
+    return nil, err
+  }
+  var plan *QueryPlan
+  switch {
+  case len(o.tables) == 1:
+    plan = &QueryPlan{Root: cheapest(o.scans[0]), Alternatives: o.scans[0]}
+  case len(o.tables) <= maxDynamicProgrammingTables:
+    plan, err = o.dynamicProgramming()
+  default:
+    plan, err = o.greedy()
+  }
+  if err != nil {
+    return nil, err
+  }
+  plan.Alternatives = rankAlternatives(plan.Root, plan.Alternatives)
+  if len(o.residual) > 0 {
+    if plan, err = o.filter(plan); err != nil {
+      return nil, err
+    }
+  }
+  if len(query.GroupBy) > 0 || len(query.Aggregates) > 0 {
+    if plan, err = o.aggregate(plan, query); err != nil {
+      return nil, err
+    }
+  }
+  if len(query.OrderBy) > 0 || query.Limit > 0 || query.Offset != 0 {
+    if plan, err = o.order(plan, query); err != nil {
+      return nil, err
+    }
+  }
+  if len(query.Select) > 0 {
+    return project(plan, query.Select)
+  }
+  return plan, nil
+}
+
+// Filters the chosen plan and each alternative on the parts of the WHERE
+// condition that read more than one table, once they're all joined.
+func (o *optimizer) filter(plan *QueryPlan) (*QueryPlan, error) {
+  condition := o.residual[0]
+  if len(o.residual) > 1 {
+    condition = And(o.residual...)
+  }
+  filtered := &QueryPlan{}
+  for _, input := range append([]Plan{plan.Root}, plan.Alternatives...) {
+    filter, err := PlanFilter(input, condition)
+    if err != nil {
+      return nil, err
+    }
+    estimate := input.estimated()
+    filter.rows = estimate.rows * math.Pow(defaultRangeSelectivity, float64(len(o.residual)))
+    filter.cost = estimate.cost + filter.rows*outputCost
+    if filtered.Root == nil {
+      filtered.Root = filter
+    } else {
+      filtered.Alternatives = append(filtered.Alternatives, filter)
+    }
+  }
+  return filtered, nil
+}
+
+// Computes the selected expressions for the chosen plan and each
+// alternative, which doesn't change what they cost relative to each other.
+func project(plan *QueryPlan, selected []SelectColumn) (*QueryPlan, error) {
+  projected := &QueryPlan{}
+  for _, input := range append([]Plan{plan.Root}, plan.Alternatives...) {
+    projection, err := PlanProject(input, selected)
+    if err != nil {
+      return nil, err
+    }
+    estimate := input.estimated()
+    projection.rows = estimate.rows
+    projection.cost = estimate.cost + projection.rows*outputCost
+    if projected.Root == nil {
+      projected.Root = projection
+    } else {
+      projected.Alternatives = append(projected.Alternatives, projection)
+    }
+  }
+  return projected, nil
+}
+
+// Sorts and limits the chosen plan and each alternative, which may already
+// come out in order, and keeps the cheapest.
+func (o *optimizer) order(plan *QueryPlan, query Query) (*QueryPlan, error) {
+  if query.Offset < 0 {
+    return nil, errors.New("offset can not be negative")
+  }
+  limit, sortLimit := NoLimit, NoLimit
+  if query.Limit > 0 {
+    // a top-N sort keeps the rows the offset skips too
+    limit, sortLimit = Limit(query.Limit), Limit(query.Limit+query.Offset)
+  }
+  ordered := &QueryPlan{}
+  for _, input := range append([]Plan{plan.Root}, plan.Alternatives...) {
+    sorted, err := PlanSort(input, query.OrderBy, sortLimit)
+    if err != nil {
+      return nil, err
+    }
+    estimateOrder(sorted)
+    if query.Offset > 0 {
+      sorted = PlanOffset(sorted, query.Offset, limit)
+      estimateOrder(sorted)
+    }
+    if ordered.Root == nil || sorted.estimated().cost < ordered.Root.estimated().cost {
+      ordered.Root = sorted
+    }
+    ordered.Alternatives = append(ordered.Alternatives, sorted)
+  }
+  ordered.Alternatives = rankAlternatives(ordered.Root, ordered.Alternatives)
+  return ordered, nil
+}
+
+func estimateOrder(plan Plan) {
+  switch p := plan.(type) {
+  case *SortPlan:
+    input := p.Input.estimated()
+    p.rows = input.rows
+    // comparisons against the rows held in memory
+    held := input.rows
+    if p.Limit != NoLimit {
+      p.rows = math.Min(input.rows, float64(p.Limit))
+      held = p.rows
+    }
+    p.cost = input.cost + input.rows*seekCost(held)*sortCompareCost + p.rows*outputCost
+    if p.Limit == NoLimit && held*float64(len(p.Columns())*columnBytes) > float64(DefaultMemoryBudget) {
+      p.cost += input.rows * spillCost
+    }
+  case *LimitPlan:
+    input := p.Input.estimated()
+    p.rows = math.Max(input.rows-float64(p.Offset), 0)
+    if p.Limit != NoLimit {
+      p.rows = math.Min(p.rows, float64(p.Limit))
+    }
+    p.cost = input.cost + p.rows*outputCost
+  }
+}
+
+// Aggregates the chosen plan and each alternative, which may come out grouped
+// and so be cheaper to aggregate, and keeps the cheapest.
+func (o *optimizer) aggregate(plan *QueryPlan, query Query) (*QueryPlan, error) {
+  aggregated := &QueryPlan{}
+  for _, input := range append([]Plan{plan.Root}, plan.Alternatives...) {
+    aggregate, err := PlanAggregate(input, query.GroupBy, query.Aggregates, query.Having)
+    if err != nil {
+      return nil, err
+    }
+    if err := o.estimateAggregate(aggregate); err != nil {
+      return nil, err
+    }
+    if aggregated.Root == nil || aggregate.cost < aggregated.Root.estimated().cost {
+      aggregated.Root = aggregate
+    }
+    aggregated.Alternatives = append(aggregated.Alternatives, aggregate)
+  }
+  aggregated.Alternatives = rankAlternatives(aggregated.Root, aggregated.Alternatives)
+  return aggregated, nil
+}
+
+func (o *optimizer) estimateAggregate(aggregate *AggregatePlan) error {
+  input := aggregate.Input.estimated()
+  groups := 1.0
+  if len(aggregate.GroupBy) > 0 {
+    columns := aggregate.Input.Columns()
+    for _, position := range aggregate.GroupBy {
+      if position >= len(columns) {
+        return errors.New("grouped column not found")
+      }
+      // the optimizer names every column, but the tables can have changed
+      // since
+      i, column, err := splitColumn(o.tables, columns[position].Name)
+      if err != nil {
+        return err
+      }
+      groups *= o.distinctValues(i, column)
+    }
+    groups = math.Min(groups, input.rows)
+  }
+  aggregate.rows = groups
+  if aggregate.Having != nil {
+    aggregate.rows *= defaultRangeSelectivity
+  }
+  if aggregate.Streaming {
+    aggregate.cost = input.cost + input.rows*aggregateRowCost + groups*outputCost
+  } else {
+    aggregate.cost = input.cost + input.rows*hashBuildCost + groups*outputCost
+  }
+  return nil
+}
+
+func rankAlternatives(chosen Plan, plans []Plan) []Plan {
+  alternatives := make([]Plan, 0, len(plans))
+  for _, plan := range plans {
+    if plan != chosen {
+      alternatives = append(alternatives, plan)
+    }
+  }
+  sort.SliceStable(alternatives, func(i, j int) bool {
+    return alternatives[i].estimated().cost < alternatives[j].estimated().cost
+  })
+  if len(alternatives) > maxAlternatives {
+    alternatives = alternatives[:maxAlternatives]
+  }
+  return alternatives
+}
+
+// plans the set could be built from. Every scan of a single table is kept, as
+// one that's more expensive may come out in a useful order.
+func (o *optimizer) candidates(set uint64, best []Plan) []Plan {
+  if bits.OnesCount64(set) == 1 {
+    return o.scans[bits.TrailingZeros64(set)]
+  }
+  if best[set] == nil {
+    return nil
+  }
+  return []Plan{best[set]}
+}
+
+// Finds the cheapest plan for every set of tables, from the cheapest plans of
+// the two sets it can be split into, smallest sets first.
+func (o *optimizer) dynamicProgramming() (*QueryPlan, error) {
+  all := o.all()
+  best := make([]Plan, all+1)
+  alternatives := make([]Plan, 0)
+  for i := range o.tables {
+    best[1<<i] = cheapest(o.scans[i])
+  }
+  // every subset of a set is a smaller number
+  for set := uint64(1); set <= all; set++ {
+    if bits.OnesCount64(set) < 2 {
+      continue
+    }
+    for left := (set - 1) & set; left > 0; left = (left - 1) & set {
+      right := set &^ left
+      if o.connected && !o.joined(left, right) {
+        continue
+      }
+      for _, leftPlan := range o.candidates(left, best) {
+        for _, rightPlan := range o.candidates(right, best) {
+          joins, err := o.joinPlans(leftPlan, rightPlan, left, right)
+          if err != nil {
+            return nil, err
+          }
+          for _, join := range joins {
+            if best[set] == nil || join.cost < best[set].estimated().cost {
+              best[set] = join
+            }
+            if set == all {
+              alternatives = append(alternatives, join)
+            }
+          }
+        }
+      }
+    }
+  }
+  return &QueryPlan{Root: best[all], Alternatives: alternatives}, nil
+}
+
+// Starts from the smallest table and keeps joining whichever table is
+// cheapest to join next.
+func (o *optimizer) greedy() (*QueryPlan, error) {
+  var current Plan
+  start := 0
+  for i, scans := range o.scans {
+    if plan := cheapest(scans); current == nil || plan.estimated().rows < current.estimated().rows {
+      current, start = plan, i
+    }
+  }
+  joined := uint64(1) << start
+  alternatives := make([]Plan, 0)
+  for joined != o.all() {
+    var next Plan
+    nextTable := -1
+    alternatives = alternatives[:0]
+    for i := range o.tables {
+      if joined&(1<<i) != 0 || (o.connected && !o.joined(joined, 1<<i)) {
+        continue
+      }
+      for _, scan := range o.scans[i] {
+        joins, err := o.joinPlans(current, scan, joined, 1<<i)
+        if err != nil {
+          return nil, err
+        }
+        for _, join := range joins {
+          alternatives = append(alternatives, join)
+          if next == nil || join.cost < next.estimated().cost {
+            next, nextTable = join, i
+          }
+        }
+      }
+    }
+    current = next
+    joined |= 1 << nextTable
+  }
+  return &QueryPlan{Root: current, Alternatives: alternatives}, nil
+}
@@ -0,0 +1,429 @@
+package sql_planner
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// users(id, age) with an index on age, pets(name, ownerId) with an index on
+// ownerId, and toys(id, petName)
+func createQueryDatabase(t *testing.T) *Database {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "age", ColumnType: INT},
+  }, []string{"id"})
+  require.NoError(t, err)
+  pets, err := db.CreateTable("pets", []Column{
+    {Name: "name", ColumnType: STRING},
+    {Name: "ownerId", ColumnType: INT},
+  }, []string{"name"})
+  require.NoError(t, err)
+  toys, err := db.CreateTable("toys", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "petName", ColumnType: STRING},
+  }, []string{"id"})
+  require.NoError(t, err)
+
+  for i := 0; i < 200; i++ {
+    require.NoError(t, users.Insert(Row{IntField(i), IntField(i % 20)}))
+  }
+  for i := 0; i < 300; i++ {
+    require.NoError(t, pets.Insert(Row{StringField(fmt.Sprintf("pet%d", i)), IntField((i * 7) % 250)}))
+  }
+  for i := 0; i < 50; i++ {
+    require.NoError(t, toys.Insert(Row{IntField(i), StringField(fmt.Sprintf("pet%d", i*3))}))
+  }
+  _, err = db.CreateIndex("users_age", "users", []string{"age"})
+  require.NoError(t, err)
+  _, err = db.CreateIndex("pets_owner", "pets", []string{"ownerId"})
+  require.NoError(t, err)
+  return db
+}
+
+// runs the plan and reorders its rows to the given columns
+func runPlan(t *testing.T, plan Plan, columns ...string) []Row {
+  positions, err := resolveColumns(plan.Columns(), columns)
+  require.NoError(t, err)
+  rows, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  reordered := make([]Row, 0, len(rows))
+  for _, row := range rows {
+    reordered = append(reordered, joinKey(row, positions))
+  }
+  return reordered
+}
+
+func TestPlanQuery(t *testing.T) {
+  db := createQueryDatabase(t)
+  plan, err := db.Plan(Query{
+    Tables: []string{"toys", "users", "pets"},
+    Joins: []JoinCondition{
+      {Left: "users.id", Right: "pets.ownerId"},
+      {Left: "toys.petName", Right: "pets.name"},
+    },
+    Filters: []ColumnFilter{{Column: "users.age", Op: Less, Value: IntField(10)}},
+  })
+  require.NoError(t, err)
+
+  // toy i belongs to pet 3i, whose owner is 21i % 250
+  expected := make([]Row, 0)
+  for i := 0; i < 50; i++ {
+    owner := (i * 21) % 250
+    if owner < 200 && owner%20 < 10 {
+      expected = append(expected, Row{IntField(i), IntField(owner)})
+    }
+  }
+  require.ElementsMatch(t, expected, runPlan(t, plan.Root, "toys.id", "users.id"))
+
+  // the few toys are cheaper to look up pets for than to hash
+  require.Contains(t, plan.Explain(), "index nested loop inner join on toys.petName = pets.name using pets_pkey")
+
+  // nothing considered was cheaper
+  require.NotEmpty(t, plan.Alternatives)
+  for _, alternative := range plan.Alternatives {
+    require.False(t, alternative.estimated().cost < plan.Root.estimated().cost, summarize(alternative))
+  }
+}
+
+func TestPlanAccessPath(t *testing.T) {
+  db := createQueryDatabase(t)
+  for _, test := range []struct {
+    filters []ColumnFilter
+    index string
+    ids []int
+  }{
+    {[]ColumnFilter{{Column: "users.age", Op: Equal, Value: IntField(5)}}, "users_age", []int{5, 25, 45, 65, 85, 105, 125, 145, 165, 185}},
+    {[]ColumnFilter{{Column: "users.id", Op: Equal, Value: IntField(42)}}, "users_pkey", []int{42}},
+    {
+      []ColumnFilter{
+        {Column: "users.id", Op: GreaterOrEqual, Value: IntField(195)},
+        {Column: "users.age", Op: Greater, Value: IntField(16)},
+      },
+      "users_pkey",
+      []int{197, 198, 199},
+    },
+    {
+      []ColumnFilter{
+        {Column: "users.age", Op: Equal, Value: IntField(3)},
+        {Column: "users.id", Op: Less, Value: IntField(50)},
+      },
+      "users_age",
+      []int{3, 23, 43},
+    },
+  } {
+    plan, err := db.Plan(Query{Tables: []string{"users"}, Filters: test.filters})
+    require.NoError(t, err)
+    scan, ok := plan.Root.(*ScanPlan)
+    require.True(t, ok)
+    require.Equal(t, test.index, scan.Index.Name())
+
+    expected := make([]Row, 0)
+    for _, id := range test.ids {
+      expected = append(expected, Row{IntField(id)})
+    }
+    require.ElementsMatch(t, expected, runPlan(t, plan.Root, "users.id"))
+  }
+}
+
+func TestPlanIndexOnly(t *testing.T) {
+  db := NewDatabase()
+  people, err := db.CreateTable("people", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "age", ColumnType: INT},
+    {Name: "name", ColumnType: STRING},
+    {Name: "bio", ColumnType: STRING},
+  }, []string{"id"})
+  require.NoError(t, err)
+  for i := 0; i < 500; i++ {
+    require.NoError(t, people.Insert(Row{IntField(i), IntField(i % 50), StringField(fmt.Sprintf("p%d", i)), StringField("...")}))
+  }
+  _, err = db.CreateIndexIncluding("people_age", "people", []string{"age"}, []string{"name"})
+  require.NoError(t, err)
+
+  query := Query{
+    Tables: []string{"people"},
+    Filters: []ColumnFilter{{Column: "people.age", Op: Equal, Value: IntField(7)}},
+    Select: []SelectColumn{{Expr: ColumnRef("name")}, {Expr: ColumnRef("id")}},
+  }
+  expected := make([]Row, 0)
+  for i := 7; i < 500; i += 50 {
+    expected = append(expected, Row{StringField(fmt.Sprintf("p%d", i)), IntField(i)})
+  }
+  plan, err := db.Plan(query)
+  require.NoError(t, err)
+  require.Contains(t, plan.Explain(), "index only scan people using people_age")
+  require.ElementsMatch(t, expected, runPlan(t, plan.Root, "people.name", "people.id"))
+
+  // bio isn't in the index, so rows are looked up in the table
+  query.Select = append(query.Select, SelectColumn{Expr: ColumnRef("bio")})
+  plan, err = db.Plan(query)
+  require.NoError(t, err)
+  require.NotContains(t, plan.Explain(), "index only")
+  require.Len(t, runPlan(t, plan.Root, "people.bio"), 10)
+}
+
+func TestPlanPartialIndex(t *testing.T) {
+  db := NewDatabase()
+  orders, err := db.CreateTable("orders", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "customer", ColumnType: INT},
+    {Name: "total", ColumnType: INT},
+  }, []string{"id"})
+  require.NoError(t, err)
+  for i := 0; i < 1000; i++ {
+    require.NoError(t, orders.Insert(Row{IntField(i), IntField(i % 100), IntField(i % 37)}))
+  }
+  _, err = db.CreatePartialIndex("orders_big", "orders", []string{"customer"}, nil,
+    Compare(Greater, ColumnRef("total"), Literal(IntField(30))))
+  require.NoError(t, err)
+
+  for _, test := range []struct {
+    filters []ColumnFilter
+    where Expr
+    partial bool
+  }{
+    {[]ColumnFilter{{Column: "orders.customer", Op: Equal, Value: IntField(3)}}, nil, false},
+    {[]ColumnFilter{
+      {Column: "orders.customer", Op: Equal, Value: IntField(3)},
+      {Column: "orders.total", Op: GreaterOrEqual, Value: IntField(35)},
+    }, nil, true},
+    {[]ColumnFilter{
+      {Column: "orders.customer", Op: Equal, Value: IntField(3)},
+      {Column: "orders.total", Op: Greater, Value: IntField(20)},
+    }, nil, false},
+    {
+      []ColumnFilter{{Column: "orders.customer", Op: Equal, Value: IntField(3)}},
+      Compare(Less, Literal(IntField(33)), ColumnRef("orders.total")),
+      true,
+    },
+  } {
+    query := Query{Tables: []string{"orders"}, Filters: test.filters, Where: test.where}
+    plan, err := db.Plan(query)
+    require.NoError(t, err)
+    require.Equal(t, test.partial, plan.Root.(*ScanPlan).Index.Name() == "orders_big", plan.Explain())
+
+    // the same rows as reading the whole table
+    expected := make([]Row, 0)
+    for i := 3; i < 1000; i += 100 {
+      passes := true
+      for _, filter := range test.filters {
+        passes = passes && (filter.Column != "orders.total" || filter.Op.holds(IntField(i%37), filter.Value))
+      }
+      if test.where != nil {
+        passes = passes && i%37 > 33
+      }
+      if passes {
+        expected = append(expected, Row{IntField(i)})
+      }
+    }
+    require.ElementsMatch(t, expected, runPlan(t, plan.Root, "orders.id"))
+  }
+}
+
+func TestPlanExpressionIndex(t *testing.T) {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "email", ColumnType: STRING},
+  }, []string{"id"})
+  require.NoError(t, err)
+  for i := 0; i < 1000; i++ {
+    require.NoError(t, users.Insert(Row{IntField(i), StringField(fmt.Sprintf("User%d@sheen.com", i))}))
+  }
+  _, err = db.CreateExpressionIndex("users_email", "users", []Expr{Lower(ColumnRef("email"))}, nil, nil)
+  require.NoError(t, err)
+
+  for _, test := range []struct {
+    where Expr
+    indexed bool
+    expected []Row
+  }{
+    {Compare(Equal, Lower(ColumnRef("users.email")), Literal(StringField("user7@sheen.com"))), true, []Row{{IntField(7)}}},
+    {Compare(Equal, Literal(StringField("user7@sheen.com")), Lower(ColumnRef("email"))), true, []Row{{IntField(7)}}},
+    // the index only has the lower case emails
+    {Compare(Equal, ColumnRef("email"), Literal(StringField("User7@sheen.com"))), false, []Row{{IntField(7)}}},
+    {Compare(Equal, Upper(ColumnRef("email")), Literal(StringField("USER7@SHEEN.COM"))), false, []Row{{IntField(7)}}},
+  } {
+    plan, err := db.Plan(Query{Tables: []string{"users"}, Where: test.where})
+    require.NoError(t, err)
+    require.Equal(t, test.indexed, plan.Root.(*ScanPlan).Index.Name() == "users_email", plan.Explain())
+    require.ElementsMatch(t, test.expected, runPlan(t, plan.Root, "users.id"))
+  }
+}
+
+func TestPlanRanges(t *testing.T) {
+  db := NewDatabase()
+  people, err := db.CreateTable("people", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "age", ColumnType: INT},
+    {Name: "city", ColumnType: INT},
+    {Name: "score", ColumnType: INT},
+  }, []string{"id"})
+  require.NoError(t, err)
+  for i := 0; i < 1000; i++ {
+    require.NoError(t, people.Insert(Row{IntField(i), IntField(i % 50), IntField(i % 7), IntField(i % 100)}))
+  }
+  _, err = db.CreateIndex("people_age", "people", []string{"age"})
+  require.NoError(t, err)
+  _, err = db.CreateIndex("people_city_score", "people", []string{"city", "score"})
+  require.NoError(t, err)
+  _, err = db.Analyze("people")
+  require.NoError(t, err)
+
+  age, score := ColumnRef("age"), ColumnRef("people.score")
+  value := func(i int) Expr {
+    return Literal(IntField(i))
+  }
+  for _, test := range []struct {
+    where Expr
+    index string
+    ranges int
+    passes func(i int) bool
+  }{
+    {
+      And(In(age, value(20), value(30)), Compare(Greater, ColumnRef("id"), value(500))),
+      "people_age", 2,
+      func(i int) bool { return (i%50 == 20 || i%50 == 30) && i > 500 },
+    },
+    {
+      Or(Compare(Less, age, value(2)), Compare(GreaterOrEqual, age, value(48))),
+      "people_age", 2,
+      func(i int) bool { return i%50 < 2 || i%50 >= 48 },
+    },
+    {
+      // the ranges overlap, so they're read as one
+      And(Or(Compare(Less, age, value(1)), In(age, value(0), value(4))), Compare(NotEqual, age, value(4))),
+      "people_age", 2,
+      func(i int) bool { return i%50 == 0 },
+    },
+    {Compare(Equal, score, value(42)), "people_city_score", 1, func(i int) bool { return i%100 == 42 }},
+    {In(score, value(3), value(4)), "people_city_score", 2, func(i int) bool { return i%100 == 3 || i%100 == 4 }},
+    {And(Compare(Equal, age, value(1)), Compare(Equal, age, value(2))), "people_age", 1, func(i int) bool { return false }},
+  } {
+    plan, err := db.Plan(Query{Tables: []string{"people"}, Where: test.where})
+    require.NoError(t, err)
+    scan := plan.Root.(*ScanPlan)
+    require.Equal(t, test.index, scan.Index.Name(), plan.Explain())
+    require.Equal(t, test.ranges, len(scan.Predicate.keyRanges()), plan.Explain())
+    require.Equal(t, test.index == "people_city_score", strings.HasPrefix(plan.Explain(), "skip scan"), plan.Explain())
+
+    expected := make([]Row, 0)
+    for i := 0; i < 1000; i++ {
+      if test.passes(i) {
+        expected = append(expected, Row{IntField(i)})
+      }
+    }
+    require.ElementsMatch(t, expected, runPlan(t, plan.Root, "people.id"))
+  }
+}
+
+func TestPlanTablesChanged(t *testing.T) {
+  db := createQueryDatabase(t)
+  users, err := db.Table("users")
+  require.NoError(t, err)
+  pets, err := db.Table("pets")
+  require.NoError(t, err)
+
+  // tables altered after the query was checked fail planning with an error
+  o, err := db.newOptimizer(Query{
+    Tables: []string{"users", "pets"},
+    Joins: []JoinCondition{{Left: "users.id", Right: "pets.ownerId"}},
+  })
+  require.NoError(t, err)
+  require.NoError(t, pets.RenameColumn("ownerId", "owner"))
+  _, err = o.dynamicProgramming()
+  require.Error(t, err)
+  _, err = o.greedy()
+  require.Error(t, err)
+
+  o, err = db.newOptimizer(Query{Tables: []string{"users"}})
+  require.NoError(t, err)
+  aggregate, err := PlanAggregate(o.scans[0][0], []string{"users.age"}, nil, nil)
+  require.NoError(t, err)
+  require.NoError(t, users.DropColumn("age", true))
+  require.Error(t, o.estimateAggregate(aggregate))
+}
+
+func TestPlanExplain(t *testing.T) {
+  db := createQueryDatabase(t)
+  explained, err := db.Explain(Query{
+    Tables: []string{"users", "pets"},
+    Joins: []JoinCondition{{Left: "users.id", Right: "pets.ownerId"}},
+    Filters: []ColumnFilter{{Column: "users.id", Op: Equal, Value: IntField(7)}},
+  })
+  require.NoError(t, err)
+  lines := strings.Split(strings.TrimSpace(explained), "\n")
+  // the join and its two inputs, then the alternatives
+  require.Contains(t, lines[0], "join on")
+  require.True(t, strings.HasPrefix(lines[1], "  "))
+  require.True(t, strings.HasPrefix(lines[2], "  "))
+  require.Contains(t, explained, "scan users using users_pkey where id = 7")
+  require.Contains(t, lines[3], "alternatives:")
+  require.Contains(t, explained, "cost=")
+}
+
+// tables t0 ... t(count-1), with 10 rows each, where ti.next = t(i+1).id
+func createChainDatabase(t *testing.T, count int) (*Database, Query) {
+  db := NewDatabase()
+  query := Query{}
+  for i := 0; i < count; i++ {
+    name := fmt.Sprintf("t%d", i)
+    table, err := db.CreateTable(name, []Column{
+      {Name: "id", ColumnType: INT},
+      {Name: "next", ColumnType: INT},
+    }, []string{"id"})
+    require.NoError(t, err)
+    for id := 0; id < 10; id++ {
+      require.NoError(t, table.Insert(Row{IntField(id), IntField((id + 1) % 10)}))
+    }
+    query.Tables = append(query.Tables, name)
+    if i > 0 {
+      query.Joins = append(query.Joins, JoinCondition{Left: fmt.Sprintf("t%d.next", i-1), Right: name + ".id"})
+    }
+  }
+  return db, query
+}
+
+func TestPlanManyTables(t *testing.T) {
+  // past maxDynamicProgrammingTables, so planned greedily
+  for _, count := range []int{4, 12} {
+    db, query := createChainDatabase(t, count)
+    plan, err := db.Plan(query)
+    require.NoError(t, err)
+    rows := runPlan(t, plan.Root, "t0.id", fmt.Sprintf("t%d.id", count-1))
+    require.Len(t, rows, 10)
+    for _, row := range rows {
+      require.Equal(t, IntField((int(row[0].(IntField))+count-1)%10), row[1])
+    }
+  }
+}
+
+func TestPlanCrossProduct(t *testing.T) {
+  db, query := createChainDatabase(t, 3)
+  query.Joins = query.Joins[:1]
+  plan, err := db.Plan(query)
+  require.NoError(t, err)
+  require.Len(t, runPlan(t, plan.Root, "t0.id", "t1.id", "t2.id"), 100)
+}
+
+func TestPlanInvalid(t *testing.T) {
+  db := createQueryDatabase(t)
+  for _, query := range []Query{
+    {},
+    {Tables: []string{"nope"}},
+    {Tables: []string{"users", "users"}},
+    {Tables: []string{"users"}, Filters: []ColumnFilter{{Column: "users.nope", Op: Equal, Value: IntField(1)}}},
+    {Tables: []string{"users"}, Filters: []ColumnFilter{{Column: "age", Op: Equal, Value: IntField(1)}}},
+    {Tables: []string{"users"}, Filters: []ColumnFilter{{Column: "users.age", Op: Equal, Value: StringField("1")}}},
+    {Tables: []string{"users"}, Filters: []ColumnFilter{{Column: "users.age", Op: Equal}}},
+    {Tables: []string{"users", "pets"}, Joins: []JoinCondition{{Left: "users.id", Right: "pets.name"}}},
+    {Tables: []string{"users"}, Joins: []JoinCondition{{Left: "users.id", Right: "users.age"}}},
+  } {
+    _, err := db.Plan(query)
+    require.Error(t, err, "%+v", query)
+  }
+}
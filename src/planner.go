@@ -0,0 +1,921 @@
+package sql_planner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Node of a physical query plan. Plans run like any other RowSource, and
+// know their output columns so names can be resolved to positions.
+type Plan interface {
+  // output columns, named "table.column" for columns of named tables
+  Columns() []Column
+  // positions of the output columns the rows are sorted on, ascending, most
+  // significant first. Empty if the order isn't known.
+  Ordering() []int
+  Run(output chan<- []Row) error
+  // estimated number of output rows and cost, see Explain
+  estimated() *planEstimate
+  // one line for EXPLAIN, without the inputs
+  describe() string
+  inputs() []Plan
+}
+
+// Estimates the optimizer made for a plan node. Plans built by hand have none.
+type planEstimate struct {
+  rows float64
+  cost float64
+}
+
+func (e *planEstimate) estimated() *planEstimate {
+  return e
+}
+
+func qualifiedColumns(table *Table) []Column {
+  schema := table.Schema()
+  name := table.Name()
+  if name == "" {
+    return schema
+  }
+  for i := range schema {
+    schema[i].Name = name + "." + schema[i].Name
+  }
+  return schema
+}
+
+// Position of name in columns. name is either qualified, or a column name
+// that only one table has.
+func resolveColumn(columns []Column, name string) (int, error) {
+  found := -1
+  for i, col := range columns {
+    if col.Name == name || strings.HasSuffix(col.Name, "."+name) {
+      if found >= 0 {
+        return -1, fmt.Errorf("column %s is ambiguous", name)
+      }
+      found = i
+    }
+  }
+  if found < 0 {
+    return -1, fmt.Errorf("column %s not found", name)
+  }
+  return found, nil
+}
+
+func resolveColumns(columns []Column, names []string) ([]int, error) {
+  positions := make([]int, 0, len(names))
+  for _, name := range names {
+    position, err := resolveColumn(columns, name)
+    if err != nil {
+      return nil, err
+    }
+    positions = append(positions, position)
+  }
+  return positions, nil
+}
+
+// Reads a table through one of its indices.
+type ScanPlan struct {
+  Table *Table
+  Index *Index
+  Predicate QueryPredicate
+  // condition on rows in the order of the table schema, checked after
+  // Predicate, may be nil
+  Filter func(Row) bool
+  BatchSize int
+  // what Predicate and Filter were made from, for EXPLAIN
+  filters []ColumnFilter
+  conditions []Expr
+  planEstimate
+}
+
+// plan reading every row of table through its primary index
+func FullScan(table *Table) *ScanPlan {
+  return IndexScan(table, table.PrimaryIndex())
+}
+
+// plan reading every row of table in the order of index
+func IndexScan(table *Table, index *Index) *ScanPlan {
+  return &ScanPlan{
+    Table: table,
+    Index: index,
+    Predicate: QueryPredicate{
+      LowerBound: NegativeInfinity{},
+      UpperBound: Infinity{},
+      Limit:      NoLimit,
+    },
+  }
+}
+
+func (s *ScanPlan) Columns() []Column {
+  return qualifiedColumns(s.Table)
+}
+
+// rows come out in the order of the index
+func (s *ScanPlan) Ordering() []int {
+  if s.Predicate.Descending {
+    return nil
+  }
+  schema := s.Table.Schema()
+  ordering := make([]int, 0, len(s.Index.schema))
+  for _, col := range s.Index.Schema() {
+    position := columnPosition(schema, col.Name)
+    if position < 0 {
+      // computed by an expression, which the rows don't have
+      break
+    }
+    ordering = append(ordering, position)
+  }
+  return ordering
+}
+
+func (s *ScanPlan) Run(output chan<- []Row) error {
+  batchSize := s.BatchSize
+  if batchSize <= 0 {
+    batchSize = DefaultBatchSize
+  }
+  scan := s.Table.Scan(s.Index, s.Predicate, batchSize)
+  if s.Filter == nil {
+    return scan(output)
+  }
+  out := newBatcher(output, batchSize)
+  err := drain(scan, func(batch []Row) error {
+    for _, row := range batch {
+      if s.Filter(row) {
+        out.add(row)
+      }
+    }
+    return nil
+  })
+  out.flush()
+  return err
+}
+
+func (s *ScanPlan) describe() string {
+  method := "scan"
+  if s.Predicate.Skip > 0 {
+    method = "skip scan"
+  }
+  if s.indexOnly() {
+    method = "index only " + method
+  }
+  description := fmt.Sprintf("%s %s using %s", method, s.Table.Name(), s.Index.Name())
+  if len(s.filters)+len(s.conditions) > 0 {
+    conditions := make([]string, 0, len(s.filters)+len(s.conditions))
+    for _, filter := range s.filters {
+      conditions = append(conditions, filter.String())
+    }
+    for _, condition := range s.conditions {
+      conditions = append(conditions, condition.String())
+    }
+    description += " where " + strings.Join(conditions, " and ")
+  }
+  return description
+}
+
+func (s *ScanPlan) inputs() []Plan {
+  return nil
+}
+
+// whether the scan reads only the index, see QueryPredicate.Columns
+func (s *ScanPlan) indexOnly() bool {
+  return s.Index != s.Table.PrimaryIndex() && s.Predicate.Columns != nil && s.Index.covers(s.Predicate.Columns)
+}
+
+// whether the scan reads the whole table, so a nested loop join can replace
+// it with lookups into the table
+func (s *ScanPlan) isFull() bool {
+  _, lowerOpen := s.Predicate.LowerBound.(NegativeInfinity)
+  _, upperOpen := s.Predicate.UpperBound.(Infinity)
+  return lowerOpen && upperOpen && len(s.Predicate.Ranges) == 0 && s.Predicate.Skip == 0 && s.Predicate.Filter == nil && s.Predicate.Limit == NoLimit && s.Filter == nil
+}
+
+type JoinMethod int
+
+const (
+  // the right table is looked up by index for every left row
+  IndexNestedLoopMethod JoinMethod = iota + 1
+  HashJoinMethod
+  // both sides are read in join key order
+  MergeJoinMethod
+)
+
+func (m JoinMethod) String() string {
+  switch m {
+  case IndexNestedLoopMethod:
+    return "index nested loop"
+  case HashJoinMethod:
+    return "hash"
+  case MergeJoinMethod:
+    return "merge"
+  default:
+    return "unknown"
+  }
+}
+
+// Equi-join of two plans, output columns are Left's followed by Right's, or
+// only Left's for SemiJoin and AntiJoin.
+type JoinPlan struct {
+  Method JoinMethod
+  Type JoinType
+  Left Plan
+  Right Plan
+  // positions of the join key in Left's and Right's columns
+  LeftKey []int
+  RightKey []int
+  // for IndexNestedLoopMethod, the index of Right's table to look rows up in.
+  // Right is then a full ScanPlan.
+  Index *Index
+  Residual func(left Row, right Row) bool
+  // bytes of memory a hash join can use, DefaultMemoryBudget if 0
+  MemoryBudget int64
+  TempDir string
+  BatchSize int
+  planEstimate
+}
+
+func (j *JoinPlan) Columns() []Column {
+  if j.Type.leftOnly() {
+    return j.Left.Columns()
+  }
+  return append(j.Left.Columns(), j.Right.Columns()...)
+}
+
+func (j *JoinPlan) Ordering() []int {
+  switch {
+  case j.Method == HashJoinMethod:
+    // partitions come out one after the other
+    return nil
+  case j.Type == RightOuterJoin || j.Type == FullOuterJoin:
+    // right rows without a match come out with NULLs for the left columns
+    return nil
+  default:
+    // left rows are read in order, and each one's matches come out together
+    return j.Left.Ordering()
+  }
+}
+
+func (j *JoinPlan) Run(output chan<- []Row) error {
+  leftSchema, rightSchema := j.Left.Columns(), j.Right.Columns()
+  switch j.Method {
+  case IndexNestedLoopMethod:
+    scan, ok := j.Right.(*ScanPlan)
+    if !ok {
+      return errors.New("index nested loop join needs a table on the right")
+    }
+    return (&NestedLoopJoin{
+      Type: j.Type,
+      Outer: j.Left.Run,
+      OuterSchema: leftSchema,
+      Inner: scan.Table,
+      OuterKey: j.LeftKey,
+      InnerKey: j.RightKey,
+      InnerIndex: j.Index,
+      Residual: j.Residual,
+      BatchSize: j.BatchSize,
+    }).Run(output)
+  case HashJoinMethod:
+    return (&HashJoin{
+      Type: j.Type,
+      Left: j.Left.Run,
+      Right: j.Right.Run,
+      LeftKey: j.LeftKey,
+      RightKey: j.RightKey,
+      LeftSchema: leftSchema,
+      RightSchema: rightSchema,
+      // so the hash table is built on the smaller side
+      LeftRows: int(j.Left.estimated().rows),
+      RightRows: int(j.Right.estimated().rows),
+      Residual: j.Residual,
+      MemoryBudget: j.MemoryBudget,
+      TempDir: j.TempDir,
+      BatchSize: j.BatchSize,
+    }).Run(output)
+  case MergeJoinMethod:
+    return (&MergeJoin{
+      Type: j.Type,
+      Left: j.Left.Run,
+      Right: j.Right.Run,
+      LeftKey: j.LeftKey,
+      RightKey: j.RightKey,
+      LeftSchema: leftSchema,
+      RightSchema: rightSchema,
+      Residual: j.Residual,
+      BatchSize: j.BatchSize,
+    }).Run(output)
+  default:
+    return errors.New("unknown join method")
+  }
+}
+
+func (j *JoinPlan) describe() string {
+  leftColumns, rightColumns := j.Left.Columns(), j.Right.Columns()
+  conditions := make([]string, 0, len(j.LeftKey))
+  for i := range j.LeftKey {
+    conditions = append(conditions, leftColumns[j.LeftKey[i]].Name+" = "+rightColumns[j.RightKey[i]].Name)
+  }
+  description := fmt.Sprintf("%s %s join", j.Method, j.Type)
+  if len(conditions) > 0 {
+    description += " on " + strings.Join(conditions, " and ")
+  }
+  if j.Method == IndexNestedLoopMethod {
+    description += " using " + j.Index.Name()
+  }
+  return description
+}
+
+func (j *JoinPlan) inputs() []Plan {
+  return []Plan{j.Left, j.Right}
+}
+
+// Plans joining left and right on leftColumns[i] = rightColumns[i] for every
+// i. A merge join is used if both sides already come out sorted on the join
+// key, otherwise an index nested loop join if right is a table with an index
+// on the join key, otherwise a hash join.
+func PlanJoin(
+  joinType JoinType,
+  left Plan,
+  right Plan,
+  leftColumns []string,
+  rightColumns []string,
+  residual func(left Row, right Row) bool,
+) (*JoinPlan, error) {
+  joins, err := joinMethods(joinType, left, right, leftColumns, rightColumns, residual)
+  if err != nil {
+    return nil, err
+  }
+  return joins[0], nil
+}
+
+// A plan for every method that can join left and right, in the order
+// PlanJoin prefers them. The last one is always a hash join.
+func joinMethods(
+  joinType JoinType,
+  left Plan,
+  right Plan,
+  leftColumns []string,
+  rightColumns []string,
+  residual func(left Row, right Row) bool,
+) ([]*JoinPlan, error) {
+  if len(leftColumns) != len(rightColumns) {
+    return nil, errors.New("join key lengths differ")
+  }
+  leftKey, err := resolveColumns(left.Columns(), leftColumns)
+  if err != nil {
+    return nil, err
+  }
+  rightKey, err := resolveColumns(right.Columns(), rightColumns)
+  if err != nil {
+    return nil, err
+  }
+  leftTypes, rightTypes := left.Columns(), right.Columns()
+  for i := range leftKey {
+    if leftTypes[leftKey[i]].ColumnType != rightTypes[rightKey[i]].ColumnType {
+      return nil, fmt.Errorf("can not join %s with %s of a different type", leftColumns[i], rightColumns[i])
+    }
+  }
+  joins := make([]*JoinPlan, 0, 3)
+  if permutation := orderedKey(left.Ordering(), leftKey, right.Ordering(), rightKey); permutation != nil {
+    joins = append(joins, &JoinPlan{
+      Method: MergeJoinMethod,
+      LeftKey: permute(leftKey, permutation),
+      RightKey: permute(rightKey, permutation),
+    })
+  }
+  if index, permutation := lookupIndex(joinType, right, rightKey); index != nil {
+    joins = append(joins, &JoinPlan{
+      Method: IndexNestedLoopMethod,
+      Index: index,
+      LeftKey: permute(leftKey, permutation),
+      RightKey: permute(rightKey, permutation),
+    })
+  }
+  joins = append(joins, &JoinPlan{Method: HashJoinMethod, LeftKey: leftKey, RightKey: rightKey})
+  for _, join := range joins {
+    join.Type, join.Left, join.Right, join.Residual = joinType, left, right, residual
+  }
+  return joins, nil
+}
+
+// If the leading columns of both orderings are the join key, in the same
+// order on both sides, the order of the key pairs that follows it.
+// Otherwise nil.
+func orderedKey(leftOrdering []int, leftKey []int, rightOrdering []int, rightKey []int) []int {
+  if len(leftKey) == 0 || len(leftOrdering) < len(leftKey) || len(rightOrdering) < len(rightKey) {
+    return nil
+  }
+  permutation := make([]int, 0, len(leftKey))
+  for i := range leftKey {
+    pair := -1
+    for k, position := range leftKey {
+      if position == leftOrdering[i] && rightKey[k] == rightOrdering[i] {
+        pair = k
+      }
+    }
+    if pair < 0 {
+      return nil
+    }
+    permutation = append(permutation, pair)
+  }
+  return permutation
+}
+
+// An index of the table right scans whose leading columns are the join key,
+// and the order of the key pairs that follows it.
+func lookupIndex(joinType JoinType, right Plan, rightKey []int) (*Index, []int) {
+  scan, ok := right.(*ScanPlan)
+  if !ok || !scan.isFull() || (joinType != InnerJoin && joinType != LeftOuterJoin) {
+    return nil, nil
+  }
+  for _, index := range append([]*Index{scan.Table.PrimaryIndex()}, scan.Table.Indices()...) {
+    if index.partial() {
+      // lookups could miss rows that aren't in it
+      continue
+    }
+    ordering := IndexScan(scan.Table, index).Ordering()
+    if permutation := orderedKey(ordering, rightKey, ordering, rightKey); permutation != nil {
+      return index, permutation
+    }
+  }
+  return nil, nil
+}
+
+func permute(key []int, permutation []int) []int {
+  permuted := make([]int, 0, len(key))
+  for _, i := range permutation {
+    permuted = append(permuted, key[i])
+  }
+  return permuted
+}
+
+// Aggregate of a column named like in Plan.Columns, for planning.
+type AggregateColumn struct {
+  Func AggregateFunc
+  // empty for COUNT(*)
+  Column string
+  Distinct bool
+}
+
+func (a AggregateColumn) String() string {
+  column := a.Column
+  if column == "" {
+    column = "*"
+  }
+  if a.Distinct {
+    column = "distinct " + column
+  }
+  return fmt.Sprintf("%s(%s)", a.Func, column)
+}
+
+// Groups and aggregates the rows of Input, see HashAggregate and
+// StreamAggregate.
+type AggregatePlan struct {
+  // Input comes grouped by GroupBy, so StreamAggregate can be used
+  Streaming bool
+  Input Plan
+  GroupBy []int
+  Aggregates []Aggregate
+  Having func(Row) bool
+  BatchSize int
+  columns []Column
+  planEstimate
+}
+
+// Plans grouping input by the groupBy columns and computing aggregates for
+// each group, keeping groups that pass having. Output columns are the groupBy
+// columns followed by one per aggregate, named like "count(users.id)". Input
+// that already comes grouped, such as a scan of an index that starts with the
+// groupBy columns, is aggregated as it streams by, otherwise in a hash table.
+func PlanAggregate(input Plan, groupBy []string, aggregates []AggregateColumn, having func(Row) bool) (*AggregatePlan, error) {
+  inputColumns := input.Columns()
+  positions, err := resolveColumns(inputColumns, groupBy)
+  if err != nil {
+    return nil, err
+  }
+  plan := &AggregatePlan{Input: input, GroupBy: positions, Having: having}
+  for _, position := range positions {
+    plan.columns = append(plan.columns, inputColumns[position])
+  }
+  for _, aggregate := range aggregates {
+    position := -1
+    columnType := INT
+    if aggregate.Column != "" {
+      if position, err = resolveColumn(inputColumns, aggregate.Column); err != nil {
+        return nil, err
+      }
+      aggregate.Column = inputColumns[position].Name
+      if aggregate.Func == Min || aggregate.Func == Max {
+        columnType = inputColumns[position].ColumnType
+      } else if aggregate.Func != Count && inputColumns[position].ColumnType != INT {
+        return nil, fmt.Errorf("can not %s %s, it is not an INT", aggregate.Func, aggregate.Column)
+      }
+    } else if aggregate.Func != Count {
+      return nil, fmt.Errorf("%s needs a column", aggregate.Func)
+    }
+    plan.Aggregates = append(plan.Aggregates, Aggregate{Func: aggregate.Func, Column: position, Distinct: aggregate.Distinct})
+    plan.columns = append(plan.columns, Column{Name: aggregate.String(), ColumnType: columnType})
+  }
+  if err := validateAggregates(plan.GroupBy, plan.Aggregates); err != nil {
+    return nil, err
+  }
+  plan.Streaming = groupedBy(input.Ordering(), positions)
+  return plan, nil
+}
+
+// whether rows in ordering come grouped by the groupBy columns, which they do
+// if ordering starts with all of them, in any order
+func groupedBy(ordering []int, groupBy []int) bool {
+  if len(ordering) < len(groupBy) {
+    return false
+  }
+  for _, position := range groupBy {
+    found := false
+    for _, ordered := range ordering[:len(groupBy)] {
+      found = found || ordered == position
+    }
+    if !found {
+      return false
+    }
+  }
+  return true
+}
+
+func (a *AggregatePlan) Columns() []Column {
+  return append([]Column{}, a.columns...)
+}
+
+// groups of streamed input come out in the order of the input
+func (a *AggregatePlan) Ordering() []int {
+  if !a.Streaming {
+    return nil
+  }
+  inputOrdering := a.Input.Ordering()
+  ordering := make([]int, 0, len(a.GroupBy))
+  for _, position := range inputOrdering[:len(a.GroupBy)] {
+    for k, grouped := range a.GroupBy {
+      if grouped == position {
+        ordering = append(ordering, k)
+        break
+      }
+    }
+  }
+  return ordering
+}
+
+func (a *AggregatePlan) Run(output chan<- []Row) error {
+  if a.Streaming {
+    return (&StreamAggregate{
+      Input: a.Input.Run,
+      GroupBy: a.GroupBy,
+      Aggregates: a.Aggregates,
+      Having: a.Having,
+      BatchSize: a.BatchSize,
+    }).Run(output)
+  }
+  return (&HashAggregate{
+    Input: a.Input.Run,
+    GroupBy: a.GroupBy,
+    Aggregates: a.Aggregates,
+    Having: a.Having,
+    BatchSize: a.BatchSize,
+  }).Run(output)
+}
+
+func (a *AggregatePlan) describe() string {
+  description := "hash aggregate"
+  if a.Streaming {
+    description = "stream aggregate"
+  }
+  names := make([]string, 0, len(a.columns))
+  for _, col := range a.columns {
+    names = append(names, col.Name)
+  }
+  if len(a.GroupBy) > 0 {
+    description += " group by " + strings.Join(names[:len(a.GroupBy)], ", ")
+  }
+  if len(a.Aggregates) > 0 {
+    description += " computing " + strings.Join(names[len(a.GroupBy):], ", ")
+  }
+  if a.Having != nil {
+    description += " having a condition"
+  }
+  return description
+}
+
+func (a *AggregatePlan) inputs() []Plan {
+  return []Plan{a.Input}
+}
+
+// Column named like in Plan.Columns to order by, for planning.
+type OrderColumn struct {
+  Column string
+  Descending bool
+  Nulls NullOrder
+}
+
+// Sorts the rows of Input, see Sort.
+type SortPlan struct {
+  Input Plan
+  Keys []SortKey
+  Limit Limit
+  MemoryBudget int64
+  TempDir string
+  BatchSize int
+  planEstimate
+}
+
+func (s *SortPlan) Columns() []Column {
+  return s.Input.Columns()
+}
+
+// the leading keys that sort like Plan.Ordering
+func (s *SortPlan) Ordering() []int {
+  ordering := make([]int, 0, len(s.Keys))
+  for _, key := range s.Keys {
+    if key.Descending || key.Nulls == NullsFirst {
+      break
+    }
+    ordering = append(ordering, key.Column)
+  }
+  return ordering
+}
+
+func (s *SortPlan) Run(output chan<- []Row) error {
+  return (&Sort{
+    Input: s.Input.Run,
+    Keys: s.Keys,
+    Limit: s.Limit,
+    MemoryBudget: s.MemoryBudget,
+    TempDir: s.TempDir,
+    BatchSize: s.BatchSize,
+  }).Run(output)
+}
+
+func (s *SortPlan) describe() string {
+  columns := s.Input.Columns()
+  keys := make([]string, 0, len(s.Keys))
+  for _, key := range s.Keys {
+    description := columns[key.Column].Name
+    if key.Descending {
+      description += " desc"
+    }
+    switch key.Nulls {
+    case NullsFirst:
+      description += " nulls first"
+    case NullsLast:
+      description += " nulls last"
+    }
+    keys = append(keys, description)
+  }
+  if s.Limit != NoLimit {
+    return fmt.Sprintf("top %d sort by %s", s.Limit, strings.Join(keys, ", "))
+  }
+  return "sort by " + strings.Join(keys, ", ")
+}
+
+func (s *SortPlan) inputs() []Plan {
+  return []Plan{s.Input}
+}
+
+// Keeps the first Limit rows of Input, after skipping the first Offset rows.
+type LimitPlan struct {
+  Input Plan
+  Limit Limit
+  Offset int
+  BatchSize int
+  planEstimate
+}
+
+func (l *LimitPlan) Columns() []Column {
+  return l.Input.Columns()
+}
+
+func (l *LimitPlan) Ordering() []int {
+  return l.Input.Ordering()
+}
+
+func (l *LimitPlan) Run(output chan<- []Row) error {
+  out := newBatcher(output, l.BatchSize)
+  remaining := l.Limit
+  skip := l.Offset
+  err := drain(l.Input.Run, func(batch []Row) error {
+    for _, row := range batch {
+      if skip > 0 {
+        skip--
+        continue
+      }
+      if remaining.usedUp() {
+        return nil
+      }
+      remaining.decrement()
+      out.add(row)
+    }
+    return nil
+  })
+  out.flush()
+  return err
+}
+
+func (l *LimitPlan) describe() string {
+  switch {
+  case l.Offset == 0:
+    return fmt.Sprintf("limit %d", l.Limit)
+  case l.Limit == NoLimit:
+    return fmt.Sprintf("offset %d", l.Offset)
+  }
+  return fmt.Sprintf("limit %d offset %d", l.Limit, l.Offset)
+}
+
+func (l *LimitPlan) inputs() []Plan {
+  return []Plan{l.Input}
+}
+
+// Plans ordering input by orderBy and keeping only its first limit rows, or
+// all of them for NoLimit. Input that already comes in that order is only
+// limited, otherwise it's sorted, keeping only the first rows in memory if
+// there's a limit.
+func PlanSort(input Plan, orderBy []OrderColumn, limit Limit) (Plan, error) {
+  columns := input.Columns()
+  keys := make([]SortKey, 0, len(orderBy))
+  for _, column := range orderBy {
+    position, err := resolveColumn(columns, column.Column)
+    if err != nil {
+      return nil, err
+    }
+    keys = append(keys, SortKey{Column: position, Descending: column.Descending, Nulls: column.Nulls})
+  }
+  if !orderedBy(input.Ordering(), keys) {
+    return &SortPlan{Input: input, Keys: keys, Limit: limit}, nil
+  }
+  if limit != NoLimit {
+    return &LimitPlan{Input: input, Limit: limit}, nil
+  }
+  return input, nil
+}
+
+// Plans skipping the first offset rows of input and keeping the first limit
+// of the rest, or all of them for NoLimit. A LimitPlan input, like PlanSort
+// makes, skips them itself.
+func PlanOffset(input Plan, offset int, limit Limit) Plan {
+  l, ok := input.(*LimitPlan)
+  if !ok || l.Offset > 0 {
+    return &LimitPlan{Input: input, Limit: limit, Offset: offset}
+  }
+  if l.Limit != NoLimit {
+    remaining := Limit(0)
+    if int(l.Limit) > offset {
+      remaining = l.Limit - Limit(offset)
+    }
+    limit = minLimit(limit, remaining)
+  }
+  return &LimitPlan{Input: l.Input, Limit: limit, Offset: offset}
+}
+
+// whether rows in ordering are sorted on keys. NULLs don't matter, as
+// ordered rows come from indices, which don't have any.
+func orderedBy(ordering []int, keys []SortKey) bool {
+  if len(ordering) < len(keys) {
+    return false
+  }
+  for i, key := range keys {
+    if key.Descending || ordering[i] != key.Column {
+      return false
+    }
+  }
+  return true
+}
+
+// Keeps the rows of Input that Condition is true for, see Filter.
+type FilterPlan struct {
+  Input Plan
+  Condition Expr
+  BatchSize int
+  filter func(Row) bool
+  planEstimate
+}
+
+// Plans keeping the rows of input that condition, a BOOL expression over its
+// columns, is true for.
+func PlanFilter(input Plan, condition Expr) (*FilterPlan, error) {
+  filter, err := CompileFilter(condition, input.Columns())
+  if err != nil {
+    return nil, err
+  }
+  return &FilterPlan{Input: input, Condition: condition, filter: filter}, nil
+}
+
+func (f *FilterPlan) Columns() []Column {
+  return f.Input.Columns()
+}
+
+func (f *FilterPlan) Ordering() []int {
+  return f.Input.Ordering()
+}
+
+func (f *FilterPlan) Run(output chan<- []Row) error {
+  return (&Filter{Input: f.Input.Run, Condition: f.filter, BatchSize: f.BatchSize}).Run(output)
+}
+
+func (f *FilterPlan) describe() string {
+  return "filter " + f.Condition.String()
+}
+
+func (f *FilterPlan) inputs() []Plan {
+  return []Plan{f.Input}
+}
+
+// Expression to output as a column, named Name, or after the expression if
+// Name is empty.
+type SelectColumn struct {
+  Expr Expr
+  Name string
+}
+
+// Computes expressions over each row of Input, see Project.
+type ProjectPlan struct {
+  Input Plan
+  Select []SelectColumn
+  BatchSize int
+  compiled []*CompiledExpr
+  planEstimate
+}
+
+// Plans computing the selected expressions, over the columns of input, for
+// each of its rows.
+func PlanProject(input Plan, selected []SelectColumn) (*ProjectPlan, error) {
+  if len(selected) == 0 {
+    return nil, errors.New("nothing selected")
+  }
+  plan := &ProjectPlan{Input: input, Select: selected}
+  columns := input.Columns()
+  for _, column := range selected {
+    compiled, err := Compile(column.Expr, columns)
+    if err != nil {
+      return nil, err
+    }
+    plan.compiled = append(plan.compiled, compiled)
+  }
+  return plan, nil
+}
+
+// Selected column references keep their names, others are named after the
+// expression.
+func (p *ProjectPlan) Columns() []Column {
+  inputColumns := p.Input.Columns()
+  columns := make([]Column, 0, len(p.Select))
+  for i, column := range p.Select {
+    name := column.Name
+    if name == "" {
+      name = column.Expr.String()
+      if ref, ok := column.Expr.(columnRef); ok {
+        // resolving can't fail, the expression compiled
+        position, _ := resolveColumn(inputColumns, ref.name)
+        name = inputColumns[position].Name
+      }
+    }
+    columns = append(columns, Column{Name: name, ColumnType: p.compiled[i].Type})
+  }
+  return columns
+}
+
+// the input ordering, for as long as its columns are selected as they are
+func (p *ProjectPlan) Ordering() []int {
+  inputColumns := p.Input.Columns()
+  ordering := make([]int, 0)
+  for _, position := range p.Input.Ordering() {
+    found := -1
+    for i, column := range p.Select {
+      if ref, ok := column.Expr.(columnRef); ok {
+        if refPosition, _ := resolveColumn(inputColumns, ref.name); refPosition == position {
+          found = i
+          break
+        }
+      }
+    }
+    if found < 0 {
+      break
+    }
+    ordering = append(ordering, found)
+  }
+  return ordering
+}
+
+func (p *ProjectPlan) Run(output chan<- []Row) error {
+  return (&Project{Input: p.Input.Run, Exprs: p.compiled, BatchSize: p.BatchSize}).Run(output)
+}
+
+func (p *ProjectPlan) describe() string {
+  expressions := make([]string, 0, len(p.Select))
+  for _, column := range p.Select {
+    description := column.Expr.String()
+    if column.Name != "" {
+      description += " as " + column.Name
+    }
+    expressions = append(expressions, description)
+  }
+  return "project " + strings.Join(expressions, ", ")
+}
+
+func (p *ProjectPlan) inputs() []Plan {
+  return []Plan{p.Input}
+}
@@ -0,0 +1,101 @@
+package sql_planner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// users and pets registered in a database, so their columns are qualified
+func createJoinDatabase(t *testing.T) (*Table, *Table) {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", userSchema, []string{"id", "isActive", "email"})
+  require.NoError(t, err)
+  require.NoError(t, users.BatchInsert([]Row{doodle, toto, momo}))
+  pets, err := db.CreateTable("pets", []Column{
+    {Name: "name", ColumnType: STRING},
+    {Name: "ownerId", ColumnType: INT},
+    {Name: "species", ColumnType: STRING},
+  }, []string{"name"})
+  require.NoError(t, err)
+  require.NoError(t, pets.BatchInsert([]Row{pusheen, stormy, rex, stray}))
+  _, err = db.CreateIndex("pets_owner", "pets", []string{"ownerId"})
+  require.NoError(t, err)
+  return users, pets
+}
+
+func TestPlanJoinMethod(t *testing.T) {
+  users, pets := createJoinDatabase(t)
+  petsByOwner := pets.Indices()[0]
+  expected := []Row{
+    joinRows(doodle, pusheen),
+    joinRows(doodle, stormy),
+    joinRows(toto, rex),
+  }
+
+  for _, test := range []struct {
+    left Plan
+    right Plan
+    joinType JoinType
+    method JoinMethod
+  }{
+    // both come out ordered by id and ownerId
+    {FullScan(users), IndexScan(pets, petsByOwner), InnerJoin, MergeJoinMethod},
+    // pets can be looked up by ownerId
+    {FullScan(users), FullScan(pets), InnerJoin, IndexNestedLoopMethod},
+    // right joins can't look up the right side
+    {FullScan(users), FullScan(pets), RightOuterJoin, HashJoinMethod},
+  } {
+    join, err := PlanJoin(test.joinType, test.left, test.right, []string{"users.id"}, []string{"ownerId"}, nil)
+    require.NoError(t, err)
+    require.Equal(t, test.method, join.Method)
+
+    rows, err := collectRows(join.Run)
+    require.NoError(t, err)
+    if test.joinType == RightOuterJoin {
+      require.ElementsMatch(t, append(expected, joinRows(Row{nil, nil, nil, nil}, stray)), rows)
+    } else {
+      require.ElementsMatch(t, expected, rows)
+    }
+  }
+
+  // the right side isn't sorted on the key and has no index on it
+  join, err := PlanJoin(InnerJoin, FullScan(pets), FullScan(users), []string{"species"}, []string{"email"}, nil)
+  require.NoError(t, err)
+  require.Equal(t, HashJoinMethod, join.Method)
+}
+
+func TestPlanJoinMultiColumnMerge(t *testing.T) {
+  users, _ := createJoinDatabase(t)
+  // the key is given in a different order from the primary index
+  join, err := PlanJoin(
+    InnerJoin, FullScan(users), FullScan(users),
+    []string{"users.isActive", "users.id"}, []string{"isActive", "id"}, nil,
+  )
+  require.NoError(t, err)
+  require.Equal(t, MergeJoinMethod, join.Method)
+  require.Equal(t, []int{2, 3}, join.LeftKey)
+  require.Equal(t, []int{2, 3}, join.RightKey)
+
+  rows, err := collectRows(join.Run)
+  require.NoError(t, err)
+  require.Equal(t, []Row{joinRows(doodle, doodle), joinRows(toto, toto), joinRows(momo, momo)}, rows)
+  require.Equal(t, []int{2, 3, 0, 1}, join.Ordering())
+}
+
+func TestPlanJoinInvalid(t *testing.T) {
+  users, pets := createJoinDatabase(t)
+  for _, columns := range [][2][]string{
+    {{"users.id"}, {"ownerId", "name"}},
+    {{"users.nope"}, {"ownerId"}},
+    {{"users.id"}, {"name"}},
+  } {
+    _, err := PlanJoin(InnerJoin, FullScan(users), FullScan(pets), columns[0], columns[1], nil)
+    require.Error(t, err)
+  }
+  // both users in the self join have an id column
+  self, err := PlanJoin(InnerJoin, FullScan(users), FullScan(users), []string{"id"}, []string{"id"}, nil)
+  require.NoError(t, err)
+  _, err = PlanJoin(InnerJoin, self, FullScan(pets), []string{"id"}, []string{"ownerId"}, nil)
+  require.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package sql_planner
+
+// Outputs, for each input row, the values of Exprs compiled against the input
+// columns. An expression that fails on a row fails the whole projection.
+type Project struct {
+  Input RowSource
+  Exprs []*CompiledExpr
+  BatchSize int
+}
+
+func (p *Project) Run(output chan<- []Row) error {
+  out := newBatcher(output, p.BatchSize)
+  err := drain(p.Input, func(batch []Row) error {
+    for _, row := range batch {
+      projected := make(Row, 0, len(p.Exprs))
+      for _, e := range p.Exprs {
+        f, err := e.Eval(row)
+        if err != nil {
+          return err
+        }
+        projected = append(projected, f)
+      }
+      out.add(projected)
+    }
+    return nil
+  })
+  out.flush()
+  return err
+}
+
+// Outputs the input rows Condition holds for.
+type Filter struct {
+  Input RowSource
+  Condition func(Row) bool
+  BatchSize int
+}
+
+func (f *Filter) Run(output chan<- []Row) error {
+  out := newBatcher(output, f.BatchSize)
+  err := drain(f.Input, func(batch []Row) error {
+    for _, row := range batch {
+      if f.Condition(row) {
+        out.add(row)
+      }
+    }
+    return nil
+  })
+  out.flush()
+  return err
+}
@@ -0,0 +1,326 @@
+package sql_planner
+
+import (
+	"math"
+	"sort"
+)
+
+// Values of a column from lower to upper. A nil bound leaves that side open.
+type valueRange struct {
+  lower Field
+  upper Field
+  lowerInclusive bool
+  upperInclusive bool
+}
+
+// ranges of values on one column past which a scan would make too many seeks,
+// and only reads the range around them all
+const maxKeyRanges = 1000
+
+// the values filter passes, false for NotEqual, which passes two ranges
+func filterRange(filter ColumnFilter) (valueRange, bool) {
+  v := filter.Value
+  switch filter.Op {
+  case Equal:
+    return valueRange{lower: v, upper: v, lowerInclusive: true, upperInclusive: true}, true
+  case Less:
+    return valueRange{upper: v}, true
+  case LessOrEqual:
+    return valueRange{upper: v, upperInclusive: true}, true
+  case Greater:
+    return valueRange{lower: v}, true
+  case GreaterOrEqual:
+    return valueRange{lower: v, lowerInclusive: true}, true
+  }
+  return valueRange{}, false
+}
+
+// whether r is a single value
+func (r valueRange) point() bool {
+  return r.lower != nil && r.upper != nil && r.lower.equals(r.upper) && r.lowerInclusive && r.upperInclusive
+}
+
+// whether no value is in r
+func (r valueRange) empty() bool {
+  if r.lower == nil || r.upper == nil {
+    return false
+  }
+  return r.upper.lessThan(r.lower) || (r.lower.equals(r.upper) && !(r.lowerInclusive && r.upperInclusive))
+}
+
+// the values in both r and other
+func (r valueRange) intersect(other valueRange) valueRange {
+  if other.lower != nil && (r.lower == nil || r.lower.lessThan(other.lower) || (r.lower.equals(other.lower) && !other.lowerInclusive)) {
+    r.lower, r.lowerInclusive = other.lower, other.lowerInclusive
+  }
+  if other.upper != nil && (r.upper == nil || other.upper.lessThan(r.upper) || (r.upper.equals(other.upper) && !other.upperInclusive)) {
+    r.upper, r.upperInclusive = other.upper, other.upperInclusive
+  }
+  return r
+}
+
+// whether r starts before other
+func (r valueRange) startsBefore(other valueRange) bool {
+  if r.lower == nil || other.lower == nil {
+    return r.lower == nil && other.lower != nil
+  }
+  if r.lower.equals(other.lower) {
+    return r.lowerInclusive && !other.lowerInclusive
+  }
+  return r.lower.lessThan(other.lower)
+}
+
+// Whether other, which doesn't start before r, starts within r or right where
+// it ends, so that together they're one range.
+func (r valueRange) joins(other valueRange) bool {
+  if r.upper == nil || other.lower == nil {
+    return true
+  }
+  if r.upper.equals(other.lower) {
+    return r.upperInclusive || other.lowerInclusive
+  }
+  return other.lower.lessThan(r.upper)
+}
+
+// r extended to the end of other, if other ends after it
+func (r valueRange) extend(other valueRange) valueRange {
+  if r.upper == nil {
+    return r
+  }
+  if other.upper == nil || r.upper.lessThan(other.upper) || (r.upper.equals(other.upper) && other.upperInclusive) {
+    r.upper, r.upperInclusive = other.upper, other.upperInclusive
+  }
+  return r
+}
+
+// The rows of an index that start with prefix, followed by a value in r.
+func (r valueRange) keyRange(prefix Row) KeyRange {
+  key := func(v Field) Row {
+    return append(append(Row{}, prefix...), v)
+  }
+  var lower, upper RowBound = InclusiveBound(prefix), ExclusiveBound(prefix)
+  if len(prefix) == 0 {
+    lower, upper = NegativeInfinity{}, Infinity{}
+  }
+  if r.lower != nil {
+    if r.lowerInclusive {
+      lower = InclusiveBound(key(r.lower))
+    } else {
+      lower = ExclusiveBound(key(r.lower))
+    }
+  }
+  if r.upper != nil {
+    if r.upperInclusive {
+      upper = ExclusiveBound(key(r.upper))
+    } else {
+      upper = InclusiveBound(key(r.upper))
+    }
+  }
+  return KeyRange{LowerBound: lower, UpperBound: upper}
+}
+
+// ranges sorted, without empty ones, and with ones that overlap or touch made
+// into one
+func mergeRanges(ranges []valueRange) []valueRange {
+  sorted := make([]valueRange, 0, len(ranges))
+  for _, r := range ranges {
+    if !r.empty() {
+      sorted = append(sorted, r)
+    }
+  }
+  sort.Slice(sorted, func(a, b int) bool { return sorted[a].startsBefore(sorted[b]) })
+  merged := make([]valueRange, 0, len(sorted))
+  for _, r := range sorted {
+    if last := len(merged) - 1; last >= 0 && merged[last].joins(r) {
+      merged[last] = merged[last].extend(r)
+      continue
+    }
+    merged = append(merged, r)
+  }
+  return merged
+}
+
+// the values in both a and b
+func intersectRanges(a []valueRange, b []valueRange) []valueRange {
+  both := make([]valueRange, 0, len(a)*len(b))
+  for _, r := range a {
+    for _, other := range b {
+      both = append(both, r.intersect(other))
+    }
+  }
+  return mergeRanges(both)
+}
+
+// Values of a column of one table the query keeps rows for, and the fraction
+// of the rows that have them.
+type columnRanges struct {
+  column string
+  ranges []valueRange
+  selectivity float64
+  // positions in the table's filters these came from
+  filters []int
+}
+
+func (c columnRanges) points() bool {
+  for _, r := range c.ranges {
+    if !r.point() {
+      return false
+    }
+  }
+  return true
+}
+
+// The condition as ranges of values of a column of table i, if it compares
+// the column to values: a comparison, or an OR of comparisons or ANDs of
+// them, like In makes.
+func (o *optimizer) conditionRanges(i int, condition Expr) (columnRanges, bool) {
+  column := ""
+  ranges := make([]valueRange, 0)
+  selectivity := 0.0
+  for _, disjunct := range disjuncts(condition) {
+    r, rSelectivity := valueRange{}, 1.0
+    for _, part := range conjuncts(disjunct) {
+      filter, ok := o.comparison(i, part)
+      if !ok || (column != "" && filter.Column != column) {
+        return columnRanges{}, false
+      }
+      column = filter.Column
+      filtered, ok := filterRange(filter)
+      if !ok {
+        return columnRanges{}, false
+      }
+      r = r.intersect(filtered)
+      rSelectivity *= o.filterSelectivity(i, filter)
+    }
+    ranges = append(ranges, r)
+    selectivity += rSelectivity
+  }
+  return columnRanges{column: column, ranges: mergeRanges(ranges), selectivity: math.Min(selectivity, 1)}, true
+}
+
+// The values of column of table i that filters and the query's conditions
+// keep, false if none of them compare it to values.
+func (o *optimizer) columnRange(i int, column string, filters []ColumnFilter) (columnRanges, bool) {
+  found := false
+  r := valueRange{}
+  result := columnRanges{column: column, selectivity: 1}
+  for k, filter := range filters {
+    if filtered, ok := filterRange(filter); ok && filter.Column == column {
+      found = true
+      r = r.intersect(filtered)
+      result.selectivity *= o.filterSelectivity(i, filter)
+      result.filters = append(result.filters, k)
+    }
+  }
+  result.ranges = mergeRanges([]valueRange{r})
+  for _, condition := range o.ranges[i] {
+    if condition.column == column {
+      found = true
+      result.ranges = intersectRanges(result.ranges, condition.ranges)
+      result.selectivity *= condition.selectivity
+    }
+  }
+  return result, found
+}
+
+// What a scan of an index reads for the filters and conditions of a table.
+type indexBounds struct {
+  ranges []KeyRange
+  // see QueryPredicate.Skip
+  skip int
+  // fraction of the index in the ranges
+  selectivity float64
+  // seeks into the index reading them takes
+  seeks float64
+  // check for the filters the ranges don't cover, nil if they cover them all
+  filter func(Row) bool
+}
+
+// Ranges of index from equality filters or IN lists on its leading columns,
+// followed by range filters on the next column. A query that doesn't limit
+// the first column but does limit the second may skip over the first, if that
+// costs less than reading all of it. The comparisons of expressions that
+// become bounds on columns the index computes are checked by the scan's
+// conditions either way.
+func (o *optimizer) bounds(i int, index *Index) indexBounds {
+  filters := append(append([]ColumnFilter{}, o.filters[i]...), o.keyFilters[i]...)
+  bounds := o.boundsFrom(i, index, filters, 0)
+  schema := index.Schema()
+  if _, ok := o.columnRange(i, schema[0].Name, filters); ok || len(schema) < 2 {
+    return bounds
+  }
+  if _, ok := o.columnRange(i, schema[1].Name, filters); !ok {
+    return bounds
+  }
+  skipped := o.boundsFrom(i, index, filters, 1)
+  // one more seek to find each distinct value of the first column
+  skipped.seeks = o.distinctValues(i, schema[0].Name) * (skipped.seeks + 1)
+  rows := o.rows(i)
+  if seekCost(rows)*skipped.seeks+rows*skipped.selectivity < seekCost(rows)*bounds.seeks+rows*bounds.selectivity {
+    return skipped
+  }
+  return bounds
+}
+
+// bounds on the columns of index from start on
+func (o *optimizer) boundsFrom(i int, index *Index, filters []ColumnFilter, start int) indexBounds {
+  table := o.tables[i]
+  used := make([]bool, len(filters))
+  schema := index.Schema()
+  bounds := indexBounds{skip: start, selectivity: 1}
+
+  prefixes := []Row{{}}
+  last := []valueRange{{}}
+  for position := start; position < len(schema); position++ {
+    r, ok := o.columnRange(i, schema[position].Name, filters)
+    if !ok {
+      break
+    }
+    for _, k := range r.filters {
+      used[k] = true
+    }
+    bounds.selectivity *= r.selectivity
+    if !r.points() || len(prefixes)*len(r.ranges) > maxKeyRanges {
+      last = r.ranges
+      break
+    }
+    extended := make([]Row, 0, len(prefixes)*len(r.ranges))
+    for _, prefix := range prefixes {
+      for _, value := range r.ranges {
+        extended = append(extended, append(append(Row{}, prefix...), value.lower))
+      }
+    }
+    prefixes = extended
+  }
+  for _, prefix := range prefixes {
+    for _, r := range last {
+      bounds.ranges = append(bounds.ranges, r.keyRange(prefix))
+    }
+  }
+  if len(bounds.ranges) == 0 {
+    // the filters contradict each other
+    bounds.ranges = []KeyRange{emptyRange}
+  }
+  bounds.seeks = float64(len(bounds.ranges))
+
+  rest := make([]ColumnFilter, 0)
+  positions := make([]int, 0)
+  tableSchema := table.Schema()
+  for k, filter := range filters[:len(o.filters[i])] {
+    if !used[k] {
+      rest = append(rest, filter)
+      positions = append(positions, columnPosition(tableSchema, filter.Column))
+    }
+  }
+  if len(rest) > 0 {
+    bounds.filter = func(row Row) bool {
+      for k, filter := range rest {
+        if !filter.Op.holds(row[positions[k]], filter.Value) {
+          return false
+        }
+      }
+      return true
+    }
+  }
+  return bounds
+}
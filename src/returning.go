@@ -0,0 +1,229 @@
+package sql_planner
+
+import (
+	"context"
+	"fmt"
+)
+
+// Images of a row a write returns, see Returning.
+type Image int
+
+const (
+  // the row as it was before the write, NULL for an inserted row
+  OldImage Image = 1 << iota
+  // the row as the write left it, NULL for a deleted row
+  NewImage
+)
+
+// Rows a write streams back for each row it changes, as SQL's RETURNING. Each
+// is the Columns of the old image followed by those of the new one, for the
+// images asked for.
+type Returning struct {
+  Images Image
+  // columns of each image, in order, nil for every column of the table
+  Columns []string
+}
+
+// Columns of the rows writes return for returning. With both images, columns
+// of the old one are named old.column and those of the new one new.column.
+func (t *Table) ReturningSchema(returning Returning) ([]Column, error) {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  positions, err := t.returningPositions(returning)
+  if err != nil {
+    return nil, err
+  }
+  schema := make([]Column, 0)
+  for _, image := range []Image{OldImage, NewImage} {
+    if returning.Images&image == 0 {
+      continue
+    }
+    for _, position := range positions {
+      col := t.schema[position]
+      if returning.Images == OldImage|NewImage && image == OldImage {
+        col.Name = "old." + col.Name
+      } else if returning.Images == OldImage|NewImage {
+        col.Name = "new." + col.Name
+      }
+      schema = append(schema, col)
+    }
+  }
+  return schema, nil
+}
+
+// positions in the table schema of the columns returning asks for
+func (t *Table) returningPositions(returning Returning) ([]int, error) {
+  if returning.Columns == nil {
+    positions := make([]int, len(t.schema))
+    for i := range positions {
+      positions[i] = i
+    }
+    return positions, nil
+  }
+  positions := make([]int, 0, len(returning.Columns))
+  for _, name := range returning.Columns {
+    position := columnPosition(t.schema, name)
+    if position < 0 {
+      return nil, fmt.Errorf("column %s does not exist", name)
+    }
+    positions = append(positions, position)
+  }
+  return positions, nil
+}
+
+// Regroups the rows a write changes into batches of what it returns, and
+// counts them.
+type returned struct {
+  ctx context.Context
+  output chan<- []Row
+  images Image
+  positions []int
+  batch []Row
+  count int
+}
+
+func (t *Table) newReturned(ctx context.Context, returning Returning, output chan<- []Row) (*returned, error) {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  positions, err := t.returningPositions(returning)
+  if err != nil {
+    return nil, err
+  }
+  return &returned{ctx: ctx, output: output, images: returning.Images, positions: positions}, nil
+}
+
+// adds a changed row, nil for the image a row that's inserted or deleted
+// doesn't have
+func (r *returned) add(old Row, new Row) error {
+  r.count++
+  if r.output == nil {
+    return nil
+  }
+  row := make(Row, 0, 2*len(r.positions))
+  if r.images&OldImage != 0 {
+    row = r.project(row, old)
+  }
+  if r.images&NewImage != 0 {
+    row = r.project(row, new)
+  }
+  r.batch = append(r.batch, row)
+  if len(r.batch) >= DefaultBatchSize {
+    return r.flush()
+  }
+  return nil
+}
+
+// row followed by the returned columns of image
+func (r *returned) project(row Row, image Row) Row {
+  for _, position := range r.positions {
+    if image == nil {
+      row = append(row, nil)
+    } else {
+      row = append(row, image[position])
+    }
+  }
+  return row
+}
+
+func (r *returned) flush() error {
+  if r.output == nil || len(r.batch) == 0 {
+    return nil
+  }
+  select {
+  case r.output <- r.batch:
+    r.batch = nil
+    return nil
+  case <-r.ctx.Done():
+    return r.ctx.Err()
+  }
+}
+
+// Sends the rows added since the last batch, so those changed before err are
+// returned too, and returns the count and err, or the error sending them.
+func (r *returned) finish(err error) (int, error) {
+  if flushErr := r.flush(); err == nil {
+    err = flushErr
+  }
+  return r.count, err
+}
+
+// Like BatchInsert, but returns the number of rows inserted, and sends output
+// what returning asks for of each, unless output is nil. Rows the table
+// already has aren't inserted again.
+func (t *Table) BatchInsertReturning(ctx context.Context, rows []Row, returning Returning, output chan<- []Row) (int, error) {
+  changed, err := t.newReturned(ctx, returning, output)
+  if err != nil {
+    return 0, err
+  }
+  for _, row := range rows {
+    if err := ctx.Err(); err != nil {
+      return changed.finish(err)
+    }
+    inserted, err := t.insertRow(row)
+    if err != nil {
+      return changed.finish(err)
+    }
+    if inserted != nil {
+      if err := changed.add(nil, inserted); err != nil {
+        return changed.count, err
+      }
+    }
+  }
+  return changed.finish(nil)
+}
+
+// Like UpdateContext, but returns the number of rows updated, and sends
+// output what returning asks for of each, unless output is nil.
+func (t *Table) UpdateReturning(ctx context.Context, index *Index, pred QueryPredicate, vals map[Column]Field, returning Returning, output chan<- []Row) (int, error) {
+  changed, err := t.newReturned(ctx, returning, output)
+  if err != nil {
+    return 0, err
+  }
+  rows, err := t.targetRows(ctx, index, pred)
+  if err != nil {
+    return 0, err
+  }
+  for _, row := range rows {
+    if err := ctx.Err(); err != nil {
+      return changed.finish(err)
+    }
+    newRow, err := t.updateRow(row, vals)
+    if err != nil {
+      return changed.finish(err)
+    }
+    if newRow != nil {
+      if err := changed.add(row, newRow); err != nil {
+        return changed.count, err
+      }
+    }
+  }
+  return changed.finish(nil)
+}
+
+// Like DeleteContext, but returns the number of rows deleted, and sends output
+// what returning asks for of each, unless output is nil.
+func (t *Table) DeleteReturning(ctx context.Context, index *Index, prefix Row, returning Returning, output chan<- []Row) (int, error) {
+  changed, err := t.newReturned(ctx, returning, output)
+  if err != nil {
+    return 0, err
+  }
+  rows, err := t.targetRows(ctx, index, QueryPredicate{
+    UpperBound: ExclusiveBound(prefix),
+    LowerBound: InclusiveBound(prefix),
+    Limit:      NoLimit,
+  })
+  if err != nil {
+    return 0, err
+  }
+  for _, row := range rows {
+    if err := ctx.Err(); err != nil {
+      return changed.finish(err)
+    }
+    if t.deleteRow(row) {
+      if err := changed.add(row, nil); err != nil {
+        return changed.count, err
+      }
+    }
+  }
+  return changed.finish(nil)
+}
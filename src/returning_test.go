@@ -0,0 +1,104 @@
+package sql_planner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateReturning(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 8)
+  ctx := context.Background()
+  returning := Returning{Images: OldImage | NewImage, Columns: []string{"id", "age"}}
+  schema, err := table.ReturningSchema(returning)
+  require.NoError(t, err)
+  require.Equal(t, []Column{
+    {Name: "old.id", ColumnType: INT},
+    {Name: "old.age", ColumnType: INT},
+    {Name: "new.id", ColumnType: INT},
+    {Name: "new.age", ColumnType: INT},
+  }, schema)
+
+  var count int
+  changed, err := collectRows(func(output chan<- []Row) error {
+    count, err = table.UpdateReturning(ctx, table.indices[0], QueryPredicate{
+      LowerBound: InclusiveBound(Row{StringField("toto@sheen.com")}),
+      UpperBound: ExclusiveBound(Row{StringField("toto@sheen.com")}),
+      Limit: NoLimit,
+    }, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(30)}, returning, output)
+    return err
+  })
+  require.NoError(t, err)
+  require.Equal(t, 4, count)
+  require.ElementsMatch(t, []Row{
+    {IntField(2), IntField(21), IntField(2), IntField(30)},
+    {IntField(2), IntField(1), IntField(2), IntField(30)},
+    {IntField(12), IntField(21), IntField(12), IntField(30)},
+    {IntField(12), IntField(1), IntField(12), IntField(30)},
+  }, changed)
+
+  // without output, the rows are only counted
+  count, err = table.UpdateReturning(ctx, table.primaryIndex, QueryPredicate{
+    LowerBound: InclusiveBound(Row{IntField(1)}),
+    UpperBound: ExclusiveBound(Row{IntField(1)}),
+    Limit: NoLimit,
+  }, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(4)}, Returning{}, nil)
+  require.NoError(t, err)
+  require.Equal(t, 1, count)
+
+  // the new image of a deleted row is NULL
+  changed, err = collectRows(func(output chan<- []Row) error {
+    count, err = table.DeleteReturning(ctx, table.primaryIndex, Row{IntField(1)}, Returning{Images: OldImage | NewImage, Columns: []string{"email"}}, output)
+    return err
+  })
+  require.NoError(t, err)
+  require.Equal(t, 1, count)
+  require.Equal(t, []Row{{StringField("doodle@sheen.com"), nil}}, changed)
+  changed, err = collectRows(func(output chan<- []Row) error {
+    count, err = table.DeleteReturning(ctx, table.primaryIndex, Row{IntField(1)}, Returning{Images: OldImage}, output)
+    return err
+  })
+  require.NoError(t, err)
+  require.Equal(t, 0, count)
+  require.Empty(t, changed)
+
+  _, err = table.ReturningSchema(Returning{Images: NewImage, Columns: []string{"height"}})
+  require.Error(t, err)
+  _, err = table.DeleteReturning(ctx, table.primaryIndex, Row{IntField(8)}, Returning{Images: OldImage, Columns: []string{"height"}}, nil)
+  require.Error(t, err)
+  require.Len(t, table.ListWithIndex(table.primaryIndex, Row{IntField(8)}), 1)
+}
+
+func TestBatchInsertReturning(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 2)
+  newRows := []Row{
+    {StringField("momo@sheen.com"), IntField(2), IntField(3), BoolField(true)},
+    rows[0],
+    {StringField("nana@sheen.com"), IntField(4), IntField(5), BoolField(true)},
+  }
+  var count int
+  var err error
+  inserted, err := collectRows(func(output chan<- []Row) error {
+    count, err = table.BatchInsertReturning(context.Background(), newRows, Returning{Images: NewImage, Columns: []string{"email"}}, output)
+    return err
+  })
+  require.NoError(t, err)
+  // the table already has the second row
+  require.Equal(t, 2, count)
+  require.Equal(t, []Row{{StringField("momo@sheen.com")}, {StringField("nana@sheen.com")}}, inserted)
+
+  // rows inserted before an error are still returned
+  inserted, err = collectRows(func(output chan<- []Row) error {
+    count, err = table.BatchInsertReturning(context.Background(), []Row{
+      {StringField("lulu@sheen.com"), IntField(2), IntField(6), BoolField(true)},
+      {StringField("lulu@sheen.com"), IntField(2), IntField(6)},
+    }, Returning{Images: OldImage | NewImage, Columns: []string{"id"}}, output)
+    return err
+  })
+  require.ErrorIs(t, err, ErrSchemaMismatch)
+  require.Equal(t, 1, count)
+  require.Equal(t, []Row{{nil, IntField(6)}}, inserted)
+}
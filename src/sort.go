@@ -0,0 +1,324 @@
+package sql_planner
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+)
+
+type NullOrder int
+
+const (
+  // NULLs sort after every value for ascending keys and before them for
+  // descending ones, as if NULL were the largest value
+  NullsDefault NullOrder = iota
+  NullsFirst
+  NullsLast
+)
+
+type SortKey struct {
+  // position of the column in input rows
+  Column int
+  Descending bool
+  Nulls NullOrder
+}
+
+func (k SortKey) nullsFirst() bool {
+  return k.Nulls == NullsFirst || (k.Nulls == NullsDefault && k.Descending)
+}
+
+// sorted runs merged at once, more are merged in several passes
+const mergeFanIn = 64
+
+// -1, 0 or 1 as a sorts before, with or after b on keys
+func compareRows(a Row, b Row, keys []SortKey) int {
+  for _, key := range keys {
+    fa, fb := a[key.Column], b[key.Column]
+    if fa == nil || fb == nil {
+      if fa == nil && fb == nil {
+        continue
+      }
+      if (fa == nil) == key.nullsFirst() {
+        return -1
+      }
+      return 1
+    }
+    c := 0
+    if fa.lessThan(fb) {
+      c = -1
+    } else if !fa.equals(fb) {
+      c = 1
+    }
+    if key.Descending {
+      c = -c
+    }
+    if c != 0 {
+      return c
+    }
+  }
+  return 0
+}
+
+// Sorts its input on Keys, keeping rows with equal keys in input order.
+// Rows are sorted in memory until they take up MemoryBudget, then each
+// sorted run is spilled to a file in TempDir, and the runs are merged.
+type Sort struct {
+  Input RowSource
+  Keys []SortKey
+  // Only the first Limit rows are output, NoLimit for all of them. With a
+  // limit, only that many rows are held, in a heap, and nothing is spilled.
+  Limit Limit
+  // bytes of rows to hold in memory, DefaultMemoryBudget if 0
+  MemoryBudget int64
+  TempDir string
+  BatchSize int
+}
+
+func (s *Sort) validate() error {
+  for _, key := range s.Keys {
+    if key.Column < 0 {
+      return errors.New("sort column out of range")
+    }
+  }
+  return nil
+}
+
+// checks that row has every sort column
+func (s *Sort) checkRow(row Row) error {
+  for _, key := range s.Keys {
+    if key.Column >= len(row) {
+      return errors.New("sort column out of range")
+    }
+  }
+  return nil
+}
+
+func (s *Sort) Run(output chan<- []Row) error {
+  if err := s.validate(); err != nil {
+    return err
+  }
+  out := newBatcher(output, s.BatchSize)
+  var err error
+  if s.Limit != NoLimit {
+    err = s.topN(out)
+  } else {
+    err = s.external(out)
+  }
+  out.flush()
+  return err
+}
+
+// a row with its position in the input, so sorting can be stable
+type sortEntry struct {
+  row Row
+  sequence int
+}
+
+func (s *Sort) less(a sortEntry, b sortEntry) bool {
+  if c := compareRows(a.row, b.row, s.Keys); c != 0 {
+    return c < 0
+  }
+  return a.sequence < b.sequence
+}
+
+// heap of the rows kept so far, the last one in sort order on top
+type topNHeap struct {
+  sort *Sort
+  entries []sortEntry
+}
+
+func (h *topNHeap) Len() int { return len(h.entries) }
+func (h *topNHeap) Less(i, j int) bool { return h.sort.less(h.entries[j], h.entries[i]) }
+func (h *topNHeap) Swap(i, j int) { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *topNHeap) Push(x interface{}) { h.entries = append(h.entries, x.(sortEntry)) }
+func (h *topNHeap) Pop() interface{} {
+  last := h.entries[len(h.entries)-1]
+  h.entries = h.entries[:len(h.entries)-1]
+  return last
+}
+
+func (s *Sort) topN(out *batcher) error {
+  h := &topNHeap{sort: s}
+  sequence := 0
+  err := drain(s.Input, func(batch []Row) error {
+    for _, row := range batch {
+      if err := s.checkRow(row); err != nil {
+        return err
+      }
+      entry := sortEntry{row: row, sequence: sequence}
+      sequence++
+      if h.Len() < int(s.Limit) {
+        heap.Push(h, entry)
+      } else if h.Len() > 0 && s.less(entry, h.entries[0]) {
+        h.entries[0] = entry
+        heap.Fix(h, 0)
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  sort.Slice(h.entries, func(i, j int) bool { return s.less(h.entries[i], h.entries[j]) })
+  for _, entry := range h.entries {
+    out.add(entry.row)
+  }
+  return nil
+}
+
+func (s *Sort) memoryBudget() int64 {
+  if s.MemoryBudget <= 0 {
+    return DefaultMemoryBudget
+  }
+  return s.MemoryBudget
+}
+
+func (s *Sort) sortEntries(entries []sortEntry) {
+  sort.Slice(entries, func(i, j int) bool { return s.less(entries[i], entries[j]) })
+}
+
+func (s *Sort) external(out *batcher) error {
+  entries := make([]sortEntry, 0)
+  var size int64
+  runs := make([]*spillFile, 0)
+  defer func() {
+    for _, run := range runs {
+      run.remove()
+    }
+  }()
+  // sorts the rows in memory and writes them out as a run
+  spill := func() error {
+    s.sortEntries(entries)
+    run, err := newSpillFile(s.TempDir)
+    if err != nil {
+      return err
+    }
+    runs = append(runs, run)
+    for _, entry := range entries {
+      if err := run.write(entry.row); err != nil {
+        return err
+      }
+    }
+    entries, size = entries[:0], 0
+    return run.finish()
+  }
+
+  sequence := 0
+  err := drain(s.Input, func(batch []Row) error {
+    for _, row := range batch {
+      if err := s.checkRow(row); err != nil {
+        return err
+      }
+      entries = append(entries, sortEntry{row: row, sequence: sequence})
+      sequence++
+      size += estimatedRowBytes(row)
+      if size > s.memoryBudget() {
+        if err := spill(); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  if len(runs) == 0 {
+    s.sortEntries(entries)
+    for _, entry := range entries {
+      out.add(entry.row)
+    }
+    return nil
+  }
+  if len(entries) > 0 {
+    if err := spill(); err != nil {
+      return err
+    }
+  }
+
+  // merge runs into fewer, longer ones until they can all be merged at once.
+  // Runs are merged in order and ties go to the earlier run, which keeps the
+  // sort stable.
+  for len(runs) > mergeFanIn {
+    merged, err := newSpillFile(s.TempDir)
+    if err != nil {
+      return err
+    }
+    err = s.merge(runs[:mergeFanIn], merged.write)
+    if err == nil {
+      err = merged.finish()
+    }
+    for _, run := range runs[:mergeFanIn] {
+      run.remove()
+    }
+    runs = append([]*spillFile{merged}, runs[mergeFanIn:]...)
+    if err != nil {
+      return err
+    }
+  }
+  return s.merge(runs, func(row Row) error {
+    out.add(row)
+    return nil
+  })
+}
+
+// cursors over sorted runs, the one with the first row on top
+type mergeHeap struct {
+  sort *Sort
+  cursors []*rowCursor
+  // position of each cursor's run, to break ties
+  runs []int
+}
+
+func (h *mergeHeap) Len() int { return len(h.cursors) }
+func (h *mergeHeap) Less(i, j int) bool {
+  a, _ := h.cursors[i].peek()
+  b, _ := h.cursors[j].peek()
+  if c := compareRows(a, b, h.sort.Keys); c != 0 {
+    return c < 0
+  }
+  return h.runs[i] < h.runs[j]
+}
+func (h *mergeHeap) Swap(i, j int) {
+  h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i]
+  h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+}
+func (h *mergeHeap) Push(x interface{}) {}
+func (h *mergeHeap) Pop() interface{} {
+  h.cursors = h.cursors[:len(h.cursors)-1]
+  h.runs = h.runs[:len(h.runs)-1]
+  return nil
+}
+
+// k-way merge of sorted runs, calling each on every row in order
+func (s *Sort) merge(runs []*spillFile, each func(Row) error) error {
+  all := make([]*rowCursor, 0, len(runs))
+  h := &mergeHeap{sort: s}
+  for i, run := range runs {
+    cursor := newRowCursor(run.source(DefaultBatchSize * 100))
+    all = append(all, cursor)
+    if _, ok := cursor.peek(); ok {
+      h.cursors = append(h.cursors, cursor)
+      h.runs = append(h.runs, i)
+    }
+  }
+  heap.Init(h)
+  var err error
+  for err == nil && h.Len() > 0 {
+    cursor := h.cursors[0]
+    row, _ := cursor.peek()
+    err = each(row)
+    cursor.advance()
+    if _, ok := cursor.peek(); ok {
+      heap.Fix(h, 0)
+    } else {
+      heap.Pop(h)
+    }
+  }
+  for _, cursor := range all {
+    if closeErr := cursor.close(); err == nil {
+      err = closeErr
+    }
+  }
+  return err
+}
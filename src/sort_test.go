@@ -0,0 +1,187 @@
+package sql_planner
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rows of (a, b, position) with NULLs in a and b
+func randomSortRows(r *rand.Rand, count int) []Row {
+  rows := make([]Row, 0, count)
+  for i := 0; i < count; i++ {
+    row := Row{IntField(r.Intn(10)), StringField(string(rune('a' + r.Intn(5)))), IntField(i)}
+    if r.Intn(7) == 0 {
+      row[0] = nil
+    }
+    if r.Intn(9) == 0 {
+      row[1] = nil
+    }
+    rows = append(rows, row)
+  }
+  return rows
+}
+
+var testSortKeys = [][]SortKey{
+  {{Column: 0}},
+  {{Column: 0, Descending: true}},
+  {{Column: 0, Nulls: NullsFirst}, {Column: 1, Descending: true, Nulls: NullsLast}},
+  {{Column: 1}, {Column: 0, Descending: true}},
+}
+
+func TestSort(t *testing.T) {
+  rows := randomSortRows(rand.New(rand.NewSource(9)), 2000)
+  for _, keys := range testSortKeys {
+    expected := append([]Row{}, rows...)
+    sort.SliceStable(expected, func(i, j int) bool { return compareRows(expected[i], expected[j], keys) < 0 })
+
+    // a budget of 500 bytes makes more runs than can be merged at once
+    for _, budget := range []int64{0, 500, 20000} {
+      dir := t.TempDir()
+      sorted, err := collectRows((&Sort{
+        Input:        rowsSource(rows, 64),
+        Keys:         keys,
+        Limit:        NoLimit,
+        MemoryBudget: budget,
+        TempDir:      dir,
+        BatchSize:    50,
+      }).Run)
+      require.NoError(t, err)
+      // equal keys keep their input order too
+      require.Equal(t, expected, sorted, "keys %v, budget %d", keys, budget)
+
+      entries, err := os.ReadDir(dir)
+      require.NoError(t, err)
+      require.Empty(t, entries)
+    }
+
+    for _, limit := range []Limit{0, 1, 17, 5000} {
+      top, err := collectRows((&Sort{Input: rowsSource(rows, 64), Keys: keys, Limit: limit}).Run)
+      require.NoError(t, err)
+      end := int(limit)
+      if end > len(expected) {
+        end = len(expected)
+      }
+      require.Equal(t, expected[:end], top, "keys %v, limit %d", keys, limit)
+    }
+  }
+}
+
+func TestSortNulls(t *testing.T) {
+  rows := []Row{{IntField(2)}, {nil}, {IntField(1)}}
+  for _, test := range []struct {
+    key SortKey
+    expected []Row
+  }{
+    {SortKey{}, []Row{{IntField(1)}, {IntField(2)}, {nil}}},
+    {SortKey{Descending: true}, []Row{{nil}, {IntField(2)}, {IntField(1)}}},
+    {SortKey{Nulls: NullsFirst}, []Row{{nil}, {IntField(1)}, {IntField(2)}}},
+    {SortKey{Descending: true, Nulls: NullsLast}, []Row{{IntField(2)}, {IntField(1)}, {nil}}},
+  } {
+    sorted, err := collectRows((&Sort{Input: rowsSource(rows, 2), Keys: []SortKey{test.key}, Limit: NoLimit}).Run)
+    require.NoError(t, err)
+    require.Equal(t, test.expected, sorted)
+  }
+}
+
+func TestSortInvalid(t *testing.T) {
+  for _, limit := range []Limit{NoLimit, 3} {
+    _, err := collectRows((&Sort{Input: rowsSource([]Row{{IntField(1)}}, 1), Keys: []SortKey{{Column: 1}}, Limit: limit}).Run)
+    require.Error(t, err)
+    _, err = collectRows((&Sort{Input: rowsSource(nil, 1), Keys: []SortKey{{Column: -1}}, Limit: limit}).Run)
+    require.Error(t, err)
+  }
+}
+
+func TestPlanSort(t *testing.T) {
+  db := createQueryDatabase(t)
+  users, _ := db.Table("users")
+
+  // the primary index is already in order
+  plan, err := PlanSort(FullScan(users), []OrderColumn{{Column: "id"}}, NoLimit)
+  require.NoError(t, err)
+  require.IsType(t, &ScanPlan{}, plan)
+  plan, err = PlanSort(FullScan(users), []OrderColumn{{Column: "id"}}, 3)
+  require.NoError(t, err)
+  require.IsType(t, &LimitPlan{}, plan)
+  rows, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  require.Equal(t, []Row{{IntField(0), IntField(0)}, {IntField(1), IntField(1)}, {IntField(2), IntField(2)}}, rows)
+
+  plan, err = PlanSort(FullScan(users), []OrderColumn{{Column: "age", Descending: true}, {Column: "id"}}, 3)
+  require.NoError(t, err)
+  require.Equal(t, "top 3 sort by users.age desc, users.id", plan.describe())
+  rows, err = collectRows(plan.Run)
+  require.NoError(t, err)
+  require.Equal(t, []Row{{IntField(19), IntField(19)}, {IntField(39), IntField(19)}, {IntField(59), IntField(19)}}, rows)
+
+  _, err = PlanSort(FullScan(users), []OrderColumn{{Column: "nope"}}, NoLimit)
+  require.Error(t, err)
+}
+
+func TestQueryOrderBy(t *testing.T) {
+  db := createQueryDatabase(t)
+  // owners with the most pets, then by id
+  plan, err := db.Plan(Query{
+    Tables:     []string{"users", "pets"},
+    Joins:      []JoinCondition{{Left: "users.id", Right: "pets.ownerId"}},
+    GroupBy:    []string{"users.id"},
+    Aggregates: []AggregateColumn{{Func: Count}},
+    OrderBy:    []OrderColumn{{Column: "count(*)", Descending: true}, {Column: "users.id"}},
+    Limit:      2,
+  })
+  require.NoError(t, err)
+  require.Contains(t, plan.Explain(), "top 2 sort by count(*) desc, users.id")
+  rows, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  // pets i and i + 250 have owner 7i % 250, pet 36 has owner 2
+  require.Equal(t, []Row{{IntField(0), IntField(2)}, {IntField(2), IntField(2)}}, rows)
+
+  // already in order of the primary index
+  plan, err = db.Plan(Query{Tables: []string{"users"}, OrderBy: []OrderColumn{{Column: "users.id"}}, Limit: 1})
+  require.NoError(t, err)
+  require.IsType(t, &LimitPlan{}, plan.Root)
+}
+
+func TestQueryOffset(t *testing.T) {
+  db := createQueryDatabase(t)
+  query := Query{
+    Tables:  []string{"users"},
+    OrderBy: []OrderColumn{{Column: "users.age", Descending: true}, {Column: "users.id"}},
+    Limit:   3,
+    Offset:  2,
+  }
+  plan, err := db.Plan(query)
+  require.NoError(t, err)
+  explained := plan.Explain()
+  require.Contains(t, explained, "limit 3 offset 2")
+  require.Contains(t, explained, "top 5 sort by users.age desc, users.id")
+  rows, err := collectRows(plan.Run)
+  require.NoError(t, err)
+  require.Equal(t, []Row{{IntField(59), IntField(19)}, {IntField(79), IntField(19)}, {IntField(99), IntField(19)}}, rows)
+
+  // already in order, and past the end
+  query.OrderBy, query.Limit, query.Offset = []OrderColumn{{Column: "users.id"}}, 5, 198
+  plan, err = db.Plan(query)
+  require.NoError(t, err)
+  require.Equal(t, "limit 5 offset 198", plan.Root.describe())
+  require.IsType(t, &ScanPlan{}, plan.Root.(*LimitPlan).Input)
+  rows, err = collectRows(plan.Run)
+  require.NoError(t, err)
+  require.Equal(t, []Row{{IntField(198), IntField(18)}, {IntField(199), IntField(19)}}, rows)
+
+  query.OrderBy, query.Limit = nil, 0
+  plan, err = db.Plan(query)
+  require.NoError(t, err)
+  require.Equal(t, "offset 198", plan.Root.describe())
+  rows, err = collectRows(plan.Run)
+  require.NoError(t, err)
+  require.Len(t, rows, 2)
+
+  query.Offset = -1
+  _, err = db.Plan(query)
+  require.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package sql_planner
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// Temporary file of rows for operators that run out of memory. Rows are
+// written once, in the row stream encoding of a tree, then read back.
+type spillFile struct {
+  file *os.File
+  writer *bufio.Writer
+  rows int
+}
+
+// dir is where to put the file, os.TempDir() if it's empty
+func newSpillFile(dir string) (*spillFile, error) {
+  file, err := os.CreateTemp(dir, "sql-planner-spill-*")
+  if err != nil {
+    return nil, err
+  }
+  return &spillFile{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (f *spillFile) write(row Row) error {
+  f.rows++
+  if err := f.writer.WriteByte(rowMarker); err != nil {
+    return err
+  }
+  return writeRow(f.writer, row)
+}
+
+// no more rows will be written
+func (f *spillFile) finish() error {
+  if err := f.writer.WriteByte(endMarker); err != nil {
+    return err
+  }
+  return f.writer.Flush()
+}
+
+// RowSource reading the rows back from the start, after finish
+func (f *spillFile) source(batchSize int) RowSource {
+  return func(output chan<- []Row) error {
+    if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+      return err
+    }
+    reader := bufio.NewReader(f.file)
+    out := newBatcher(output, batchSize)
+    defer out.flush()
+    for {
+      marker, err := reader.ReadByte()
+      if err != nil {
+        return truncated(err)
+      }
+      if marker == endMarker {
+        return nil
+      }
+      if marker != rowMarker {
+        return corrupt("invalid row marker %d", marker)
+      }
+      row, err := readRow(reader)
+      if err != nil {
+        return err
+      }
+      out.add(row)
+    }
+  }
+}
+
+func (f *spillFile) remove() error {
+  f.file.Close()
+  return os.Remove(f.file.Name())
+}
@@ -0,0 +1,286 @@
+package sql_planner
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Rows ANALYZE computes statistics from. Larger tables are still read in
+// full to count their rows, but only a uniform sample of them is kept.
+const DefaultStatisticsSample = 30000
+
+const (
+  mostCommonValueCount = 10
+  histogramBuckets = 20
+)
+
+// Statistics of a table, as of the last ANALYZE.
+type TableStats struct {
+  RowCount int
+  // number of rows the column statistics were computed from
+  SampleSize int
+  Columns map[string]*ColumnStats
+}
+
+type ValueFrequency struct {
+  Value Field
+  // of all rows
+  Fraction float64
+}
+
+type ColumnStats struct {
+  // estimated for the whole table when it was sampled
+  DistinctCount float64
+  NullFraction float64
+  // nil if every value is NULL
+  Min Field
+  Max Field
+  // values much more common than the rest, most common first
+  MostCommon []ValueFrequency
+  // Equi-depth histogram of the values other than NULL and MostCommon:
+  // bounds of buckets that each hold about the same number of rows, the
+  // first being the smallest value and the last the largest.
+  Histogram []Field
+}
+
+// Reads every row of the table and computes statistics for each column, from
+// a sample of sampleSize rows if there are more.
+func (t *Table) Analyze(sampleSize int) *TableStats {
+  if sampleSize <= 0 {
+    sampleSize = DefaultStatisticsSample
+  }
+  schema := t.Schema()
+  // reservoir sampling, seeded so ANALYZE of the same table is repeatable
+  random := rand.New(rand.NewSource(1))
+  sample := make([]Row, 0)
+  count := 0
+  // errors can't happen scanning the primary index
+  _ = drain(t.Scan(t.primaryIndex, QueryPredicate{
+    LowerBound: NegativeInfinity{},
+    UpperBound: Infinity{},
+    Limit:      NoLimit,
+  }, DefaultBatchSize*100), func(batch []Row) error {
+    for _, row := range batch {
+      count++
+      if len(sample) < sampleSize {
+        sample = append(sample, row)
+      } else if k := random.Intn(count); k < sampleSize {
+        sample[k] = row
+      }
+    }
+    return nil
+  })
+
+  stats := &TableStats{
+    RowCount: count,
+    SampleSize: len(sample),
+    Columns: make(map[string]*ColumnStats, len(schema)),
+  }
+  for position, col := range schema {
+    values := make([]Field, 0, len(sample))
+    for _, row := range sample {
+      if position < len(row) {
+        values = append(values, row[position])
+      }
+    }
+    stats.Columns[col.Name] = columnStats(values, count)
+  }
+  return stats
+}
+
+// statistics of a column from a sample of its values, out of rowCount rows
+func columnStats(values []Field, rowCount int) *ColumnStats {
+  stats := &ColumnStats{}
+  if len(values) == 0 {
+    return stats
+  }
+  sorted := make([]Field, 0, len(values))
+  for _, v := range values {
+    if v != nil {
+      sorted = append(sorted, v)
+    }
+  }
+  stats.NullFraction = float64(len(values)-len(sorted)) / float64(len(values))
+  if len(sorted) == 0 {
+    return stats
+  }
+  sort.Slice(sorted, func(i, j int) bool { return sorted[i].lessThan(sorted[j]) })
+  stats.Min, stats.Max = sorted[0], sorted[len(sorted)-1]
+
+  // each distinct value with the number of times it's in the sample
+  type run struct {
+    value Field
+    count int
+  }
+  runs := make([]run, 0)
+  for _, v := range sorted {
+    if len(runs) > 0 && runs[len(runs)-1].value.equals(v) {
+      runs[len(runs)-1].count++
+    } else {
+      runs = append(runs, run{value: v, count: 1})
+    }
+  }
+  singletons := 0
+  for _, r := range runs {
+    if r.count == 1 {
+      singletons++
+    }
+  }
+  // Haas and Stokes' Duj1 estimator, which is exact if the sample is the
+  // whole table
+  n, d, N := float64(len(sorted)), float64(len(runs)), float64(rowCount)*float64(len(sorted))/float64(len(values))
+  stats.DistinctCount = n * d / (n - float64(singletons) + float64(singletons)*n/N)
+
+  // values more common than average are kept apart from the histogram, so a
+  // few of them don't swallow whole buckets
+  byCount := append([]run{}, runs...)
+  sort.SliceStable(byCount, func(i, j int) bool { return byCount[i].count > byCount[j].count })
+  average := n / d
+  mostCommon := make(map[int]bool)
+  for _, r := range byCount {
+    if len(stats.MostCommon) == mostCommonValueCount || r.count < 2 || float64(r.count) <= 1.25*average {
+      break
+    }
+    stats.MostCommon = append(stats.MostCommon, ValueFrequency{
+      Value: r.value,
+      Fraction: float64(r.count) / float64(len(values)),
+    })
+  }
+  for i, r := range runs {
+    for _, common := range stats.MostCommon {
+      if common.Value.equals(r.value) {
+        mostCommon[i] = true
+      }
+    }
+  }
+
+  rest := make([]Field, 0, len(sorted))
+  for i, r := range runs {
+    if !mostCommon[i] {
+      for c := 0; c < r.count; c++ {
+        rest = append(rest, r.value)
+      }
+    }
+  }
+  if len(rest) == 0 {
+    return stats
+  }
+  buckets := histogramBuckets
+  if len(rest)-1 < buckets {
+    buckets = len(rest) - 1
+  }
+  stats.Histogram = append(stats.Histogram, rest[0])
+  for b := 1; b <= buckets; b++ {
+    bound := rest[b*(len(rest)-1)/buckets]
+    if !bound.equals(stats.Histogram[len(stats.Histogram)-1]) {
+      stats.Histogram = append(stats.Histogram, bound)
+    }
+  }
+  return stats
+}
+
+// fraction of rows that aren't NULL or one of the most common values
+func (c *ColumnStats) histogramFraction() float64 {
+  fraction := 1 - c.NullFraction
+  for _, common := range c.MostCommon {
+    fraction -= common.Fraction
+  }
+  if fraction < 0 {
+    return 0
+  }
+  return fraction
+}
+
+// fraction of the histogram's values less than v
+func (c *ColumnStats) histogramBelow(v Field) float64 {
+  bounds := c.Histogram
+  if len(bounds) == 0 || !bounds[0].lessThan(v) {
+    return 0
+  }
+  if !v.lessThan(bounds[len(bounds)-1]) {
+    return 1
+  }
+  if len(bounds) == 1 {
+    return 0.5
+  }
+  // bucket that v falls in, and how far into it
+  b := sort.Search(len(bounds), func(i int) bool { return !bounds[i].lessThan(v) }) - 1
+  within := 0.5
+  low, lowIsInt := bounds[b].(IntField)
+  high, highIsInt := bounds[b+1].(IntField)
+  value, valueIsInt := v.(IntField)
+  if lowIsInt && highIsInt && valueIsInt && high > low {
+    within = float64(value-low) / float64(high-low)
+  }
+  return (float64(b) + within) / float64(len(bounds)-1)
+}
+
+// Estimated fraction of rows whose value compares to v with op.
+func (c *ColumnStats) selectivity(op CompareOp, v Field) float64 {
+  equal := 0.0
+  below := 0.0
+  for _, common := range c.MostCommon {
+    if common.Value.equals(v) {
+      equal = common.Fraction
+    } else if common.Value.lessThan(v) {
+      below += common.Fraction
+    }
+  }
+  rest := c.histogramFraction()
+  outOfRange := c.Min == nil || v.lessThan(c.Min) || c.Max.lessThan(v)
+  if equal == 0 && !outOfRange {
+    // the other values are assumed to be equally common
+    others := c.DistinctCount - float64(len(c.MostCommon))
+    if others < 1 {
+      others = 1
+    }
+    equal = rest / others
+  }
+  below += rest * c.histogramBelow(v)
+  var fraction float64
+  switch op {
+  case Equal:
+    fraction = equal
+  case Less:
+    fraction = below
+  case LessOrEqual:
+    fraction = below + equal
+  case Greater:
+    fraction = 1 - c.NullFraction - below - equal
+  case GreaterOrEqual:
+    fraction = 1 - c.NullFraction - below
+  case NotEqual:
+    fraction = 1 - c.NullFraction - equal
+  }
+  if fraction < 0 {
+    return 0
+  }
+  if fraction > 1 {
+    return 1
+  }
+  return fraction
+}
+
+// Computes statistics for the named table and stores them in the catalog for
+// the optimizer, see Table.Analyze.
+func (d *Database) Analyze(tableName string) (*TableStats, error) {
+  table, err := d.Table(tableName)
+  if err != nil {
+    return nil, err
+  }
+  stats := table.Analyze(DefaultStatisticsSample)
+  d.mutex.Lock()
+  defer d.mutex.Unlock()
+  // the table could have been dropped, or replaced, while it was read
+  if d.tables[tableName] == table {
+    d.stats[tableName] = stats
+  }
+  return stats, nil
+}
+
+// Statistics of the named table from its last ANALYZE, nil if it has none.
+func (d *Database) Statistics(tableName string) *TableStats {
+  d.mutex.RLock()
+  defer d.mutex.RUnlock()
+  return d.stats[tableName]
+}
@@ -0,0 +1,112 @@
+package sql_planner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// events(id, kind), where nine in ten rows are of kind 0 and the rest have a
+// kind of their own, with an index on kind
+func createSkewedTable(t *testing.T, db *Database, rows int) *Table {
+  table, err := db.CreateTable("events", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "kind", ColumnType: INT},
+  }, []string{"id"})
+  require.NoError(t, err)
+  for i := 0; i < rows; i++ {
+    kind := 0
+    if i%10 == 0 {
+      kind = i
+    }
+    require.NoError(t, table.Insert(Row{IntField(i), IntField(kind)}))
+  }
+  _, err = db.CreateIndex("events_kind", "events", []string{"kind"})
+  require.NoError(t, err)
+  return table
+}
+
+func TestAnalyze(t *testing.T) {
+  db := createQueryDatabase(t)
+  stats, err := db.Analyze("users")
+  require.NoError(t, err)
+  require.Same(t, stats, db.Statistics("users"))
+  require.Equal(t, 200, stats.RowCount)
+  require.Equal(t, 200, stats.SampleSize)
+
+  id := stats.Columns["id"]
+  require.Equal(t, 200.0, id.DistinctCount)
+  require.Equal(t, 0.0, id.NullFraction)
+  require.Equal(t, IntField(0), id.Min)
+  require.Equal(t, IntField(199), id.Max)
+  require.Empty(t, id.MostCommon)
+  require.Len(t, id.Histogram, histogramBuckets+1)
+  require.Equal(t, IntField(0), id.Histogram[0])
+  require.Equal(t, IntField(199), id.Histogram[histogramBuckets])
+  for i := 1; i < len(id.Histogram); i++ {
+    require.True(t, id.Histogram[i-1].lessThan(id.Histogram[i]))
+  }
+  require.InDelta(t, 0.25, id.selectivity(Less, IntField(50)), 0.01)
+  require.InDelta(t, 0.005, id.selectivity(Equal, IntField(50)), 0.001)
+  require.Equal(t, 0.0, id.selectivity(Equal, IntField(500)))
+  require.Equal(t, 1.0, id.selectivity(GreaterOrEqual, IntField(-1)))
+
+  // every age is as common as the others
+  age := stats.Columns["age"]
+  require.Equal(t, 20.0, age.DistinctCount)
+  require.Empty(t, age.MostCommon)
+  require.InDelta(t, 0.05, age.selectivity(Equal, IntField(3)), 0.001)
+
+  require.Nil(t, db.Statistics("pets"))
+  _, err = db.Analyze("nope")
+  require.ErrorIs(t, err, ErrTableNotFound)
+  require.NoError(t, db.DropTable("users"))
+  require.Nil(t, db.Statistics("users"))
+}
+
+func TestAnalyzeMostCommon(t *testing.T) {
+  table := createSkewedTable(t, NewDatabase(), 1000)
+  kind := table.Analyze(0).Columns["kind"]
+  require.Len(t, kind.MostCommon, 1)
+  require.Equal(t, IntField(0), kind.MostCommon[0].Value)
+  // kind 0 is in the sample as well as among the rest
+  require.InDelta(t, 0.901, kind.MostCommon[0].Fraction, 0.001)
+  require.Equal(t, IntField(10), kind.Histogram[0])
+  require.InDelta(t, 0.901, kind.selectivity(Equal, IntField(0)), 0.001)
+  require.InDelta(t, 0.001, kind.selectivity(Equal, IntField(500)), 0.001)
+  require.InDelta(t, 0.099, kind.selectivity(Greater, IntField(0)), 0.001)
+}
+
+func TestAnalyzeSample(t *testing.T) {
+  table := createSkewedTable(t, NewDatabase(), 5000)
+  stats := table.Analyze(500)
+  require.Equal(t, 5000, stats.RowCount)
+  require.Equal(t, 500, stats.SampleSize)
+  // estimated from the sample
+  require.InDelta(t, 5000, stats.Columns["id"].DistinctCount, 500)
+  require.InDelta(t, 0.9, stats.Columns["kind"].selectivity(Equal, IntField(0)), 0.05)
+}
+
+func TestStatisticsChooseIndex(t *testing.T) {
+  db := NewDatabase()
+  createSkewedTable(t, db, 1000)
+  plan := func(kind int) string {
+    plan, err := db.Plan(Query{
+      Tables:  []string{"events"},
+      Filters: []ColumnFilter{{Column: "events.kind", Op: Equal, Value: IntField(kind)}},
+    })
+    require.NoError(t, err)
+    return plan.Root.(*ScanPlan).Index.Name()
+  }
+
+  // without statistics every kind looks as rare as the others
+  require.Equal(t, "events_kind", plan(0))
+  require.Equal(t, "events_kind", plan(500))
+
+  _, err := db.Analyze("events")
+  require.NoError(t, err)
+  // most rows are kind 0, so looking them up through the index costs more
+  // than reading the whole table
+  require.Equal(t, "events_pkey", plan(0))
+  require.Equal(t, "events_kind", plan(500))
+}
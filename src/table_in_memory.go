@@ -1,8 +1,11 @@
 package sql_planner
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 )
 
 type ColumnType int
@@ -82,27 +85,304 @@ type Column struct {
 }
 
 type Table struct {
+  // name in the Database, if the table is in one
+  name string
   // schema is an ordered list of (column name, type)
   schema []Column
   // map from primary key to data
   primaryIndex *Index
-  // ordered list of indices, first one being the primary key, required
+  // number of leading columns of primaryIndex that make up the primary key
+  primaryKeyLength int
+  // ordered list of indices, first one being the primary key, required.
+  // Replaced rather than modified in place, guarded by mutex.
   indices []*Index
+  // canonical copies of string values shared by every index
+  strings *stringPool
+  // writers of single rows hold a read lock, changes to the indices a write lock
+  mutex sync.RWMutex
+  // held by writers of single rows from checking the row against the table,
+  // such as against the unique indices, until it's written, while mutex is
+  // read locked
+  uniqueMutex sync.Mutex
+  // schema changes run one at a time
+  alterMutex sync.Mutex
+}
+
+func (t *Table) String() string {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  return fmt.Sprintf("Schema: %v\nPrimary index:%s\nIndices:%v", t.schema, t.primaryIndex, t.indices)
 }
 
-func (t Table) String() string {
-  return fmt.Sprintf("Schema: %v\nPrimary index:%s\nIndices:%v", t.schema, t.primaryIndex, t.indices)
+// Hands out one shared copy of each distinct string, so a value repeated
+// across rows and indices is only stored once. A value is kept while rows of
+// the table hold it: each interned row counts once for each of its strings
+// until it's released. A nil pool shares nothing.
+type stringPool struct {
+  mutex sync.Mutex
+  fields map[StringField]*pooledString
+}
+
+type pooledString struct {
+  field Field
+  // number of interned, not yet released, fields holding it
+  refs int
+}
+
+func newStringPool() *stringPool {
+  return &stringPool{fields: make(map[StringField]*pooledString)}
+}
+
+// replaces the string fields of row in place with their shared copies
+func (p *stringPool) intern(row Row) {
+  if p == nil {
+    return
+  }
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  for i, field := range row {
+    s, ok := field.(StringField)
+    if !ok {
+      continue
+    }
+    if shared, exists := p.fields[s]; exists {
+      row[i] = shared.field
+      shared.refs++
+    } else {
+      p.fields[s] = &pooledString{field: field, refs: 1}
+    }
+  }
+}
+
+// Gives back the strings of an interned row the table no longer holds, any
+// copy of it will do. Strings no row holds anymore leave the pool.
+func (p *stringPool) release(row Row) {
+  if p == nil {
+    return
+  }
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  for _, field := range row {
+    s, ok := field.(StringField)
+    if !ok {
+      continue
+    }
+    shared, exists := p.fields[s]
+    if !exists {
+      continue
+    }
+    shared.refs--
+    if shared.refs <= 0 {
+      delete(p.fields, s)
+    }
+  }
 }
 
 type Index struct {
+  // name in the Database, if the index is in one
+  name string
   // list of columns to build an index with
   schema []Column
   // B-Tree
   btree *BTree
+  // Condition a row must meet to be in a partial index, nil if every row is.
+  where Expr
+  whereFilter func(Row) bool
+  // columns of schema computed from expressions over the row
+  computed []computedColumn
+  // the table schema where and computed are compiled against
+  exprSchema []Column
+  // leading columns of schema no two rows share: the key of a unique index,
+  // 0 for any other index, including the primary index
+  unique int
+  // set while the index is being backfilled by AddIndex
+  building bool
+  // rows deleted from the table while building, in the order of the table schema
+  buildLog []Row
+  // guards replacing btree's root, the build state and the name
+  mutex sync.RWMutex
 }
 
 func (i *Index) String() string {
-  return fmt.Sprintf("{schema: %v, data:\n%s\n}", i.schema, i.btree)
+  return fmt.Sprintf("{schema: %v, data:\n%s\n}", i.schema, i.tree())
+}
+
+func (i *Index) Name() string {
+  i.mutex.RLock()
+  defer i.mutex.RUnlock()
+  return i.name
+}
+
+// the index may already be in use, so the name is set under its mutex
+func (i *Index) setName(name string) {
+  i.mutex.Lock()
+  defer i.mutex.Unlock()
+  i.name = name
+}
+
+// Columns of the index, in order. Secondary indices end with the primary key,
+// followed by any include columns.
+func (i *Index) Schema() []Column {
+  i.mutex.RLock()
+  defer i.mutex.RUnlock()
+  return append([]Column{}, i.schema...)
+}
+
+// Whether no two rows of the table share the index's key, as for indices made
+// by AddUniqueIndex. Insert doesn't keep the primary key unique, only
+// InsertOnConflict does.
+func (i *Index) Unique() bool {
+  return i.unique > 0
+}
+
+// Condition of a partial index, nil if every row of the table is in it.
+func (i *Index) Where() Expr {
+  return i.where
+}
+
+type computedColumn struct {
+  // named after expr
+  column Column
+  expr Expr
+  compiled *CompiledExpr
+}
+
+// Expressions the index's key is made of, in order, ColumnRefs for columns of
+// the table.
+func (i *Index) Keys() []Expr {
+  keys := make([]Expr, 0, len(i.schema))
+  for _, col := range i.schema {
+    key := ColumnRef(col.Name)
+    for _, c := range i.computed {
+      if c.column == col {
+        key = c.expr
+      }
+    }
+    keys = append(keys, key)
+  }
+  return keys
+}
+
+// whether some rows of the table aren't in the index, because they don't
+// meet its condition or one of its expressions is NULL for them
+func (i *Index) partial() bool {
+  return i.where != nil || len(i.computed) > 0
+}
+
+// compiles where and the computed columns against the table's schema
+func (i *Index) compile(tableSchema []Column) error {
+  i.exprSchema = append([]Column{}, tableSchema...)
+  if i.where != nil {
+    filter, err := CompileFilter(i.where, i.exprSchema)
+    if err != nil {
+      return err
+    }
+    i.whereFilter = filter
+  }
+  for k := range i.computed {
+    compiled, err := Compile(i.computed[k].expr, i.exprSchema)
+    if err != nil {
+      return err
+    }
+    i.computed[k].compiled = compiled
+  }
+  return nil
+}
+
+// The index's entry for row, which is in the order of schema, and whether the
+// row belongs in the index. Rows that don't meet its condition don't, nor do
+// rows that one of its expressions is NULL for, or fails on, as no query the
+// index is used for wants them.
+func (i *Index) entry(row Row, schema []Column) (Row, bool) {
+  if !i.partial() {
+    return reorderRowBySchema(row, schema, i.schema), true
+  }
+  tableRow := row
+  if !sameSchema(schema, i.exprSchema) {
+    tableRow = reorderRowBySchema(row, schema, i.exprSchema)
+  }
+  if i.where != nil && !i.whereFilter(tableRow) {
+    return nil, false
+  }
+  if len(i.computed) == 0 {
+    return reorderRowBySchema(row, schema, i.schema), true
+  }
+  extended := append(make(Row, 0, len(row)+len(i.computed)), row...)
+  extendedSchema := append(make([]Column, 0, len(schema)+len(i.computed)), schema...)
+  for _, c := range i.computed {
+    f, err := c.compiled.Eval(tableRow)
+    if err != nil || f == nil {
+      return nil, false
+    }
+    extended = append(extended, f)
+    extendedSchema = append(extendedSchema, c.column)
+  }
+  return reorderRowBySchema(extended, extendedSchema, i.schema), true
+}
+
+// whether the index has the named column, or reads it in an expression
+func (i *Index) uses(name string) bool {
+  return columnPosition(i.schema, name) >= 0 || i.exprReads(name)
+}
+
+// whether the condition or the computed columns of the index read the named
+// column
+func (i *Index) exprReads(name string) bool {
+  exprs := make([]Expr, 0, len(i.computed)+1)
+  if i.where != nil {
+    exprs = append(exprs, i.where)
+  }
+  for _, c := range i.computed {
+    exprs = append(exprs, c.expr)
+  }
+  for _, reference := range referencesOf(exprs...) {
+    if reference == name {
+      return true
+    }
+  }
+  return false
+}
+
+// whether the index has every one of the named columns
+func (i *Index) covers(columns []string) bool {
+  return schemaCovers(i.Schema(), columns)
+}
+
+func schemaCovers(schema []Column, columns []string) bool {
+  for _, name := range columns {
+    if columnPosition(schema, name) < 0 {
+      return false
+    }
+  }
+  return true
+}
+
+// The schemas rows read through an index are converted with, read together so
+// a schema change can't come in between. Schema changes replace the slices
+// rather than change them, so these stay as they were.
+type indexSchemas struct {
+  table []Column
+  primary []Column
+  index []Column
+}
+
+// the schemas of the table and index, as of now
+func (t *Table) schemasOf(index *Index) indexSchemas {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  return t.currentSchemas(index)
+}
+
+// like schemasOf, for callers that already hold t.mutex
+func (t *Table) currentSchemas(index *Index) indexSchemas {
+  return indexSchemas{table: t.schema, primary: t.primaryIndex.schema, index: index.schema}
+}
+
+// current root of the index's tree
+func (i *Index) tree() *BTree {
+  i.mutex.RLock()
+  defer i.mutex.RUnlock()
+  return i.btree
 }
 
 // append s to list only if s not already in list
@@ -133,20 +413,41 @@ func namesToSchema(
   return schema, nil
 }
 
-func CreateTable(schema []Column, primaryIndex []string, indices ...[]string) (*Table, error) {
-  if len(schema) == 0 {
-    return nil, errors.New("schema can not be empty")
-  }
+func schemaTypes(schema []Column) map[string]ColumnType {
   nameToType := make(map[string]ColumnType, len(schema))
   for _, col := range schema {
     nameToType[col.Name] = col.ColumnType
   }
+  return nameToType
+}
+
+// schema of a secondary index on the given columns, followed by the primary
+// key columns so every entry points to a single row, and then by the include
+// columns, which only make more queries answerable from the index alone
+func secondaryIndexSchema(
+  columns []string,
+  include []string,
+  primaryKey []string,
+  nameToType map[string]ColumnType,
+) ([]Column, error) {
+  index := append([]string{}, columns...)
+  for _, primaryIndexName := range primaryKey {
+    index = appendUnique(index, primaryIndexName)
+  }
+  for _, includeName := range include {
+    index = appendUnique(index, includeName)
+  }
+  return namesToSchema(index, nameToType)
+}
+
+func CreateTable(schema []Column, primaryIndex []string, indices ...[]string) (*Table, error) {
+  if len(schema) == 0 {
+    return nil, errors.New("schema can not be empty")
+  }
+  nameToType := schemaTypes(schema)
   fullIndices := make([]*Index, 0, len(indices))
   for _, index := range indices {
-    for _, primaryIndexName := range primaryIndex {
-      index = appendUnique(index, primaryIndexName)
-    }
-    indexSchema, err := namesToSchema(index, nameToType)
+    indexSchema, err := secondaryIndexSchema(index, nil, primaryIndex, nameToType)
     if err != nil {
       return nil, err
     }
@@ -155,6 +456,7 @@ func CreateTable(schema []Column, primaryIndex []string, indices ...[]string) (*
       btree:  new(BTree),
     })
   }
+  primaryKeyLength := len(primaryIndex)
   // add all fields in the schema to primary index
   for _, col := range schema {
     primaryIndex = appendUnique(primaryIndex, col.Name)
@@ -164,19 +466,85 @@ func CreateTable(schema []Column, primaryIndex []string, indices ...[]string) (*
     return nil, err
   }
   return &Table{
-    schema:       schema,
-    primaryIndex: &Index{schema: primaryIndexSchema, btree: new(BTree)},
-    indices:      fullIndices,
+    schema:           schema,
+    primaryIndex:     &Index{schema: primaryIndexSchema, btree: new(BTree)},
+    primaryKeyLength: primaryKeyLength,
+    indices:          fullIndices,
+    strings:          newStringPool(),
   }, nil
 }
 
+// names of the primary key columns
+func (t *Table) primaryKey() []string {
+  names := make([]string, 0, t.primaryKeyLength)
+  for _, col := range t.primaryIndex.schema[:t.primaryKeyLength] {
+    names = append(names, col.Name)
+  }
+  return names
+}
+
+func (t *Table) Name() string {
+  return t.name
+}
+
+// Columns of the table, in order.
+func (t *Table) Schema() []Column {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  return append([]Column{}, t.schema...)
+}
+
+func (t *Table) PrimaryIndex() *Index {
+  return t.primaryIndex
+}
+
+// Secondary indices that are ready to be queried, in the order they were created.
+func (t *Table) Indices() []*Index {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  indices := make([]*Index, 0, len(t.indices))
+  for _, index := range t.indices {
+    if !index.building {
+      indices = append(indices, index)
+    }
+  }
+  return indices
+}
+
+var ErrSchemaMismatch = errors.New("schema mismatch")
+
+// A row that doesn't fit the schema it's written with. errors.Is matches it
+// with ErrSchemaMismatch.
+type SchemaMismatchError struct {
+  Row Row
+  Schema []Column
+  // "table" or "index"
+  Of string
+  // "length", "type" or "null"
+  Mismatch string
+}
+
+func (e *SchemaMismatchError) Error() string {
+  if e.Mismatch == "null" {
+    return "row has a NULL field"
+  }
+  return fmt.Sprintf("row and %s schema %s mismatch", e.Of, e.Mismatch)
+}
+
+func (e *SchemaMismatchError) Is(target error) bool {
+  return target == ErrSchemaMismatch
+}
+
 func rowMatchSchema(row Row, schema []Column) error {
   if len(schema) != len(row) {
-    return errors.New("row and table schema length mismatch")
+    return &SchemaMismatchError{Row: row, Schema: schema, Of: "table", Mismatch: "length"}
   }
   for i, col := range row {
+    if col == nil {
+      return &SchemaMismatchError{Row: row, Schema: schema, Of: "table", Mismatch: "null"}
+    }
     if col.columnType() != schema[i].ColumnType {
-      return errors.New("row and table schema type mismatch")
+      return &SchemaMismatchError{Row: row, Schema: schema, Of: "table", Mismatch: "type"}
     }
   }
   return nil
@@ -188,20 +556,86 @@ func (r Row) copy() Row {
   return newRow
 }
 
-func (t Table) Insert(row Row) error {
+func (t *Table) Insert(row Row) error {
+  _, err := t.insertRow(row)
+  return err
+}
+
+// Inserts row and returns the copy of it the table keeps, nil if the table
+// already had the same row.
+func (t *Table) insertRow(row Row) (Row, error) {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
   // validate input row against table schema
   if err := rowMatchSchema(row, t.schema); err != nil {
-    return err
+    return nil, err
   }
-  t.primaryIndex.insert(row, t.schema)
-  // insert into indices
-  for _, index := range t.indices {
-    index.insert(row, t.schema)
+  row = row.copy()
+  t.strings.intern(row)
+  t.uniqueMutex.Lock()
+  defer t.uniqueMutex.Unlock()
+  entries, err := t.rowEntries(row, nil)
+  if err != nil {
+    t.strings.release(row)
+    return nil, err
+  }
+  if _, found := t.primaryIndex.tree().find(entries[0]); found {
+    t.strings.release(row)
+    return nil, nil
+  }
+  t.insertEntries(entries)
+  return row, nil
+}
+
+// The entries of row, in the order of the table schema, in the primary index
+// followed by each secondary index, nil for indices it doesn't belong in. An
+// index that can't take the row fails the whole row, before any are written,
+// as does a unique index that has another row with its key. replacing is the
+// row this one replaces, if any, which doesn't count as another row.
+func (t *Table) rowEntries(row Row, replacing Row) ([]Row, error) {
+  entries := make([]Row, 0, len(t.indices)+1)
+  for _, index := range append([]*Index{t.primaryIndex}, t.indices...) {
+    entry, belongs, err := index.checkedEntry(row, t.schema)
+    if err != nil {
+      return nil, err
+    }
+    if !belongs {
+      entries = append(entries, nil)
+      continue
+    }
+    if index.unique > 0 && t.conflicts(index, index.unique, entry, replacing) {
+      return nil, fmt.Errorf("%w: %v", ErrUniqueViolation, entry[:index.unique])
+    }
+    entries = append(entries, entry)
+  }
+  return entries, nil
+}
+
+// whether a row of the table other than replacing has the first keyLength
+// columns of entry in index
+func (t *Table) conflicts(index *Index, keyLength int, entry Row, replacing Row) bool {
+  existing, found := index.tree().find(entry[:keyLength])
+  if !found || existing.equals(entry) {
+    return false
+  }
+  if replacing != nil {
+    if old, belongs := index.entry(replacing, t.schema); belongs && existing.equals(old) {
+      return false
+    }
+  }
+  return true
+}
+
+// writes entries from rowEntries to their indices
+func (t *Table) insertEntries(entries []Row) {
+  for k, index := range append([]*Index{t.primaryIndex}, t.indices...) {
+    if entries[k] != nil {
+      index.insertEntry(entries[k])
+    }
   }
-  return nil
 }
 
-func (t Table) BatchInsert(rows []Row) error {
+func (t *Table) BatchInsert(rows []Row) error {
   for _, row := range rows {
     err := t.Insert(row)
     if err != nil {
@@ -211,102 +645,161 @@ func (t Table) BatchInsert(rows []Row) error {
   return nil
 }
 
-func (t Table) Delete(index *Index, prefix Row) error {
-  output := make(chan []Row)
-  var err error
-  go func() {
-    defer close(output)
-    err = t.TraverseWithIndexPaginated(index, QueryPredicate{
-      UpperBound: ExclusiveBound(prefix),
-      LowerBound: InclusiveBound(prefix),
-      Limit:      NoLimit,
-    }, DefaultBatchSize, output)
-  }()
+func (t *Table) Delete(index *Index, prefix Row) error {
+  return t.DeleteContext(context.Background(), index, prefix)
+}
 
-  for rowBatch := range output {
-    for _, row := range rowBatch {
-      t.primaryIndex.btree = t.primaryIndex.btree.Delete(
-        reorderRowBySchema(row, t.schema, t.primaryIndex.schema),
-      )
-      for _, i := range t.indices {
-        i.btree = i.btree.Delete(
-          reorderRowBySchema(row, t.schema, i.schema),
-        )
-      }
-    }
-  }
+// Like Delete, but stops once ctx is done and returns ctx.Err(). The rows
+// deleted by then stay deleted.
+func (t *Table) DeleteContext(ctx context.Context, index *Index, prefix Row) error {
+  _, err := t.DeleteReturning(ctx, index, prefix, Returning{}, nil)
   return err
 }
 
-func (t Table) Update(index *Index, pred QueryPredicate, vals map[Column]Field) error {
-  output := make(chan []Row)
-  var err error
-  go func() {
-    defer close(output)
-    err = t.TraverseWithIndexPaginated(index, pred, DefaultBatchSize, output)
-  }()
+// The rows of the table matching pred on index, in the order of the table
+// schema, for a write to change. They're all read before any are written, so
+// a row the write moves further along index can't be read, and written,
+// again (the Halloween problem), nor count against pred.Limit twice.
+func (t *Table) targetRows(ctx context.Context, index *Index, pred QueryPredicate) ([]Row, error) {
+  // rows are written back whole
+  pred.Columns = nil
+  rows := make([]Row, 0)
+  err := pipe(ctx, func(ctx context.Context, output chan<- []Row) error {
+    return t.TraverseWithIndexPaginatedContext(ctx, index, pred, DefaultBatchSize, output)
+  }, func(rowBatch []Row) error {
+    rows = append(rows, rowBatch...)
+    return nil
+  })
+  return rows, err
+}
+
+// Removes a row, in the order of the table schema, from every index, false if
+// it has been deleted since it was read.
+func (t *Table) deleteRow(row Row) bool {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  t.uniqueMutex.Lock()
+  defer t.uniqueMutex.Unlock()
+  if _, found := t.primaryIndex.tree().find(reorderRowBySchema(row, t.schema, t.primaryIndex.schema)); !found {
+    return false
+  }
+  t.primaryIndex.delete(row, t.schema)
+  for _, i := range t.indices {
+    i.delete(row, t.schema)
+  }
+  t.strings.release(row)
+  return true
+}
 
-  for rowBatch := range output {
-    for _, row := range rowBatch {
-      // delete
-      t.primaryIndex.btree = t.primaryIndex.btree.Delete(
-        reorderRowBySchema(row, t.schema, t.primaryIndex.schema),
-      )
-      for _, i := range t.indices {
-        i.btree = i.btree.Delete(
-          reorderRowBySchema(row, t.schema, i.schema),
-        )
-      }
-      // update
-      var newRow Row
-      for i, field := range row {
-        if col, exists := vals[t.schema[i]]; exists {
-          newRow = append(newRow, col)
-        } else {
-          newRow = append(newRow, field)
-        }
-      }
-      t.primaryIndex.btree = t.primaryIndex.btree.Insert(
-        reorderRowBySchema(newRow, t.schema, t.primaryIndex.schema),
-      )
-      for _, i := range t.indices {
-        i.btree = i.btree.Insert(
-          reorderRowBySchema(newRow, t.schema, i.schema),
-        )
-      }
+func (t *Table) Update(index *Index, pred QueryPredicate, vals map[Column]Field) error {
+  return t.UpdateContext(context.Background(), index, pred, vals)
+}
+
+// Like Update, but stops once ctx is done and returns ctx.Err(). The rows
+// updated by then, or before an error, stay updated.
+func (t *Table) UpdateContext(ctx context.Context, index *Index, pred QueryPredicate, vals map[Column]Field) error {
+  _, err := t.UpdateReturning(ctx, index, pred, vals, Returning{}, nil)
+  return err
+}
+
+// Replaces row, in the order of the table schema, with vals set in it, and
+// returns the new row, nil if the row has been deleted since it was read.
+func (t *Table) updateRow(row Row, vals map[Column]Field) (Row, error) {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  t.uniqueMutex.Lock()
+  defer t.uniqueMutex.Unlock()
+  if _, found := t.primaryIndex.tree().find(reorderRowBySchema(row, t.schema, t.primaryIndex.schema)); !found {
+    return nil, nil
+  }
+  newRow := make(Row, 0, len(row))
+  for i, field := range row {
+    if col, exists := vals[t.schema[i]]; exists {
+      newRow = append(newRow, col)
+    } else {
+      newRow = append(newRow, field)
     }
   }
-  return err
+  if err := rowMatchSchema(newRow, t.schema); err != nil {
+    return nil, err
+  }
+  if err := t.replaceRow(row, newRow); err != nil {
+    return nil, err
+  }
+  return newRow, nil
 }
 
-func (t Table) TraverseWithIndexPaginated(index *Index, pred QueryPredicate, batchSize int, output chan<- []Row) error {
-  indexOutput := make(chan []Row)
-  var err error
-  go func() {
-    defer close(indexOutput)
-    err = index.btree.TraversePaginated(pred, batchSize, indexOutput)
-  }()
+// Writes newRow in place of row, both in the order of the table schema, and
+// interns newRow. The caller holds the locks writers of single rows do.
+func (t *Table) replaceRow(row Row, newRow Row) error {
+  t.strings.intern(newRow)
+  entries, err := t.rowEntries(newRow, row)
+  if err != nil {
+    t.strings.release(newRow)
+    return err
+  }
+  // delete
+  t.primaryIndex.delete(row, t.schema)
+  for _, i := range t.indices {
+    i.delete(row, t.schema)
+  }
+  t.strings.release(row)
+  // update
+  t.insertEntries(entries)
+  return nil
+}
 
-  for rowBatch := range indexOutput {
-    rowFromTableList := make([]Row, 0, batchSize)
-    for _, rowFromIndex := range rowBatch {
-      rowFromTable := rowFromIndex
-      if index != t.primaryIndex {
-        primaryIndexPrefix := reorderRowBySchema(rowFromIndex, index.schema, t.primaryIndex.schema)
-        rowFromTable = t.searchPrimaryIndex(primaryIndexPrefix)
-      }
-      rowFromTable = reorderRowBySchema(rowFromTable, t.primaryIndex.schema, t.schema)
-      rowFromTableList = append(rowFromTableList, rowFromTable)
-    }
+// Outputs rows of the table, in the order of the table schema, read through
+// index. Rows of a secondary index are looked up in the primary index, unless
+// pred.Columns says the index has every column needed.
+func (t *Table) TraverseWithIndexPaginated(index *Index, pred QueryPredicate, batchSize int, output chan<- []Row) error {
+  return t.TraverseWithIndexPaginatedContext(context.Background(), index, pred, batchSize, output)
+}
 
+// Like TraverseWithIndexPaginated, but stops once ctx is done, even while
+// waiting for output to take a batch, and returns ctx.Err(). Nothing is left
+// reading the index by the time it returns.
+func (t *Table) TraverseWithIndexPaginatedContext(ctx context.Context, index *Index, pred QueryPredicate, batchSize int, output chan<- []Row) error {
+  return pipe(ctx, func(ctx context.Context, indexOutput chan<- []Row) error {
+    return index.traversePaginated(ctx, pred, batchSize, indexOutput)
+  }, func(rowBatch []Row) error {
     // output each batch to the channel
-    output <- rowFromTableList
+    select {
+    case output <- t.tableRows(index, t.schemasOf(index), pred.Columns, rowBatch):
+      return nil
+    case <-ctx.Done():
+      return ctx.Err()
+    }
+  })
+}
+
+// The rows of the table that rows of index are for, in the order of the table
+// schema. A secondary index that has every one of columns stands in for the
+// table, see QueryPredicate.Columns.
+func (t *Table) tableRows(index *Index, schemas indexSchemas, columns []string, rows []Row) []Row {
+  rowFromTableList := make([]Row, 0, len(rows))
+  switch {
+  case index != t.primaryIndex && columns != nil && schemaCovers(schemas.index, columns):
+    for _, rowFromIndex := range rows {
+      rowFromTableList = append(rowFromTableList, coveredRow(rowFromIndex, schemas.index, schemas.table))
+    }
+  case index != t.primaryIndex:
+    for _, rowFromTable := range t.searchPrimaryIndexBatch(schemas, rows) {
+      // skip rows deleted since the index was read
+      if rowFromTable != nil {
+        rowFromTableList = append(rowFromTableList, reorderRowBySchema(rowFromTable, schemas.primary, schemas.table))
+      }
+    }
+  default:
+    for _, rowFromIndex := range rows {
+      rowFromTableList = append(rowFromTableList, reorderRowBySchema(rowFromIndex, schemas.primary, schemas.table))
+    }
   }
-  return err
+  return rowFromTableList
 }
 
 // input prefix row is in the order of the index. output rows are from the main table.
-func (t Table) TraverseWithIndex(index *Index, prefix Row, output chan<- Row) {
+func (t *Table) TraverseWithIndex(index *Index, prefix Row, output chan<- Row) {
   indexOutput := make(chan Row)
   go func() {
     defer close(indexOutput)
@@ -314,18 +807,19 @@ func (t Table) TraverseWithIndex(index *Index, prefix Row, output chan<- Row) {
   }()
 
   for rowFromIndex := range indexOutput {
+    schemas := t.schemasOf(index)
     rowFromTable := rowFromIndex
     if index != t.primaryIndex {
-      primaryIndexPrefix := reorderRowBySchema(rowFromIndex, index.schema, t.primaryIndex.schema)
+      primaryIndexPrefix := reorderRowBySchema(rowFromIndex, schemas.index, schemas.primary)
       rowFromTable = t.searchPrimaryIndex(primaryIndexPrefix)
     }
-    rowFromTable = reorderRowBySchema(rowFromTable, t.primaryIndex.schema, t.schema)
+    rowFromTable = reorderRowBySchema(rowFromTable, schemas.primary, schemas.table)
 
     output <- rowFromTable
   }
 }
 
-func (t Table) ListWithIndex(index *Index, prefix Row) []Row {
+func (t *Table) ListWithIndex(index *Index, prefix Row) []Row {
   allRows := make(chan Row)
   go func() {
     defer close(allRows)
@@ -338,12 +832,46 @@ func (t Table) ListWithIndex(index *Index, prefix Row) []Row {
   return rowList
 }
 
-// prefix must contain all fields in the primary index
-func (t Table) searchPrimaryIndex(prefix Row) Row {
-  // TODO: enforce primary index is unique at write time. otherwise this will deadlock.
-  primaryIndexOutput := make(chan Row, 1)
-  t.primaryIndex.traversePrefix(prefix, primaryIndexOutput)
-  return <-primaryIndexOutput
+// prefix must contain all fields in the primary index. Returns nil if there is
+// no such row.
+func (t *Table) searchPrimaryIndex(prefix Row) Row {
+  row, _ := t.primaryIndex.tree().find(prefix)
+  return row
+}
+
+// row of an index as a row of the table, with NULL for the columns the index
+// doesn't have
+func coveredRow(row Row, indexSchema []Column, tableSchema []Column) Row {
+  tableRow := make(Row, len(tableSchema))
+  for i, col := range indexSchema {
+    if position := columnPosition(tableSchema, col.Name); position >= 0 {
+      tableRow[position] = row[i]
+    }
+  }
+  return tableRow
+}
+
+// Looks up rows of an index with schemas.index in the primary index, sorted
+// by primary key so they can all be found in one pass over it. Returns them in
+// the order of rows, nil for rows no longer in the table.
+func (t *Table) searchPrimaryIndexBatch(schemas indexSchemas, rows []Row) []Row {
+  prefixes := make([]Row, len(rows))
+  order := make([]int, len(rows))
+  for i, row := range rows {
+    prefixes[i] = reorderRowBySchema(row, schemas.index, schemas.primary)
+    order[i] = i
+  }
+  sort.Slice(order, func(a, b int) bool { return prefixes[order[a]].lessThan(prefixes[order[b]]) })
+  sorted := make([]Row, len(rows))
+  for i, position := range order {
+    sorted[i] = prefixes[position]
+  }
+  found := t.primaryIndex.tree().findSorted(sorted)
+  result := make([]Row, len(rows))
+  for i, position := range order {
+    result[position] = found[i]
+  }
+  return result
 }
 
 // general function for reordering a row from one schema to another, possibly yielding only a prefix
@@ -368,16 +896,51 @@ func reorderRowBySchema(row Row, rowSchema []Column, newSchema []Column) Row {
 }
 
 // inserting row into index, where the row is in the order of the table schema
-func (i *Index) insert(row Row, tableSchema []Column) {
-  rowToInsert := reorderRowBySchema(row, tableSchema, i.schema)
-  if len(rowToInsert) < len(i.schema) {
-    panic("row and index schema type mismatch")
+func (i *Index) insert(row Row, tableSchema []Column) error {
+  rowToInsert, belongs, err := i.checkedEntry(row, tableSchema)
+  if err != nil || !belongs {
+    return err
   }
+  i.insertEntry(rowToInsert)
+  return nil
+}
+
+// like entry, but fails if the row is missing columns of the index
+func (i *Index) checkedEntry(row Row, schema []Column) (Row, bool, error) {
+  entry, belongs := i.entry(row, schema)
+  if belongs && len(entry) < len(i.schema) {
+    return nil, false, &SchemaMismatchError{Row: row, Schema: i.schema, Of: "index", Mismatch: "length"}
+  }
+  return entry, belongs, nil
+}
 
-  i.btree = i.btree.Insert(rowToInsert)
+func (i *Index) insertEntry(entry Row) {
+  i.mutex.Lock()
+  defer i.mutex.Unlock()
+  i.btree = i.btree.Insert(entry)
+}
+
+// deleting row from index, where the row is in the order of the table schema
+func (i *Index) delete(row Row, tableSchema []Column) {
+  rowToDelete, belongs := i.entry(row, tableSchema)
+  if !belongs {
+    return
+  }
+  i.mutex.Lock()
+  defer i.mutex.Unlock()
+  i.btree = i.btree.Delete(rowToDelete)
+  if i.building {
+    i.buildLog = append(i.buildLog, row.copy())
+  }
 }
 
 // input prefix is in the order of the index's schema
 func (i *Index) traversePrefix(prefix Row, output chan<- Row) {
-  i.btree.TraversePrefix(prefix, output)
+  i.tree().TraversePrefix(prefix, output)
+}
+
+// like BTree.TraversePaginatedContext, but picks up the index's current root
+// for every batch, so writes can replace it in between
+func (i *Index) traversePaginated(ctx context.Context, pred QueryPredicate, batchSize int, output chan<- []Row) error {
+  return traversePaginated(ctx, i.tree, pred, batchSize, output)
 }
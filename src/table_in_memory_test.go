@@ -1,8 +1,14 @@
 package sql_planner
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -112,6 +118,202 @@ func TestUpdate(t *testing.T) {
     []Row{{StringField("doodle@sheen.com"), IntField(4), IntField(1), BoolField(true)}})
 }
 
+func TestUpdateIndexKey(t *testing.T) {
+  table := createTable(t)
+  rows := make([]Row, 0)
+  for i := 1; i <= 40; i++ {
+    rows = append(rows, Row{StringField(fmt.Sprintf("user%02d@sheen.com", i)), IntField(i), IntField(i), BoolField(true)})
+  }
+  require.NoError(t, table.BatchInsert(rows))
+  all := QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: Limit(len(rows))}
+
+  // the first rows read move past ones the scan hasn't read yet, and are
+  // only updated once, leaving the limit for the rest
+  email := StringField("user30@sheen.com")
+  require.NoError(t, table.Update(table.indices[0], all, map[Column]Field{{Name: "email", ColumnType: STRING}: email}))
+  updated := table.ListWithIndex(table.indices[0], Row{email})
+  require.Len(t, updated, len(rows))
+  for i, row := range updated {
+    require.Equal(t, Row{email, IntField(i + 1), IntField(i + 1), BoolField(true)}, row)
+  }
+  require.True(t, table.CheckIntegrity().OK())
+
+  require.NoError(t, table.Delete(table.indices[0], Row{email}))
+  require.Empty(t, table.ListWithIndex(table.primaryIndex, Row{}))
+}
+
+// the pool only keeps strings rows of the table hold
+func TestStringPoolReleases(t *testing.T) {
+  table := createTable(t)
+  pooled := func() []string {
+    strings := make([]string, 0)
+    for s := range table.strings.fields {
+      strings = append(strings, string(s))
+    }
+    sort.Strings(strings)
+    return strings
+  }
+  rows := insertManyToTable(t, table, 8)
+  require.Equal(t, []string{"doodle@sheen.com", "toto@sheen.com"}, pooled())
+  require.NoError(t, table.Insert(rows[0]))
+  require.Error(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(1)}))
+
+  toto := Row{StringField("toto@sheen.com")}
+  require.NoError(t, table.Update(table.indices[0], QueryPredicate{
+    LowerBound: InclusiveBound(toto),
+    UpperBound: ExclusiveBound(toto),
+    Limit: NoLimit,
+  }, map[Column]Field{{Name: "email", ColumnType: STRING}: StringField("momo@sheen.com")}))
+  require.Equal(t, []string{"doodle@sheen.com", "momo@sheen.com"}, pooled())
+
+  pusheen := Row{StringField("pusheen@sheen.com"), IntField(3), IntField(1), BoolField(true)}
+  result, err := table.InsertOnConflict(pusheen, OnConflict{Index: table.primaryIndex, Action: DoNothing})
+  require.NoError(t, err)
+  require.Equal(t, Skipped, result)
+  require.Equal(t, []string{"doodle@sheen.com", "momo@sheen.com"}, pooled())
+  result, err = table.InsertOnConflict(pusheen, OnConflict{Index: table.primaryIndex, Action: DoUpdate, Excluded: []string{"email"}})
+  require.NoError(t, err)
+  require.Equal(t, Updated, result)
+  require.Equal(t, []string{"doodle@sheen.com", "momo@sheen.com", "pusheen@sheen.com"}, pooled())
+
+  require.NoError(t, table.AddColumn(Column{Name: "name", ColumnType: STRING}, StringField("pusheen")))
+  require.Equal(t, []string{"doodle@sheen.com", "momo@sheen.com", "pusheen", "pusheen@sheen.com"}, pooled())
+  require.NoError(t, table.DropColumn("name", false))
+  require.Equal(t, []string{"doodle@sheen.com", "momo@sheen.com", "pusheen@sheen.com"}, pooled())
+
+  require.NoError(t, table.Delete(table.primaryIndex, Row{}))
+  require.Empty(t, pooled())
+}
+
+func TestTraverseTableCancel(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 100)
+  baseline := runtime.NumGoroutine()
+  all := QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit}
+
+  // the consumer stops reading after one batch
+  ctx, cancel := context.WithCancel(context.Background())
+  output := make(chan []Row)
+  errs := make(chan error, 1)
+  go func() {
+    errs <- table.TraverseWithIndexPaginatedContext(ctx, table.primaryIndex, all, 10, output)
+  }()
+  require.Len(t, <-output, 10)
+  cancel()
+  require.ErrorIs(t, <-errs, context.Canceled)
+  requireNoLeaks(t, baseline)
+
+  ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+  err := table.TraverseWithIndexPaginatedContext(ctx, table.indices[0], all, 10, make(chan []Row))
+  require.ErrorIs(t, err, context.DeadlineExceeded)
+  requireNoLeaks(t, baseline)
+
+  // nothing changes once ctx is done
+  ctx, cancel = context.WithCancel(context.Background())
+  cancel()
+  require.ErrorIs(t, table.DeleteContext(ctx, table.indices[0], Row{StringField("toto@sheen.com")}), context.Canceled)
+  require.ErrorIs(t, table.UpdateContext(ctx, table.primaryIndex, all, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(4)}), context.Canceled)
+  scanned, err := collectRows(table.Scan(table.primaryIndex, all, DefaultBatchSize))
+  require.NoError(t, err)
+  require.ElementsMatch(t, rows, scanned)
+  requireNoLeaks(t, baseline)
+
+  // and the table is still writable
+  require.NoError(t, table.Delete(table.indices[0], Row{StringField("toto@sheen.com")}))
+  require.Len(t, table.ListWithIndex(table.indices[0], Row{StringField("toto@sheen.com")}), 0)
+}
+
+func TestWriteSchemaMismatch(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 8)
+  all := QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit}
+  requireRows := func() {
+    scanned, err := collectRows(table.Scan(table.primaryIndex, all, DefaultBatchSize))
+    require.NoError(t, err)
+    require.ElementsMatch(t, rows, scanned)
+    require.Len(t, table.ListWithIndex(table.indices[0], Row{StringField("doodle@sheen.com")}), 4)
+  }
+
+  // the new value doesn't fit the column, so nothing is updated
+  err := table.Update(table.primaryIndex, all, map[Column]Field{{Name: "age", ColumnType: INT}: StringField("old")})
+  require.ErrorIs(t, err, ErrSchemaMismatch)
+  var mismatch *SchemaMismatchError
+  require.True(t, errors.As(err, &mismatch))
+  require.Equal(t, "table", mismatch.Of)
+  require.Equal(t, "type", mismatch.Mismatch)
+  requireRows()
+
+  // neither does NULL
+  err = table.Insert(Row{StringField("new@sheen.com"), nil, IntField(100), BoolField(true)})
+  require.ErrorIs(t, err, ErrSchemaMismatch)
+  require.True(t, errors.As(err, &mismatch))
+  require.Equal(t, "table", mismatch.Of)
+  require.Equal(t, "null", mismatch.Mismatch)
+  requireRows()
+
+  // an index with a column the table doesn't have can't take rows, and the
+  // other indices give them back
+  broken := &Index{schema: []Column{{Name: "missing", ColumnType: INT}}, btree: new(BTree)}
+  table.indices = append(table.indices, broken)
+  err = table.Insert(Row{StringField("new@sheen.com"), IntField(1), IntField(100), BoolField(true)})
+  require.True(t, errors.As(err, &mismatch))
+  require.Equal(t, "index", mismatch.Of)
+  err = table.Update(table.primaryIndex, all, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(5)})
+  require.ErrorIs(t, err, ErrSchemaMismatch)
+  table.indices = table.indices[:1]
+  requireRows()
+}
+
+func TestConcurrentWrites(t *testing.T) {
+  table := createTable(t)
+  insertManyToTable(t, table, 100)
+  all := QueryPredicate{LowerBound: NegativeInfinity{}, UpperBound: Infinity{}, Limit: NoLimit}
+  baseline := runtime.NumGoroutine()
+
+  var wait sync.WaitGroup
+  errs := make(chan error, 30)
+  for w := 0; w < 10; w++ {
+    wait.Add(3)
+    go func(w int) {
+      defer wait.Done()
+      row := Row{StringField("new@sheen.com"), IntField(0), IntField(1000 + w), BoolField(false)}
+      if err := table.Insert(row); err != nil {
+        errs <- err
+        return
+      }
+      errs <- table.Update(table.primaryIndex, QueryPredicate{
+        LowerBound: InclusiveBound(Row{IntField(1000 + w)}),
+        UpperBound: ExclusiveBound(Row{IntField(1000 + w)}),
+        Limit: Limit(1),
+      }, map[Column]Field{{Name: "age", ColumnType: INT}: IntField(w + 1)})
+    }(w)
+    go func() {
+      defer wait.Done()
+      _, err := collectRows(table.Scan(table.indices[0], all, 7))
+      errs <- err
+    }()
+    go func() {
+      defer wait.Done()
+      errs <- table.Delete(table.indices[0], Row{StringField("toto@sheen.com")})
+    }()
+  }
+  wait.Wait()
+  close(errs)
+  for err := range errs {
+    require.NoError(t, err)
+  }
+  require.Empty(t, table.ListWithIndex(table.indices[0], Row{StringField("toto@sheen.com")}))
+  updated := table.ListWithIndex(table.indices[0], Row{StringField("new@sheen.com")})
+  require.Len(t, updated, 10)
+  for _, row := range updated {
+    require.Equal(t, row[2].(IntField)-999, row[1])
+  }
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+  requireNoLeaks(t, baseline)
+}
+
 func TestMultipleConcurrentOperations(t *testing.T) {
   table := createTable(t)
   insertManyToTable(t, table, 4)
@@ -146,3 +348,62 @@ func TestMultipleConcurrentOperations(t *testing.T) {
   insertChan <- struct{}{}
   <-updateDone
 }
+
+func heapAlloc() uint64 {
+  runtime.GC()
+  var stats runtime.MemStats
+  runtime.ReadMemStats(&stats)
+  return stats.HeapAlloc
+}
+
+// stores the keys of an empty table whole, and its strings unshared
+func uncompress(table *Table) {
+  table.strings = nil
+  for _, index := range append([]*Index{table.primaryIndex}, table.indices...) {
+    index.btree = &BTree{uncompressed: true}
+  }
+}
+
+// reports the heap used per row by the table and its indices, with and without
+// key compression and string sharing
+func BenchmarkKeyCompression(b *testing.B) {
+  const rowCount = 10000
+  for _, compressed := range []bool{false, true} {
+    name := "uncompressed"
+    if compressed {
+      name = "compressed"
+    }
+    b.Run(name, func(b *testing.B) {
+      var bytesPerRow float64
+      for n := 0; n < b.N; n++ {
+        before := heapAlloc()
+        table, err := CreateTable(
+          []Column{
+            {Name: "email", ColumnType: STRING},
+            {Name: "age", ColumnType: INT},
+            {Name: "id", ColumnType: INT},
+            {Name: "isActive", ColumnType: BOOL},
+          },
+          []string{"id", "isActive"},
+          []string{"email"},
+          []string{"age", "email"},
+        )
+        require.NoError(b, err)
+        if !compressed {
+          uncompress(table)
+        }
+        for i := 0; i < rowCount; i++ {
+          require.NoError(b, table.Insert(Row{
+            StringField(fmt.Sprintf("pusheen-number-%d@sheen.com", i%50)),
+            IntField(i % 30),
+            IntField(i),
+            BoolField(i%3 == 0),
+          }))
+        }
+        bytesPerRow = float64(heapAlloc()-before) / rowCount
+        runtime.KeepAlive(table)
+      }
+      b.ReportMetric(bytesPerRow, "bytes/row")
+    })
+  }
+}
@@ -0,0 +1,171 @@
+package sql_planner
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUniqueViolation = errors.New("duplicate key in unique index")
+
+type ConflictAction int
+
+const (
+  // leave the row that's there, as ON CONFLICT DO NOTHING
+  DoNothing ConflictAction = iota
+  // update the row that's there, as ON CONFLICT DO UPDATE SET
+  DoUpdate
+)
+
+// What InsertOnConflict does with a row that has the key of a row already in
+// the table.
+type OnConflict struct {
+  // the primary index, for conflicts on the primary key, or a unique index
+  Index *Index
+  Action ConflictAction
+  // for DoUpdate, the values set in the row that's there, as in Update
+  Set map[Column]Field
+  // for DoUpdate, columns set to the inserted row's values, as SET c =
+  // EXCLUDED.c
+  Excluded []string
+}
+
+type InsertResult int
+
+const (
+  Inserted InsertResult = iota + 1
+  Updated
+  Skipped
+)
+
+func (r InsertResult) String() string {
+  switch r {
+  case Inserted:
+    return "inserted"
+  case Updated:
+    return "updated"
+  case Skipped:
+    return "skipped"
+  default:
+    return "unknown"
+  }
+}
+
+// Inserts row, unless a row of the table already has its key in
+// onConflict.Index, in which case that row is left alone or updated instead.
+// Conflicts on other unique indices fail with ErrUniqueViolation, as with
+// Insert, and so do conflicts on the primary key, which Insert allows.
+func (t *Table) InsertOnConflict(row Row, onConflict OnConflict) (InsertResult, error) {
+  t.mutex.RLock()
+  defer t.mutex.RUnlock()
+  if err := rowMatchSchema(row, t.schema); err != nil {
+    return 0, err
+  }
+  keyLength, err := t.conflictKeyLength(onConflict.Index)
+  if err != nil {
+    return 0, err
+  }
+  row = row.copy()
+  // conflicts are looked for and resolved with no other writes in between
+  t.uniqueMutex.Lock()
+  defer t.uniqueMutex.Unlock()
+
+  existing := t.conflictingRow(onConflict.Index, keyLength, row)
+  if existing == nil {
+    t.strings.intern(row)
+    entries, err := t.rowEntries(row, nil)
+    if err == nil {
+      err = t.checkPrimaryKey(entries[0], nil)
+    }
+    if err != nil {
+      t.strings.release(row)
+      return 0, err
+    }
+    t.insertEntries(entries)
+    return Inserted, nil
+  }
+  if onConflict.Action == DoNothing {
+    return Skipped, nil
+  }
+
+  newRow := existing.copy()
+  for i, col := range t.schema {
+    if field, exists := onConflict.Set[col]; exists {
+      newRow[i] = field
+    }
+  }
+  for _, name := range onConflict.Excluded {
+    position := columnPosition(t.schema, name)
+    if position < 0 {
+      return 0, fmt.Errorf("column %s does not exist", name)
+    }
+    newRow[position] = row[position]
+  }
+  if err := rowMatchSchema(newRow, t.schema); err != nil {
+    return 0, err
+  }
+  if err := t.checkPrimaryKey(reorderRowBySchema(newRow, t.schema, t.primaryIndex.schema), existing); err != nil {
+    return 0, err
+  }
+  if err := t.replaceRow(existing, newRow); err != nil {
+    return 0, err
+  }
+  return Updated, nil
+}
+
+// Like BatchInsert, with InsertOnConflict for each row in turn, so rows also
+// conflict with the ones before them. On an error, the results are for the
+// rows before the one that failed.
+func (t *Table) BatchInsertOnConflict(rows []Row, onConflict OnConflict) ([]InsertResult, error) {
+  results := make([]InsertResult, 0, len(rows))
+  for _, row := range rows {
+    result, err := t.InsertOnConflict(row, onConflict)
+    if err != nil {
+      return results, err
+    }
+    results = append(results, result)
+  }
+  return results, nil
+}
+
+// number of leading columns of index that rows conflict on
+func (t *Table) conflictKeyLength(index *Index) (int, error) {
+  if index == t.primaryIndex {
+    return t.primaryKeyLength, nil
+  }
+  for _, existing := range t.indices {
+    if existing == index {
+      if index.unique == 0 {
+        return 0, errors.New("can only conflict on the primary key or a unique index")
+      }
+      return index.unique, nil
+    }
+  }
+  return 0, errors.New("index does not belong to table")
+}
+
+// fails if a row of the table other than replacing has the primary key of
+// entry, a row of the primary index
+func (t *Table) checkPrimaryKey(entry Row, replacing Row) error {
+  if t.conflicts(t.primaryIndex, t.primaryKeyLength, entry, replacing) {
+    return fmt.Errorf("%w: %v", ErrUniqueViolation, entry[:t.primaryKeyLength])
+  }
+  return nil
+}
+
+// the row of the table, in the order of the table schema, with the key of row
+// in index, nil if there isn't one
+func (t *Table) conflictingRow(index *Index, keyLength int, row Row) Row {
+  entry, belongs := index.entry(row, t.schema)
+  if !belongs {
+    return nil
+  }
+  found, ok := index.tree().find(entry[:keyLength])
+  if !ok {
+    return nil
+  }
+  rows := t.tableRows(index, t.currentSchemas(index), nil, []Row{found})
+  if len(rows) == 0 {
+    return nil
+  }
+  return rows[0]
+}
@@ -0,0 +1,102 @@
+package sql_planner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertOnConflict(t *testing.T) {
+  table := createTable(t)
+  rows := insertManyToTable(t, table, 4)
+  age := Column{Name: "age", ColumnType: INT}
+  primary := func(id int, isActive bool) []Row {
+    return table.ListWithIndex(table.primaryIndex, Row{IntField(id), BoolField(isActive)})
+  }
+
+  // the primary key is taken, so the row is left as it is
+  onConflict := OnConflict{Index: table.primaryIndex, Action: DoNothing}
+  result, err := table.InsertOnConflict(Row{StringField("momo@sheen.com"), IntField(5), IntField(1), BoolField(true)}, onConflict)
+  require.NoError(t, err)
+  require.Equal(t, Skipped, result)
+  require.Equal(t, []Row{rows[0]}, primary(1, true))
+  // including when it's the same row
+  result, err = table.InsertOnConflict(rows[0], onConflict)
+  require.NoError(t, err)
+  require.Equal(t, Skipped, result)
+
+  // or updated, with set values and values of the inserted row
+  onConflict = OnConflict{
+    Index: table.primaryIndex,
+    Action: DoUpdate,
+    Set: map[Column]Field{age: IntField(40)},
+    Excluded: []string{"email"},
+  }
+  result, err = table.InsertOnConflict(Row{StringField("momo@sheen.com"), IntField(5), IntField(1), BoolField(true)}, onConflict)
+  require.NoError(t, err)
+  require.Equal(t, Updated, result)
+  require.Equal(t, []Row{{StringField("momo@sheen.com"), IntField(40), IntField(1), BoolField(true)}}, primary(1, true))
+  result, err = table.InsertOnConflict(Row{StringField("nana@sheen.com"), IntField(5), IntField(3), BoolField(true)}, onConflict)
+  require.NoError(t, err)
+  require.Equal(t, Inserted, result)
+  require.Equal(t, []Row{{StringField("nana@sheen.com"), IntField(5), IntField(3), BoolField(true)}}, primary(3, true))
+  require.Len(t, table.ListWithIndex(table.indices[0], Row{StringField("doodle@sheen.com")}), 1)
+
+  // without ON CONFLICT, a taken primary key makes a second row, as before
+  require.NoError(t, table.Insert(Row{StringField("momo@sheen.com"), IntField(5), IntField(3), BoolField(true)}))
+  require.Len(t, primary(3, true), 2)
+  // but not with it, when the conflict is on another index
+  unique, err := table.AddUniqueIndex([]string{"age", "email"})
+  require.NoError(t, err)
+  _, err = table.InsertOnConflict(Row{StringField("lulu@sheen.com"), IntField(5), IntField(3), BoolField(true)}, OnConflict{Index: unique})
+  require.ErrorIs(t, err, ErrUniqueViolation)
+  require.Len(t, primary(3, true), 2)
+
+  // conflicts need a key that's unique
+  _, err = table.InsertOnConflict(rows[1], OnConflict{Index: table.indices[0]})
+  require.Error(t, err)
+  onConflict.Excluded = []string{"height"}
+  _, err = table.InsertOnConflict(rows[1], onConflict)
+  require.Error(t, err)
+  _, err = table.InsertOnConflict(Row{StringField("momo@sheen.com")}, onConflict)
+  require.ErrorIs(t, err, ErrSchemaMismatch)
+  report := table.CheckIntegrity()
+  require.True(t, report.OK(), report.String())
+}
+
+func TestBatchInsertOnConflict(t *testing.T) {
+  db := NewDatabase()
+  users, err := db.CreateTable("users", []Column{
+    {Name: "id", ColumnType: INT},
+    {Name: "email", ColumnType: STRING},
+    {Name: "visits", ColumnType: INT},
+  }, []string{"id"})
+  require.NoError(t, err)
+  require.NoError(t, users.Insert(Row{IntField(1), StringField("a@sheen.com"), IntField(1)}))
+  byEmail, err := db.CreateUniqueIndex("users_email", "users", []string{"email"})
+  require.NoError(t, err)
+
+  // on the email, which rows also conflict on with the ones before them
+  results, err := users.BatchInsertOnConflict([]Row{
+    {IntField(2), StringField("b@sheen.com"), IntField(1)},
+    {IntField(3), StringField("a@sheen.com"), IntField(5)},
+    {IntField(4), StringField("b@sheen.com"), IntField(7)},
+    {IntField(5), StringField("c@sheen.com"), IntField(1)},
+  }, OnConflict{Index: byEmail, Action: DoUpdate, Excluded: []string{"visits"}})
+  require.NoError(t, err)
+  require.Equal(t, []InsertResult{Inserted, Updated, Updated, Inserted}, results)
+  require.Equal(t, []Row{
+    {IntField(1), StringField("a@sheen.com"), IntField(5)},
+    {IntField(2), StringField("b@sheen.com"), IntField(7)},
+    {IntField(5), StringField("c@sheen.com"), IntField(1)},
+  }, users.ListWithIndex(users.PrimaryIndex(), Row{}))
+
+  // a conflict on the primary key, which isn't the index rows conflict on
+  results, err = users.BatchInsertOnConflict([]Row{
+    {IntField(6), StringField("d@sheen.com"), IntField(1)},
+    {IntField(7), StringField("c@sheen.com"), IntField(1)},
+    {IntField(6), StringField("e@sheen.com"), IntField(1)},
+  }, OnConflict{Index: byEmail, Action: DoNothing})
+  require.ErrorIs(t, err, ErrUniqueViolation)
+  require.Equal(t, []InsertResult{Inserted, Skipped}, results)
+}